@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/auth"
+	"os"
+)
+
+// keygen создаёт новый ключ подписи (HS256, с -rsa — RS256). С -f ключ дописывается в файл связки
+// (файл создаётся, если его нет), с -activate новые токены подписываются им.
+// Старые ключи остаются в файле, пока их не удалят вручную.
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	path := fs.String("f", "", "key ring file to add the key to")
+	activate := fs.Bool("activate", false, "sign new tokens with the generated key")
+	rsaKey := fs.Bool("rsa", false, "generate an RS256 key pair instead of an HS256 secret")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	generate := auth.GenerateKey
+	if *rsaKey {
+		generate = auth.GenerateRSAKey
+	}
+
+	key, err := generate()
+	if err != nil {
+		return err
+	}
+
+	if *path == "" {
+		fmt.Printf("%v %v\n", key.ID, base64.StdEncoding.EncodeToString(key.Secret))
+		return nil
+	}
+
+	kf, err := auth.ReadKeyFile(*path)
+	if os.IsNotExist(err) {
+		kf, err = &auth.KeyFile{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	kf.Add(key, *activate)
+
+	// не сохраняем файл, с которым сервер потом не запустится
+	if _, err := kf.KeyRing(); err != nil {
+		return err
+	}
+
+	if err := kf.WriteFile(*path); err != nil {
+		return err
+	}
+
+	fmt.Printf("added key %v, active key %v\n", key.ID, kf.Active)
+
+	// публичную часть можно раздать сервисам, которые только проверяют токены
+	if *rsaKey {
+		public, err := auth.PublicKeyPEM(key)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s", public)
+	}
+
+	return nil
+}
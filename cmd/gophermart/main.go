@@ -2,9 +2,17 @@ package main
 
 import (
 	"context"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/accrual"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/auth"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/config"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/expiry"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/handlers"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/poller"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/reconcile"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository/memory"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/server"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/throttle"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/wpool"
 	"log"
 	"os"
@@ -14,23 +22,106 @@ import (
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		if err := keygen(os.Args[2:]); err != nil {
+			log.Fatalf("keygen failed:+%v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:]); err != nil {
+			log.Fatalf("migrate failed:+%v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		if err := reconcileBalances(os.Args[2:]); err != nil {
+			log.Fatalf("reconcile failed:+%v", err)
+		}
+		return
+	}
+
 	config, err := config.New()
 	if err != nil {
 		log.Fatalf("failed to configurate:+%v", err)
 	}
 
 	config.InitFlags()
-	
-	repo, err := repository.New(config.DBURL)
+
+	keys, ephemeral, err := auth.Load(config.TokenKeysFile, config.TokenSecret)
 	if err != nil {
-		log.Fatalf("failed to init repository:+%v", err)
+		log.Fatalf("failed to load signing keys:+%v", err)
+	}
+
+	keys = keys.WithAudience(config.TokenIssuer, config.TokenAudience)
+
+	if ephemeral {
+		log.Print("TOKEN_KEYS_FILE and TOKEN_SECRET are not set, tokens will not survive restart")
+	}
+	
+	var repo repository.Repositorier
+
+	// хранилище в памяти — только по явному запросу: без DATABASE_URI сервис, как и раньше, не стартует
+	if config.Storage == "memory" {
+		log.Print("STORAGE=memory, data is kept in memory and will not survive restart")
+		repo = memory.New()
+	} else {
+		pg, err := repository.New(config.DBURL,
+			repository.WithMaxConns(int32(config.DBMaxConns)),
+			repository.WithMinConns(int32(config.DBMinConns)),
+			repository.WithConnLifetime(config.DBConnLifetime),
+			repository.WithConnIdleTime(config.DBConnIdleTime),
+			repository.WithConnectTimeout(config.DBConnectTimeout),
+			repository.WithStatementTimeout(config.DBStatementTimeout),
+		)
+		if err != nil {
+			log.Fatalf("failed to init repository:+%v", err)
+		}
+
+		repo = pg
 	}
 
 	workersCounter := runtime.NumCPU()
 
 	wp := wpool.New(workersCounter);
 
-	s := server.New(config.Address, config.AccrualURL, repo, wp)
+	limiter := accrual.NewLimiter(config.AccrualRateLimit)
+
+	client, err := accrual.NewClient(config.AccrualURL, accrual.WithLimiter(limiter))
+	if err != nil {
+		log.Fatalf("failed to init accrual client:+%v", err)
+	}
+
+	p := poller.New(repo, wp, client, workersCounter)
+
+	rc := reconcile.New(repo, config.ReconcileInterval, config.ReconcileRepair)
+
+	expirer := expiry.New(repo, config.PointsTTL, config.ExpiryInterval)
+
+	var store throttle.Store = repo
+	if config.LoginStore == "memory" {
+		store = throttle.NewMemory()
+	}
+
+	guard := throttle.New(store, throttle.Policy{
+		MaxFailures: config.LoginMaxFailures,
+		BaseLockout: config.LoginLockout,
+		MaxLockout:  config.LoginMaxLockout,
+		Window:      config.LoginWindow,
+	}, throttle.Policy{
+		MaxFailures: config.IPMaxFailures,
+		BaseLockout: config.LoginLockout,
+		MaxLockout:  config.LoginMaxLockout,
+		Window:      config.LoginWindow,
+	})
+
+	s := server.New(config.Address, config.AccrualURL, repo, wp, p, handlers.Sessions{
+		Keys:       keys,
+		AccessTTL:  config.AccessTTL,
+		SessionTTL: config.SessionTTL,
+	}, guard, config.TrustProxy)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -43,8 +134,13 @@ func main() {
 		cancel()
 	}()
 
+	go rc.Run(ctx)
+	go expirer.Run(ctx)
+
 	if err := s.Run(ctx); err != nil {
 		log.Printf("failed to serve:+%v\n", err)
 	}
 
+	repo.Close()
+
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/config"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/migrator"
+	"github.com/DatDomrachev/go-loyalty-system/migrations"
+	"github.com/jackc/pgx/v4"
+)
+
+// migrate up|down|status работает с теми же встроенными миграциями, что сервис применяет при старте.
+// down откатывает одну последнюю применённую миграцию.
+func migrate(args []string) error {
+	cfg, err := config.New()
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.StringVar(&cfg.DBURL, "d", cfg.DBURL, "data base url")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gophermart migrate [-d url] up|down|status")
+	}
+
+	if cfg.DBURL == "" {
+		return fmt.Errorf("DATABASE_URI is not set")
+	}
+
+	ctx := context.Background()
+
+	conn, err := pgx.Connect(ctx, cfg.DBURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	m, err := migrator.New(conn, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	switch fs.Arg(0) {
+	case "up":
+		done, err := m.Up(ctx)
+		for _, migration := range done {
+			fmt.Printf("applied %v_%v\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Println("no pending migrations")
+		}
+
+	case "down":
+		migration, err := m.Down(ctx)
+		if err != nil {
+			return err
+		}
+		if migration == nil {
+			fmt.Println("no applied migrations")
+			return nil
+		}
+		fmt.Printf("rolled back %v_%v\n", migration.Version, migration.Name)
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%v_%v\t%v\n", status.Version, status.Name, applied)
+		}
+
+	default:
+		return fmt.Errorf("unknown migrate command %q", fs.Arg(0))
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/config"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+)
+
+// reconcileBalances (gophermart reconcile) сверяет балансы пользователей с транзакциями и печатает расхождения.
+// Без -repair найденные расхождения — ошибка, чтобы их было видно по коду выхода.
+func reconcileBalances(args []string) error {
+	cfg, err := config.New()
+	if err != nil {
+		return err
+	}
+
+	repair := false
+
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	fs.StringVar(&cfg.DBURL, "d", cfg.DBURL, "data base url")
+	fs.BoolVar(&repair, "repair", repair, "set mismatched balances to the values derived from transactions")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: gophermart reconcile [-d url] [-repair]")
+	}
+
+	if cfg.DBURL == "" {
+		return fmt.Errorf("DATABASE_URI is not set")
+	}
+
+	// отчёт не должен менять схему: при неприменённых миграциях сверка просто не запускается
+	repo, err := repository.New(cfg.DBURL, repository.WithConnectTimeout(cfg.DBConnectTimeout), repository.WithoutMigrations())
+	if err != nil {
+		return err
+	}
+	defer repo.Close()
+
+	mismatches, err := repo.Reconcile(context.Background(), repair)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mismatches {
+		state := "mismatch"
+		if m.Repaired {
+			state = "repaired"
+		}
+		fmt.Printf("%v\t%v\tbalance %v -> %v\twithdrawn %v -> %v\n", state, m.UserToken, m.Balance, m.LedgerBalance, m.Withdrawn, m.LedgerWithdrawn)
+	}
+
+	if len(mismatches) == 0 {
+		fmt.Println("all balances match transactions")
+		return nil
+	}
+
+	if !repair {
+		return fmt.Errorf("%v balances do not match transactions, run with -repair to fix them", len(mismatches))
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package accrualtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/accrual"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server — поддельная система расчёта начислений поверх httptest.
+// Незарегистрированные заказы отвечают 204, как настоящий accrual.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	orders     map[string]accrual.OrderStatus
+	requests   map[string]int
+	throttled  int
+	retryAfter time.Duration
+	perMinute  int
+	failures   int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		orders:   make(map[string]accrual.OrderStatus),
+		requests: make(map[string]int),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveOrder))
+
+	return s
+}
+
+func (s *Server) SetOrder(number string, status string, points money.Amount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.orders[number] = accrual.OrderStatus{
+		Order:   number,
+		Status:  status,
+		Accrual: points,
+	}
+}
+
+// Throttle отвечает 429 на следующие n запросов.
+func (s *Server) Throttle(n int, retryAfter time.Duration, perMinute int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.throttled = n
+	s.retryAfter = retryAfter
+	s.perMinute = perMinute
+}
+
+// Fail отвечает 500 на следующие n запросов.
+func (s *Server) Fail(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = n
+}
+
+func (s *Server) Requests(number string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[number]
+}
+
+func (s *Server) serveOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, "/api/orders/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[number]++
+
+	if s.throttled > 0 {
+		s.throttled--
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.retryAfter.Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than %v requests per minute allowed", s.perMinute)
+		return
+	}
+
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	order, ok := s.orders[number]
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
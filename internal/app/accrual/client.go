@@ -0,0 +1,214 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	StatusRegistered = "REGISTERED"
+	StatusInvalid    = "INVALID"
+	StatusProcessing = "PROCESSING"
+	StatusProcessed  = "PROCESSED"
+	// StatusUnregistered — accrual ответил 204, заказ ему пока не известен
+	StatusUnregistered = "UNREGISTERED"
+)
+
+const defaultTimeout = 10 * time.Second
+
+type OrderStatus struct {
+	Order   string       `json:"order"`
+	Status  string       `json:"status"`
+	Accrual money.Amount `json:"accrual"`
+}
+
+type Clienter interface {
+	GetOrder(ctx context.Context, number string) (OrderStatus, error)
+}
+
+type NoContentError struct {
+	Order string
+}
+
+type TooManyRequestsError struct {
+	Order      string
+	RetryAfter time.Duration
+	PerMinute  int
+}
+
+type ServerError struct {
+	Order      string
+	StatusCode int
+}
+
+type RequestError struct {
+	Order string
+	Err   error
+}
+
+type BadResponseError struct {
+	Order   string
+	Message string
+}
+
+func (nce *NoContentError) Error() string {
+	return fmt.Sprintf("order %v is not registered in accrual", nce.Order)
+}
+
+func (tmr *TooManyRequestsError) Error() string {
+	return fmt.Sprintf("too many requests on order %v, retry after %v", tmr.Order, tmr.RetryAfter)
+}
+
+func (se *ServerError) Error() string {
+	return fmt.Sprintf("accrual responded %v on order %v", se.StatusCode, se.Order)
+}
+
+func (re *RequestError) Error() string {
+	return fmt.Sprintf("unable to do request to accrual on order %v: %v", re.Order, re.Err)
+}
+
+func (re *RequestError) Unwrap() error {
+	return re.Err
+}
+
+func (bre *BadResponseError) Error() string {
+	return fmt.Sprintf("bad accrual response on order %v: %v", bre.Order, bre.Message)
+}
+
+type Client struct {
+	baseURL *url.URL
+	http    *http.Client
+	limiter *Limiter
+}
+
+type Option func(c *Client)
+
+// WithTransport подменяет транспорт, например на httptest или с другими настройками пула соединений.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		c.http.Transport = rt
+	}
+}
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.http.Timeout = timeout
+	}
+}
+
+func WithLimiter(limiter *Limiter) Option {
+	return func(c *Client) {
+		c.limiter = limiter
+	}
+}
+
+func NewClient(baseURL string, opts ...Option) (*Client, error) {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 100
+	transport.IdleConnTimeout = 90 * time.Second
+
+	c := &Client{
+		baseURL: u,
+		http: &http.Client{
+			Transport: transport,
+			Timeout:   defaultTimeout,
+		},
+		limiter: NewLimiter(0),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+func (c *Client) orderURL(number string) string {
+	u := *c.baseURL
+	u.Path = path.Join("/", u.Path, "api/orders", number)
+	return u.String()
+}
+
+func (c *Client) GetOrder(ctx context.Context, number string) (OrderStatus, error) {
+	var status OrderStatus
+
+	// ждём общий для всех воркеров лимит, чтобы не долбить accrual во время паузы
+	if err := c.limiter.Wait(ctx); err != nil {
+		return status, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.orderURL(number), nil)
+	if err != nil {
+		return status, &RequestError{Order: number, Err: err}
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return status, &RequestError{Order: number, Err: err}
+	}
+
+	defer func() {
+		// дочитываем тело, чтобы соединение вернулось в пул
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+			return status, &BadResponseError{Order: number, Message: err.Error()}
+		}
+
+		if status.Status == "" {
+			return status, &BadResponseError{Order: number, Message: "empty status"}
+		}
+
+		if status.Order == "" {
+			status.Order = number
+		}
+
+		return status, nil
+
+	case http.StatusNoContent:
+		return status, &NoContentError{Order: number}
+
+	case http.StatusTooManyRequests:
+		retryAfter, ok := ParseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			retryAfter = DefaultRetryAfter
+		}
+		c.limiter.Pause(retryAfter)
+
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		perMinute, _ := ParseRateLimit(string(body))
+		c.limiter.Limit(perMinute)
+
+		return status, &TooManyRequestsError{
+			Order:      number,
+			RetryAfter: retryAfter,
+			PerMinute:  perMinute,
+		}
+
+	default:
+		return status, &ServerError{Order: number, StatusCode: res.StatusCode}
+	}
+}
@@ -0,0 +1,98 @@
+package accrual_test
+
+import (
+	"context"
+	"errors"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/accrual"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/accrual/accrualtest"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingTransport struct {
+	calls int32
+	next  http.RoundTripper
+}
+
+func (ct *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&ct.calls, 1)
+	return ct.next.RoundTrip(r)
+}
+
+func TestClient_GetOrder(t *testing.T) {
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	srv.SetOrder("12345678903", accrual.StatusProcessed, money.MustParse("729.98"))
+	srv.SetOrder("9278923470", accrual.StatusRegistered, 0)
+
+	client, err := accrual.NewClient(srv.URL)
+	require.NoError(t, err)
+
+	status, err := client.GetOrder(context.Background(), "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, accrual.OrderStatus{Order: "12345678903", Status: accrual.StatusProcessed, Accrual: money.MustParse("729.98")}, status)
+
+	status, err = client.GetOrder(context.Background(), "9278923470")
+	require.NoError(t, err)
+	assert.Equal(t, accrual.StatusRegistered, status.Status)
+
+	_, err = client.GetOrder(context.Background(), "2377225624")
+	var nce *accrual.NoContentError
+	assert.True(t, errors.As(err, &nce))
+
+	srv.Fail(1)
+	_, err = client.GetOrder(context.Background(), "12345678903")
+	var se *accrual.ServerError
+	require.True(t, errors.As(err, &se))
+	assert.Equal(t, http.StatusInternalServerError, se.StatusCode)
+}
+
+func TestClient_TooManyRequests(t *testing.T) {
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	srv.SetOrder("12345678903", accrual.StatusProcessing, 0)
+	srv.Throttle(1, time.Second, 20)
+
+	limiter := accrual.NewLimiter(0)
+	client, err := accrual.NewClient(srv.URL, accrual.WithLimiter(limiter))
+	require.NoError(t, err)
+
+	_, err = client.GetOrder(context.Background(), "12345678903")
+	var tmr *accrual.TooManyRequestsError
+	require.True(t, errors.As(err, &tmr))
+	assert.Equal(t, time.Second, tmr.RetryAfter)
+	assert.Equal(t, 20, tmr.PerMinute)
+	assert.Equal(t, 20, limiter.PerMinute())
+
+	// пока идёт пауза, запросы не уходят даже по другим заказам
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = client.GetOrder(ctx, "9278923470")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, 0, srv.Requests("9278923470"))
+}
+
+func TestClient_Transport(t *testing.T) {
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	srv.SetOrder("12345678903", accrual.StatusInvalid, 0)
+
+	transport := &countingTransport{next: http.DefaultTransport}
+	client, err := accrual.NewClient(srv.URL+"/", accrual.WithTransport(transport))
+	require.NoError(t, err)
+
+	status, err := client.GetOrder(context.Background(), "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, accrual.StatusInvalid, status.Status)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&transport.calls))
+	assert.Equal(t, 1, srv.Requests("12345678903"))
+}
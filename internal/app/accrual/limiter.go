@@ -0,0 +1,157 @@
+package accrual
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultRetryAfter = 60 * time.Second
+
+var rateLimitRe = regexp.MustCompile(`(?i)no more than (\d+) requests per minute allowed`)
+
+// Limiter общий для всех запросов к accrual: token bucket на N запросов в минуту
+// плюс глобальная пауза после 429.
+type Limiter struct {
+	mu          sync.Mutex
+	perMinute   int
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	now         func() time.Time
+}
+
+// NewLimiter создаёт лимитер; perMinute == 0 означает отсутствие ограничения, пока accrual не сообщит своё.
+func NewLimiter(perMinute int) *Limiter {
+	return &Limiter{
+		perMinute: perMinute,
+		tokens:    1,
+		now:       time.Now,
+	}
+}
+
+// Wait блокируется, пока не закончится пауза и в bucket не появится токен.
+func (l *Limiter) Wait(ctx context.Context) error {
+	for {
+		delay := l.reserve()
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (l *Limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+
+	if l.perMinute <= 0 {
+		return 0
+	}
+
+	interval := time.Minute / time.Duration(l.perMinute)
+
+	if !l.last.IsZero() {
+		l.tokens += float64(now.Sub(l.last)) / float64(interval)
+		if l.tokens > 1 {
+			l.tokens = 1
+		}
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - l.tokens) * float64(interval))
+}
+
+// Pause останавливает все исходящие запросы на d.
+func (l *Limiter) Pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until := l.now().Add(d)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// Limit снижает лимит до perMinute, если он строже текущего.
+func (l *Limiter) Limit(perMinute int) {
+	if perMinute <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perMinute == 0 || perMinute < l.perMinute {
+		l.perMinute = perMinute
+	}
+}
+
+func (l *Limiter) PerMinute() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.perMinute
+}
+
+// ParseRetryAfter понимает обе формы заголовка: число секунд и HTTP-дату.
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	if date.Before(now) {
+		return 0, true
+	}
+
+	return date.Sub(now), true
+}
+
+// ParseRateLimit достаёт N из тела ответа "No more than N requests per minute allowed".
+func ParseRateLimit(body string) (int, bool) {
+	m := rateLimitRe.FindStringSubmatch(body)
+	if m == nil {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+
+	return n, true
+}
@@ -0,0 +1,88 @@
+package accrual
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{name: "seconds", value: "60", want: 60 * time.Second, ok: true},
+		{name: "spaces", value: " 5 ", want: 5 * time.Second, ok: true},
+		{name: "http date", value: "Mon, 10 Jan 2022 12:00:30 GMT", want: 30 * time.Second, ok: true},
+		{name: "date in past", value: "Mon, 10 Jan 2022 11:00:00 GMT", want: 0, ok: true},
+		{name: "empty", value: "", ok: false},
+		{name: "negative", value: "-1", ok: false},
+		{name: "garbage", value: "soon", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseRetryAfter(tt.value, now)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	n, ok := ParseRateLimit("No more than 20 requests per minute allowed")
+	assert.True(t, ok)
+	assert.Equal(t, 20, n)
+
+	_, ok = ParseRateLimit("Too Many Requests")
+	assert.False(t, ok)
+
+	_, ok = ParseRateLimit("No more than 0 requests per minute allowed")
+	assert.False(t, ok)
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	l := NewLimiter(0)
+	l.now = func() time.Time { return now }
+
+	// без лимита запросы проходят сразу
+	assert.Equal(t, time.Duration(0), l.reserve())
+	assert.Equal(t, time.Duration(0), l.reserve())
+
+	l.Limit(60)
+	assert.Equal(t, 60, l.PerMinute())
+
+	// более мягкий лимит не ослабляет текущий
+	l.Limit(120)
+	assert.Equal(t, 60, l.PerMinute())
+
+	assert.Equal(t, time.Duration(0), l.reserve())
+	assert.Equal(t, time.Second, l.reserve())
+
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), l.reserve())
+
+	l.Pause(30 * time.Second)
+	assert.Equal(t, 30*time.Second, l.reserve())
+
+	now = now.Add(31 * time.Second)
+	assert.Equal(t, time.Duration(0), l.reserve())
+}
+
+func TestLimiter_WaitCancel(t *testing.T) {
+	l := NewLimiter(0)
+	l.Pause(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, l.Wait(ctx), context.DeadlineExceeded)
+}
@@ -1,25 +1,55 @@
 package auth
 
 import (
-	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/hex"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 )
 
-
-var SecretKey = []byte("secret key of My Castle")
-
-func GetToken(userID int) (token string) {
+// NewUserToken выдаёт постоянный идентификатор пользователя, под которым хранятся его заказы и баланс.
+// Секрета в нём нет: в cookie он попадает только внутри подписанного токена.
+func NewUserToken(userID int) (string, error) {
 
 	//userId
 	src := make([]byte, 8)
 	ID := uint64(userID)
 	binary.LittleEndian.PutUint64(src, ID)
 
-	//подпись
-	h := hmac.New(sha256.New, SecretKey)
-	h.Write(src)
-	
-	return hex.EncodeToString(src) + hex.EncodeToString(h.Sum(nil))
+	//случайная часть
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(src) + hex.EncodeToString(nonce), nil
+}
+
+// NewSessionID — случайный идентификатор сессии, он же jti токена.
+func NewSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// NewRefreshToken возвращает непрозрачный refresh-токен для клиента и его хеш для БД.
+func NewRefreshToken() (token string, hash string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(raw)
+
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken: в БД лежит только sha256 токена, утечка таблицы не даёт войти.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,371 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// MinKeyLen — минимальная длина ключа HMAC-SHA256 в байтах.
+const MinKeyLen = 32
+
+const RSAKeyBits = 2048
+
+type KeyError struct {
+	Message string
+}
+
+func (ke *KeyError) Error() string {
+	return fmt.Sprintf("%v", ke.Message)
+}
+
+type UnknownKeyError struct {
+	KeyID string
+}
+
+func (uke *UnknownKeyError) Error() string {
+	return fmt.Sprintf("unknown signing key %q", uke.KeyID)
+}
+
+// KeyRing подписывает токены активным ключом и проверяет любым из известных.
+// Идентификатор ключа кладётся в заголовок kid, поэтому при ротации старые токены
+// продолжают проходить, пока их ключ остаётся в связке.
+type KeyRing struct {
+	active   string
+	keys     map[string]signingKey
+	issuer   string
+	audience string
+}
+
+// signingKey — ключ вместе с алгоритмом: токен проверяется только тем алгоритмом,
+// под который заведён ключ, а не тем, что написано в его заголовке.
+type signingKey struct {
+	method jwt.SigningMethod
+	sign   interface{}
+	verify interface{}
+}
+
+// parseKey: PEM с ключом RSA — RS256 (публичный ключ годится только для проверки),
+// иначе это секрет HS256.
+func parseKey(id string, data []byte) (signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		if len(data) < MinKeyLen {
+			return signingKey{}, &KeyError{Message: fmt.Sprintf("key %q is shorter than %v bytes", id, MinKeyLen)}
+		}
+
+		secret := append([]byte(nil), data...)
+		return signingKey{method: jwt.SigningMethodHS256, sign: secret, verify: secret}, nil
+	}
+
+	if private, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return signingKey{method: jwt.SigningMethodRS256, sign: private, verify: &private.PublicKey}, nil
+	}
+
+	public, err := jwt.ParseRSAPublicKeyFromPEM(data)
+	if err != nil {
+		return signingKey{}, &KeyError{Message: fmt.Sprintf("key %q: %v", id, err)}
+	}
+
+	return signingKey{method: jwt.SigningMethodRS256, verify: public}, nil
+}
+
+func NewKeyRing(active string, keys map[string][]byte) (*KeyRing, error) {
+	if len(keys) == 0 {
+		return nil, &KeyError{Message: "key ring is empty"}
+	}
+
+	ring := &KeyRing{
+		active: active,
+		keys:   make(map[string]signingKey, len(keys)),
+	}
+
+	for id, data := range keys {
+		if id == "" {
+			return nil, &KeyError{Message: "key id is empty"}
+		}
+
+		key, err := parseKey(id, data)
+		if err != nil {
+			return nil, err
+		}
+
+		ring.keys[id] = key
+	}
+
+	key, ok := ring.keys[active]
+	if !ok {
+		return nil, &UnknownKeyError{KeyID: active}
+	}
+
+	if key.sign == nil {
+		return nil, &KeyError{Message: fmt.Sprintf("active key %q has no private part", active)}
+	}
+
+	return ring, nil
+}
+
+// WithAudience возвращает связку, которая пишет iss и aud в новые токены и требует их при проверке.
+// Пустое значение отключает соответствующую проверку.
+func (kr *KeyRing) WithAudience(issuer string, audience string) *KeyRing {
+	ring := *kr
+	ring.issuer = issuer
+	ring.audience = audience
+
+	return &ring
+}
+
+// FromSecret собирает связку из одного ключа, заданного строкой; kid — отпечаток секрета.
+func FromSecret(secret string) (*KeyRing, error) {
+	sum := sha256.Sum256([]byte(secret))
+	id := hex.EncodeToString(sum[:4])
+
+	return NewKeyRing(id, map[string][]byte{id: []byte(secret)})
+}
+
+// Load читает связку из файла, а если он не задан — берёт единственный секрет.
+// Без того и другого ключ генерируется на время работы процесса.
+func Load(path string, secret string) (*KeyRing, bool, error) {
+	if path != "" {
+		kf, err := ReadKeyFile(path)
+		if err != nil {
+			return nil, false, err
+		}
+
+		ring, err := kf.KeyRing()
+		return ring, false, err
+	}
+
+	if secret != "" {
+		ring, err := FromSecret(secret)
+		return ring, false, err
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, false, err
+	}
+
+	ring, err := NewKeyRing(key.ID, map[string][]byte{key.ID: key.Secret})
+	return ring, true, err
+}
+
+func (kr *KeyRing) ActiveKeyID() string {
+	return kr.active
+}
+
+func (kr *KeyRing) KeyIDs() []string {
+	ids := make([]string, 0, len(kr.keys))
+	for id := range kr.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Claims — содержимое токена: сессия, пользователь и срок действия.
+type Claims struct {
+	SessionID string
+	UserToken string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// Sign выпускает токен сессии, подписанный активным ключом.
+func (kr *KeyRing) Sign(c Claims) (string, error) {
+	claims := jwt.RegisteredClaims{
+		ID:        c.SessionID,
+		Subject:   c.UserToken,
+		Issuer:    kr.issuer,
+		IssuedAt:  jwt.NewNumericDate(c.IssuedAt),
+		NotBefore: jwt.NewNumericDate(c.IssuedAt),
+		ExpiresAt: jwt.NewNumericDate(c.ExpiresAt),
+	}
+
+	if kr.audience != "" {
+		claims.Audience = jwt.ClaimStrings{kr.audience}
+	}
+
+	key := kr.keys[kr.active]
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = kr.active
+
+	return token.SignedString(key.sign)
+}
+
+// Verify проверяет подпись ключом из kid, срок действия (exp, nbf), издателя и аудиторию.
+// Любой отказ — одна из ошибок MalformedTokenError, UnknownKeyError, InvalidSignatureError,
+// ExpiredTokenError или InvalidClaimsError; паники и чтения за пределами токена не бывает.
+// Отозвана ли сессия, токен не знает — это проверяет вызывающий по SessionID.
+func (kr *KeyRing) Verify(tokenString string) (*Claims, error) {
+	header, err := parseHeader(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := kr.keys[header.Kid]
+	if !ok {
+		return nil, &UnknownKeyError{KeyID: header.Kid}
+	}
+
+	// алгоритм задаёт ключ, а не заголовок: HS256 с публичным ключом RSA в роли секрета не пройдёт
+	if header.Alg != key.method.Alg() {
+		return nil, &InvalidSignatureError{KeyID: header.Kid}
+	}
+
+	claims := &jwt.RegisteredClaims{}
+
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return key.verify, nil
+	}, jwt.WithValidMethods([]string{key.method.Alg()}))
+
+	if err != nil {
+		return nil, validationError(header.Kid, claims, err)
+	}
+
+	if claims.Subject == "" || claims.ID == "" || claims.ExpiresAt == nil || claims.IssuedAt == nil {
+		return nil, &InvalidClaimsError{Message: "token misses required claims"}
+	}
+
+	if kr.issuer != "" && !claims.VerifyIssuer(kr.issuer, true) {
+		return nil, &InvalidClaimsError{Message: "token has invalid issuer"}
+	}
+
+	if kr.audience != "" && !claims.VerifyAudience(kr.audience, true) {
+		return nil, &InvalidClaimsError{Message: "token has invalid audience"}
+	}
+
+	return &Claims{
+		SessionID: claims.ID,
+		UserToken: claims.Subject,
+		IssuedAt:  claims.IssuedAt.Time,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// GenerateKey создаёт случайный ключ; в id входит дата, чтобы по нему было видно возраст ключа.
+func GenerateKey() (Key, error) {
+	secret := make([]byte, MinKeyLen)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return Key{}, err
+	}
+
+	return Key{
+		ID:     time.Now().UTC().Format("20060102") + "-" + hex.EncodeToString(suffix),
+		Secret: secret,
+	}, nil
+}
+
+// GenerateRSAKey создаёт ключ RS256; Secret — закрытый ключ в PEM.
+// Сервисы, которые только проверяют токены, получают публичную часть из PublicKeyPEM.
+func GenerateRSAKey() (Key, error) {
+	key, err := GenerateKey()
+	if err != nil {
+		return Key{}, err
+	}
+
+	private, err := rsa.GenerateKey(rand.Reader, RSAKeyBits)
+	if err != nil {
+		return Key{}, err
+	}
+
+	key.Secret = pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(private),
+	})
+
+	return key, nil
+}
+
+func PublicKeyPEM(key Key) ([]byte, error) {
+	private, err := jwt.ParseRSAPrivateKeyFromPEM(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// KeyFile — формат файла ключей: {"active": "<kid>", "keys": {"<kid>": "<base64>"}}.
+// Значение — секрет HS256 или PEM ключа RSA, в обоих случаях в base64.
+type KeyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+func ReadKeyFile(path string) (*KeyFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	kf := &KeyFile{}
+	if err := json.Unmarshal(data, kf); err != nil {
+		return nil, &KeyError{Message: fmt.Sprintf("key file %v: %v", path, err)}
+	}
+
+	return kf, nil
+}
+
+func (kf *KeyFile) WriteFile(path string) error {
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// Add добавляет ключ в файл; activate делает его ключом для подписи новых токенов.
+func (kf *KeyFile) Add(key Key, activate bool) {
+	if kf.Keys == nil {
+		kf.Keys = make(map[string]string)
+	}
+
+	kf.Keys[key.ID] = base64.StdEncoding.EncodeToString(key.Secret)
+
+	if activate || kf.Active == "" {
+		kf.Active = key.ID
+	}
+}
+
+func (kf *KeyFile) KeyRing() (*KeyRing, error) {
+	keys := make(map[string][]byte, len(kf.Keys))
+
+	for id, encoded := range kf.Keys {
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, &KeyError{Message: fmt.Sprintf("key %q: %v", id, err)}
+		}
+		keys[id] = secret
+	}
+
+	return NewKeyRing(kf.Active, keys)
+}
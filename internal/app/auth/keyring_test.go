@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T) Key {
+	key, err := GenerateKey()
+	require.NoError(t, err)
+
+	return key
+}
+
+func testClaims(userToken string) Claims {
+	now := time.Now()
+
+	return Claims{
+		SessionID: "session-" + userToken,
+		UserToken: userToken,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+}
+
+func TestKeyRing_SignVerify(t *testing.T) {
+	key := testKey(t)
+	ring, err := NewKeyRing(key.ID, map[string][]byte{key.ID: key.Secret})
+	require.NoError(t, err)
+
+	token, err := ring.Sign(testClaims("user-1"))
+	require.NoError(t, err)
+
+	claims, err := ring.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", claims.UserToken)
+	assert.Equal(t, "session-user-1", claims.SessionID)
+
+	// подпись от другой части токена не подходит
+	parts := strings.Split(token, ".")
+	other, err := ring.Sign(testClaims("user-2"))
+	require.NoError(t, err)
+	forged := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+
+	_, err = ring.Verify(forged)
+	assert.Error(t, err)
+
+	// токены старого формата hex(id)+hmac больше не принимаются
+	_, err = ring.Verify("0100000000000000" + strings.Repeat("ab", 32))
+	assert.Error(t, err)
+}
+
+func TestKeyRing_Rotation(t *testing.T) {
+	old := testKey(t)
+	oldRing, err := NewKeyRing(old.ID, map[string][]byte{old.ID: old.Secret})
+	require.NoError(t, err)
+
+	oldToken, err := oldRing.Sign(testClaims("user-1"))
+	require.NoError(t, err)
+
+	next := Key{ID: old.ID + "-next", Secret: bytes.Repeat([]byte{1}, MinKeyLen)}
+	ring, err := NewKeyRing(next.ID, map[string][]byte{old.ID: old.Secret, next.ID: next.Secret})
+	require.NoError(t, err)
+
+	// старый ключ ещё в связке: выданные им токены проходят
+	claims, err := ring.Verify(oldToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", claims.UserToken)
+
+	newToken, err := ring.Sign(testClaims("user-1"))
+	require.NoError(t, err)
+
+	// после удаления старого ключа его токены отклоняются
+	retired, err := NewKeyRing(next.ID, map[string][]byte{next.ID: next.Secret})
+	require.NoError(t, err)
+
+	_, err = retired.Verify(newToken)
+	assert.NoError(t, err)
+
+	_, err = retired.Verify(oldToken)
+	var uke *UnknownKeyError
+	assert.True(t, errors.As(err, &uke))
+}
+
+func TestKeyRing_Expired(t *testing.T) {
+	key := testKey(t)
+	ring, err := NewKeyRing(key.ID, map[string][]byte{key.ID: key.Secret})
+	require.NoError(t, err)
+
+	claims := testClaims("user-1")
+	claims.IssuedAt = time.Now().Add(-2 * time.Hour)
+	claims.ExpiresAt = time.Now().Add(-time.Hour)
+
+	token, err := ring.Sign(claims)
+	require.NoError(t, err)
+
+	_, err = ring.Verify(token)
+	assert.Error(t, err)
+}
+
+func TestKeyRing_RS256(t *testing.T) {
+	key, err := GenerateRSAKey()
+	require.NoError(t, err)
+
+	ring, err := NewKeyRing(key.ID, map[string][]byte{key.ID: key.Secret})
+	require.NoError(t, err)
+
+	token, err := ring.Sign(testClaims("user-1"))
+	require.NoError(t, err)
+
+	// сервису, который только проверяет токены, достаточно публичного ключа
+	public, err := PublicKeyPEM(key)
+	require.NoError(t, err)
+
+	hmacKey := testKey(t)
+	verifier, err := NewKeyRing(hmacKey.ID, map[string][]byte{hmacKey.ID: hmacKey.Secret, key.ID: public})
+	require.NoError(t, err)
+
+	claims, err := verifier.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", claims.UserToken)
+
+	// публичным ключом нельзя подписывать
+	_, err = NewKeyRing(key.ID, map[string][]byte{key.ID: public})
+	assert.Error(t, err)
+
+	// токен HS256, подписанный публичным ключом как секретом, не проходит
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ID:        "session",
+		Subject:   "user-2",
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	forged.Header["kid"] = key.ID
+
+	signed, err := forged.SignedString(public)
+	require.NoError(t, err)
+
+	_, err = verifier.Verify(signed)
+	assert.Error(t, err)
+}
+
+func TestKeyRing_Audience(t *testing.T) {
+	key := testKey(t)
+	ring, err := NewKeyRing(key.ID, map[string][]byte{key.ID: key.Secret})
+	require.NoError(t, err)
+
+	issued := ring.WithAudience("gophermart", "mobile")
+
+	token, err := issued.Sign(testClaims("user-1"))
+	require.NoError(t, err)
+
+	_, err = issued.Verify(token)
+	assert.NoError(t, err)
+
+	_, err = ring.WithAudience("gophermart", "web").Verify(token)
+	assert.Error(t, err)
+
+	_, err = ring.WithAudience("other", "mobile").Verify(token)
+	assert.Error(t, err)
+
+	// токен без aud не подходит, если аудитория задана
+	plain, err := ring.Sign(testClaims("user-1"))
+	require.NoError(t, err)
+
+	_, err = issued.Verify(plain)
+	assert.Error(t, err)
+
+	// nbf в будущем
+	claims := testClaims("user-1")
+	claims.IssuedAt = time.Now().Add(time.Hour)
+	claims.ExpiresAt = time.Now().Add(2 * time.Hour)
+
+	early, err := ring.Sign(claims)
+	require.NoError(t, err)
+
+	_, err = ring.Verify(early)
+	assert.Error(t, err)
+}
+
+func TestNewKeyRing_Invalid(t *testing.T) {
+	key := testKey(t)
+
+	_, err := NewKeyRing("missing", map[string][]byte{key.ID: key.Secret})
+	assert.Error(t, err)
+
+	_, err = NewKeyRing("short", map[string][]byte{"short": []byte("secret")})
+	assert.Error(t, err)
+
+	_, err = NewKeyRing("", nil)
+	assert.Error(t, err)
+}
+
+func TestKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+
+	first := testKey(t)
+	kf := &KeyFile{}
+	kf.Add(first, false)
+	assert.Equal(t, first.ID, kf.Active)
+
+	second := Key{ID: first.ID + "-2", Secret: bytes.Repeat([]byte{2}, MinKeyLen)}
+	kf.Add(second, false)
+	assert.Equal(t, first.ID, kf.Active)
+
+	require.NoError(t, kf.WriteFile(path))
+
+	ring, _, err := Load(path, "ignored")
+	require.NoError(t, err)
+	assert.Equal(t, first.ID, ring.ActiveKeyID())
+	assert.Equal(t, []string{first.ID, second.ID}, ring.KeyIDs())
+
+	read, err := ReadKeyFile(path)
+	require.NoError(t, err)
+	read.Add(Key{ID: first.ID + "-3", Secret: bytes.Repeat([]byte{3}, MinKeyLen)}, true)
+
+	ring, err = read.KeyRing()
+	require.NoError(t, err)
+	assert.Equal(t, first.ID+"-3", ring.ActiveKeyID())
+}
+
+func TestLoad_Secret(t *testing.T) {
+	secret := strings.Repeat("s", MinKeyLen)
+
+	ring, ephemeral, err := Load("", secret)
+	require.NoError(t, err)
+	assert.False(t, ephemeral)
+
+	// тот же секрет после перезапуска проверяет выданные токены
+	token, err := ring.Sign(testClaims("user-1"))
+	require.NoError(t, err)
+
+	again, _, err := Load("", secret)
+	require.NoError(t, err)
+	_, err = again.Verify(token)
+	assert.NoError(t, err)
+
+	_, ephemeral, err = Load("", "")
+	require.NoError(t, err)
+	assert.True(t, ephemeral)
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"strings"
+	"time"
+)
+
+// MaxTokenLen ограничивает размер токена до разбора: RS256 с ключом 4096 бит и нашими claims
+// укладывается с большим запасом, а мусорный заголовок в мегабайт не дойдёт до base64 и JSON.
+const MaxTokenLen = 4096
+
+const maxHeaderLen = 512
+
+var strictEncoding = base64.RawURLEncoding.Strict()
+
+type MalformedTokenError struct {
+	Message string
+}
+
+type InvalidSignatureError struct {
+	KeyID string
+}
+
+type ExpiredTokenError struct {
+	ExpiresAt time.Time
+}
+
+type InvalidClaimsError struct {
+	Message string
+}
+
+func (mte *MalformedTokenError) Error() string {
+	return fmt.Sprintf("malformed token: %v", mte.Message)
+}
+
+func (ise *InvalidSignatureError) Error() string {
+	return fmt.Sprintf("invalid token signature for key %q", ise.KeyID)
+}
+
+func (ete *ExpiredTokenError) Error() string {
+	return fmt.Sprintf("token expired at %v", ete.ExpiresAt.Format(time.RFC3339))
+}
+
+func (ice *InvalidClaimsError) Error() string {
+	return fmt.Sprintf("invalid token claims: %v", ice.Message)
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// parseHeader проверяет форму токена до того, как за него возьмётся jwt: длину, три непустых
+// сегмента в алфавите base64url и заголовок с известным алгоритмом и kid.
+// Подпись здесь не проверяется.
+func parseHeader(token string) (*tokenHeader, error) {
+	if token == "" {
+		return nil, &MalformedTokenError{Message: "empty token"}
+	}
+
+	if len(token) > MaxTokenLen {
+		return nil, &MalformedTokenError{Message: fmt.Sprintf("token is longer than %v bytes", MaxTokenLen)}
+	}
+
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, &MalformedTokenError{Message: "token must have 3 segments"}
+	}
+
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, &MalformedTokenError{Message: "empty segment"}
+		}
+
+		for i := 0; i < len(segment); i++ {
+			if !isBase64URL(segment[i]) {
+				return nil, &MalformedTokenError{Message: "segment is not base64url"}
+			}
+		}
+
+		// строгий режим отвергает лишние биты в последнем символе,
+		// иначе у одного токена было бы несколько написаний
+		if _, err := strictEncoding.DecodeString(segment); err != nil {
+			return nil, &MalformedTokenError{Message: "segment is not canonical base64url"}
+		}
+	}
+
+	if len(segments[0]) > maxHeaderLen {
+		return nil, &MalformedTokenError{Message: "header is too long"}
+	}
+
+	data, err := strictEncoding.DecodeString(segments[0])
+	if err != nil {
+		return nil, &MalformedTokenError{Message: "header is not base64url"}
+	}
+
+	header := &tokenHeader{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return nil, &MalformedTokenError{Message: "header is not a JSON object"}
+	}
+
+	if header.Alg != jwt.SigningMethodHS256.Alg() && header.Alg != jwt.SigningMethodRS256.Alg() {
+		return nil, &MalformedTokenError{Message: fmt.Sprintf("unsupported algorithm %q", header.Alg)}
+	}
+
+	if header.Kid == "" {
+		return nil, &MalformedTokenError{Message: "header has no kid"}
+	}
+
+	return header, nil
+}
+
+func isBase64URL(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// validationError переводит ошибки jwt в наши типы. Неверная подпись важнее истёкшего срока:
+// про поддельный токен не сообщаем ничего, кроме того, что он поддельный.
+func validationError(kid string, claims *jwt.RegisteredClaims, err error) error {
+	var ve *jwt.ValidationError
+	if !errors.As(err, &ve) {
+		return &MalformedTokenError{Message: err.Error()}
+	}
+
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return &MalformedTokenError{Message: ve.Error()}
+	case ve.Errors&(jwt.ValidationErrorSignatureInvalid|jwt.ValidationErrorUnverifiable) != 0:
+		return &InvalidSignatureError{KeyID: kid}
+	case ve.Errors&jwt.ValidationErrorExpired != 0 && claims.ExpiresAt != nil:
+		return &ExpiredTokenError{ExpiresAt: claims.ExpiresAt.Time}
+	default:
+		return &InvalidClaimsError{Message: ve.Error()}
+	}
+}
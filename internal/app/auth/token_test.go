@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRing(t *testing.T) *KeyRing {
+	key, err := GenerateKey()
+	require.NoError(t, err)
+
+	ring, err := NewKeyRing(key.ID, map[string][]byte{key.ID: key.Secret})
+	require.NoError(t, err)
+
+	return ring
+}
+
+func TestVerify_Errors(t *testing.T) {
+	ring := testRing(t)
+
+	valid, err := ring.Sign(testClaims("user-1"))
+	require.NoError(t, err)
+	parts := strings.Split(valid, ".")
+
+	expiredClaims := testClaims("user-1")
+	expiredClaims.IssuedAt = time.Now().Add(-2 * time.Hour)
+	expiredClaims.ExpiresAt = time.Now().Add(-time.Hour)
+	expired, err := ring.Sign(expiredClaims)
+	require.NoError(t, err)
+
+	header := func(json string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(json))
+	}
+
+	var mte *MalformedTokenError
+	var uke *UnknownKeyError
+	var ise *InvalidSignatureError
+	var ete *ExpiredTokenError
+	var ice *InvalidClaimsError
+
+	tests := []struct {
+		name   string
+		token  string
+		target interface{}
+	}{
+		{name: "empty", token: "", target: &mte},
+		{name: "legacy hex", token: "0100000000000000" + strings.Repeat("ab", 32), target: &mte},
+		{name: "short hex", token: "01", target: &mte},
+		{name: "two segments", token: parts[0] + "." + parts[1], target: &mte},
+		{name: "four segments", token: valid + ".x", target: &mte},
+		{name: "empty signature", token: parts[0] + "." + parts[1] + ".", target: &mte},
+		{name: "non-canonical signature", token: parts[0] + "." + parts[1] + "." + parts[2][:len(parts[2])-1] + "B", target: &mte},
+		{name: "padding", token: parts[0] + "=." + parts[1] + "." + parts[2], target: &mte},
+		{name: "too long", token: parts[0] + "." + strings.Repeat("a", MaxTokenLen) + "." + parts[2], target: &mte},
+		{name: "header not json", token: header("nope") + "." + parts[1] + "." + parts[2], target: &mte},
+		{name: "alg none", token: header(`{"alg":"none","kid":"x"}`) + "." + parts[1] + ".c2ln", target: &mte},
+		{name: "no kid", token: header(`{"alg":"HS256"}`) + "." + parts[1] + "." + parts[2], target: &mte},
+		{name: "unknown kid", token: header(`{"alg":"HS256","kid":"other"}`) + "." + parts[1] + "." + parts[2], target: &uke},
+		{name: "alg mismatch", token: header(`{"alg":"RS256","kid":"`+ring.ActiveKeyID()+`"}`) + "." + parts[1] + "." + parts[2], target: &ise},
+		{name: "bad signature", token: parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])), target: &ise},
+		{name: "payload not json", token: parts[0] + "." + header("nope") + "." + parts[2], target: &mte},
+		{name: "expired", token: expired, target: &ete},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ring.Verify(tt.token)
+			assert.Nil(t, claims)
+			assert.True(t, errors.As(err, tt.target), "%T: %v", err, err)
+		})
+	}
+
+	// подпись проверяется раньше срока: просроченный поддельный токен — это поддельный токен
+	expiredParts := strings.Split(expired, ".")
+	_, err = ring.Verify(expiredParts[0] + "." + expiredParts[1] + "." + parts[2])
+	assert.True(t, errors.As(err, &ise), "%T: %v", err, err)
+
+	// без sub или jti токен не годится, даже с верной подписью
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	token.Header["kid"] = ring.ActiveKeyID()
+	signed, err := token.SignedString(ring.keys[ring.ActiveKeyID()].sign)
+	require.NoError(t, err)
+
+	_, err = ring.Verify(signed)
+	assert.True(t, errors.As(err, &ice), "%T: %v", err, err)
+}
+
+// randomTokens сочиняет n случайных токенов: произвольные байты, строки из алфавита JWT
+// и испорченные копии valid. Один seed — одна и та же последовательность.
+func randomTokens(seed int64, n int, valid string) []string {
+	rnd := rand.New(rand.NewSource(seed))
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_.="
+
+	tokens := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		var b []byte
+
+		switch rnd.Intn(3) {
+		case 0:
+			b = make([]byte, rnd.Intn(MaxTokenLen+64))
+			rnd.Read(b)
+		case 1:
+			b = make([]byte, rnd.Intn(len(valid)*2+1))
+			for j := range b {
+				b[j] = alphabet[rnd.Intn(len(alphabet))]
+			}
+		default:
+			b = []byte(valid)
+			for k := rnd.Intn(4) + 1; k > 0 && len(b) > 0; k-- {
+				pos := rnd.Intn(len(b))
+
+				switch rnd.Intn(4) {
+				case 0:
+					b[pos] = alphabet[rnd.Intn(len(alphabet))]
+				case 1:
+					b = append(b[:pos], b[pos+1:]...)
+				case 2:
+					b = append(b[:pos], append([]byte{byte(rnd.Intn(256))}, b[pos:]...)...)
+				default:
+					b = b[:pos]
+				}
+			}
+		}
+
+		tokens = append(tokens, string(b))
+	}
+
+	return tokens
+}
+
+func TestVerify_Random(t *testing.T) {
+	ring := testRing(t)
+
+	valid, err := ring.Sign(testClaims("user-1"))
+	require.NoError(t, err)
+
+	seed := time.Now().UnixNano()
+	t.Logf("seed %v", seed)
+
+	var mte *MalformedTokenError
+	var uke *UnknownKeyError
+	var ise *InvalidSignatureError
+	var ete *ExpiredTokenError
+	var ice *InvalidClaimsError
+
+	for _, token := range randomTokens(seed, 20000, valid) {
+		claims, err := verifyNoPanic(t, ring, token)
+
+		if err == nil {
+			// принять можно только токен, подписанный нашим ключом, то есть исходный
+			require.Equal(t, valid, token, "seed %v", seed)
+			require.Equal(t, "user-1", claims.UserToken)
+			continue
+		}
+
+		require.Nil(t, claims, "seed %v, token %q", seed, token)
+
+		typed := errors.As(err, &mte) || errors.As(err, &uke) || errors.As(err, &ise) || errors.As(err, &ete) || errors.As(err, &ice)
+		require.True(t, typed, "seed %v, token %q: untyped error %T: %v", seed, token, err, err)
+	}
+}
+
+func verifyNoPanic(t *testing.T, ring *KeyRing, token string) (claims *Claims, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			t.Fatalf("Verify(%q) panicked: %v", token, p)
+		}
+	}()
+
+	return ring.Verify(token)
+}
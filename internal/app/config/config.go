@@ -4,12 +4,38 @@ import (
 	"flag"
 	"github.com/caarlos0/env/v6"
 	"log"
+	"time"
 )
 
 type Config struct {
-	Address     string `env:"RUN_ADDRESS" envDefault:"localhost:8080"`
-	DBURL       string `env:"DATABASE_URI" envDefault:""`
-	AccrualURL  string `env:"ACCRUAL_SYSTEM_ADDRESS" envDefault:""`
+	Address            string        `env:"RUN_ADDRESS" envDefault:"localhost:8080"`
+	DBURL              string        `env:"DATABASE_URI" envDefault:""`
+	Storage            string        `env:"STORAGE" envDefault:"postgres"`
+	AccrualURL         string        `env:"ACCRUAL_SYSTEM_ADDRESS" envDefault:""`
+	AccrualRateLimit   int           `env:"ACCRUAL_RATE_LIMIT" envDefault:"0"`
+	TokenSecret        string        `env:"TOKEN_SECRET" envDefault:""`
+	TokenKeysFile      string        `env:"TOKEN_KEYS_FILE" envDefault:""`
+	SessionTTL         time.Duration `env:"SESSION_TTL" envDefault:"720h"`
+	AccessTTL          time.Duration `env:"ACCESS_TOKEN_TTL" envDefault:"15m"`
+	TokenIssuer        string        `env:"TOKEN_ISSUER" envDefault:""`
+	TokenAudience      string        `env:"TOKEN_AUDIENCE" envDefault:""`
+	LoginStore         string        `env:"LOGIN_THROTTLE_STORE" envDefault:"postgres"`
+	LoginMaxFailures   int           `env:"LOGIN_MAX_FAILURES" envDefault:"5"`
+	IPMaxFailures      int           `env:"LOGIN_IP_MAX_FAILURES" envDefault:"50"`
+	LoginLockout       time.Duration `env:"LOGIN_LOCKOUT" envDefault:"30s"`
+	LoginMaxLockout    time.Duration `env:"LOGIN_MAX_LOCKOUT" envDefault:"1h"`
+	LoginWindow        time.Duration `env:"LOGIN_FAILURE_WINDOW" envDefault:"24h"`
+	TrustProxy         bool          `env:"TRUST_PROXY" envDefault:"false"`
+	DBMaxConns         int           `env:"DB_MAX_CONNS" envDefault:"0"`
+	DBMinConns         int           `env:"DB_MIN_CONNS" envDefault:"0"`
+	DBConnLifetime     time.Duration `env:"DB_CONN_LIFETIME" envDefault:"1h"`
+	DBConnIdleTime     time.Duration `env:"DB_CONN_IDLE_TIME" envDefault:"30m"`
+	DBConnectTimeout   time.Duration `env:"DB_CONNECT_TIMEOUT" envDefault:"5s"`
+	DBStatementTimeout time.Duration `env:"DB_STATEMENT_TIMEOUT" envDefault:"0"`
+	ReconcileInterval  time.Duration `env:"RECONCILE_INTERVAL" envDefault:"1h"`
+	ReconcileRepair    bool          `env:"RECONCILE_REPAIR" envDefault:"false"`
+	PointsTTL          time.Duration `env:"POINTS_TTL" envDefault:"0"`
+	ExpiryInterval     time.Duration `env:"POINTS_EXPIRY_INTERVAL" envDefault:"1h"`
 }
 
 func New() (*Config, error) {
@@ -26,6 +52,31 @@ func New() (*Config, error) {
 func (c *Config) InitFlags() {
 	flag.StringVar(&c.Address, "a", c.Address, "host to listen on")
 	flag.StringVar(&c.DBURL, "d", c.DBURL, "data base url")
+	flag.StringVar(&c.Storage, "storage", c.Storage, "where data is kept: postgres or memory (tests and demos only, lost on restart)")
 	flag.StringVar(&c.AccrualURL, "r", c.AccrualURL, "data base url")
+	flag.IntVar(&c.AccrualRateLimit, "l", c.AccrualRateLimit, "accrual requests per minute, 0 - until accrual reports its limit")
+	flag.StringVar(&c.TokenSecret, "s", c.TokenSecret, "token signing secret, at least 32 bytes")
+	flag.StringVar(&c.TokenKeysFile, "k", c.TokenKeysFile, "token signing key ring file, see gophermart keygen")
+	flag.DurationVar(&c.SessionTTL, "t", c.SessionTTL, "session lifetime, refresh tokens expire with the session")
+	flag.DurationVar(&c.AccessTTL, "access-ttl", c.AccessTTL, "access token lifetime")
+	flag.StringVar(&c.TokenIssuer, "iss", c.TokenIssuer, "token issuer (iss), checked when set")
+	flag.StringVar(&c.TokenAudience, "aud", c.TokenAudience, "token audience (aud), checked when set")
+	flag.StringVar(&c.LoginStore, "login-store", c.LoginStore, "where failed logins are counted: postgres or memory")
+	flag.IntVar(&c.LoginMaxFailures, "login-max-failures", c.LoginMaxFailures, "failed logins per login before lockout, 0 - no limit")
+	flag.IntVar(&c.IPMaxFailures, "ip-max-failures", c.IPMaxFailures, "failed logins per client address before lockout, 0 - no limit")
+	flag.DurationVar(&c.LoginLockout, "login-lockout", c.LoginLockout, "first lockout, doubled on every further failure")
+	flag.DurationVar(&c.LoginMaxLockout, "login-max-lockout", c.LoginMaxLockout, "longest lockout")
+	flag.DurationVar(&c.LoginWindow, "login-window", c.LoginWindow, "failures older than this are forgotten")
+	flag.BoolVar(&c.TrustProxy, "trust-proxy", c.TrustProxy, "take client address from X-Forwarded-For and X-Real-IP")
+	flag.IntVar(&c.DBMaxConns, "db-max-conns", c.DBMaxConns, "connection pool size, 0 - max(4, number of CPUs)")
+	flag.IntVar(&c.DBMinConns, "db-min-conns", c.DBMinConns, "connections kept open when idle")
+	flag.DurationVar(&c.DBConnLifetime, "db-conn-lifetime", c.DBConnLifetime, "close connections older than this")
+	flag.DurationVar(&c.DBConnIdleTime, "db-conn-idle-time", c.DBConnIdleTime, "close connections idle for longer than this")
+	flag.DurationVar(&c.DBConnectTimeout, "db-connect-timeout", c.DBConnectTimeout, "timeout for opening a connection")
+	flag.DurationVar(&c.DBStatementTimeout, "db-statement-timeout", c.DBStatementTimeout, "server-side statement timeout, 0 - no limit")
+	flag.DurationVar(&c.ReconcileInterval, "reconcile-interval", c.ReconcileInterval, "how often balances are checked against transactions, 0 - never")
+	flag.BoolVar(&c.ReconcileRepair, "reconcile-repair", c.ReconcileRepair, "fix mismatched balances found by the periodic check")
+	flag.DurationVar(&c.PointsTTL, "points-ttl", c.PointsTTL, "points expire this long after accrual, e.g. 8760h, 0 - never")
+	flag.DurationVar(&c.ExpiryInterval, "points-expiry-interval", c.ExpiryInterval, "how often expired points are written off")
 	flag.Parse()
 }
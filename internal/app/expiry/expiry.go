@@ -0,0 +1,92 @@
+// Package expiry по расписанию сжигает баллы, начисленные раньше, чем TTL назад.
+package expiry
+
+import (
+	"context"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"log"
+	"time"
+)
+
+// usersPerBatch — сколько пользователей выбирается за один запрос; каждый сгорает в своей транзакции
+const usersPerBatch = 100
+
+type Expirer struct {
+	repo     repository.Repositorier
+	ttl      time.Duration
+	interval time.Duration
+	now      func() time.Time
+}
+
+// New — баллы живут ttl с момента начисления, проверка раз в interval.
+func New(repo repository.Repositorier, ttl time.Duration, interval time.Duration) *Expirer {
+	return &Expirer{
+		repo:     repo,
+		ttl:      ttl,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// Once сжигает все просроченные партии и возвращает сгоревшие остатки.
+// Пользователи перебираются по возрастанию токена, поэтому цикл конечен, даже если
+// кого-то ExpirePoints пропустил из-за расхождения баланса.
+func (e *Expirer) Once(ctx context.Context) ([]repository.ExpiredLot, error) {
+	var expired []repository.ExpiredLot
+	after := ""
+
+	processedBefore := e.now().Add(-e.ttl)
+
+	for {
+		tokens, err := e.repo.UsersWithExpiringPoints(ctx, processedBefore, after, usersPerBatch)
+		if err != nil {
+			return expired, err
+		}
+
+		for _, token := range tokens {
+			lots, err := e.repo.ExpirePoints(ctx, token, processedBefore)
+			if err != nil {
+				return expired, err
+			}
+			expired = append(expired, lots...)
+			after = token
+		}
+
+		if len(tokens) < usersPerBatch {
+			return expired, nil
+		}
+	}
+}
+
+// Run сжигает просроченные баллы при старте и затем раз в interval, пока не отменён ctx.
+// Нулевой ttl — баллы не сгорают.
+func (e *Expirer) Run(ctx context.Context) {
+	if e.ttl <= 0 || e.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		expired, err := e.Once(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("unable to expire points: %v", err)
+		}
+
+		if len(expired) > 0 {
+			var total money.Amount
+			for _, lot := range expired {
+				total += lot.Points
+			}
+			log.Printf("expired %v points in %v lots", total, len(expired))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
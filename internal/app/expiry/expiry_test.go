@@ -0,0 +1,106 @@
+package expiry
+
+import (
+	"context"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository/memory"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository/repositorytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestExpirer_Once(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.New()
+
+	// пользователей больше одной пачки, чтобы проверить проход по всем
+	var tokens []string
+	for i := 0; i < usersPerBatch+20; i++ {
+		token := repositorytest.User(t, repo)
+		order := repositorytest.Order(i)
+		require.NoError(t, repo.CreateOrder(ctx, order, token))
+		require.NoError(t, repo.UpdateOrder(ctx, order, "PROCESSED", money.FromInt(10)))
+		tokens = append(tokens, token)
+	}
+	require.NoError(t, repo.SaveWithdraw(ctx, repositorytest.Order(999), money.FromInt(4), tokens[0], ""))
+
+	e := New(repo, 24*time.Hour, time.Hour)
+
+	expired, err := e.Once(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	e.now = func() time.Time { return time.Now().Add(25 * time.Hour) }
+
+	expired, err = e.Once(ctx)
+	require.NoError(t, err)
+	assert.Len(t, expired, len(tokens))
+
+	for i, token := range tokens {
+		balance, err := repo.GetBalance(ctx, token)
+		require.NoError(t, err)
+		assert.Zero(t, balance.Current, "user %v", i)
+	}
+
+	expired, err = e.Once(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+}
+
+// skippingRepo пропускает каждого пользователя, как ExpirePoints при балансе меньше сгорающего остатка
+type skippingRepo struct {
+	repository.Repositorier
+}
+
+func (skippingRepo) ExpirePoints(ctx context.Context, userToken string, processedBefore time.Time) ([]repository.ExpiredLot, error) {
+	return nil, nil
+}
+
+func TestExpirer_OnceWithSkippedUsers(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.New()
+
+	for i := 0; i < usersPerBatch+20; i++ {
+		token := repositorytest.User(t, repo)
+		order := repositorytest.Order(i)
+		require.NoError(t, repo.CreateOrder(ctx, order, token))
+		require.NoError(t, repo.UpdateOrder(ctx, order, "PROCESSED", money.FromInt(10)))
+	}
+
+	e := New(skippingRepo{repo}, 24*time.Hour, time.Hour)
+	e.now = func() time.Time { return time.Now().Add(25 * time.Hour) }
+
+	// пропущенные пользователи не выбираются снова, и проход заканчивается
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		expired, err := e.Once(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, expired)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Once did not finish with skipped users")
+	}
+}
+
+func TestExpirer_Disabled(t *testing.T) {
+	done := make(chan struct{})
+
+	go func() {
+		New(memory.New(), 0, time.Hour).Run(context.Background())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run with zero ttl did not return")
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/validation"
+	"log"
+	"net/http"
+)
+
+const (
+	CodeBadRequest    = "bad_request"
+	CodeInvalidJSON   = "invalid_json"
+	CodeUnauthorized  = "unauthorized"
+	CodeConflict      = "conflict"
+	CodeTooManyLogins = "too_many_attempts"
+	CodeLowBalance    = "insufficient_funds"
+	CodeInternal      = "internal_error"
+)
+
+// ErrorData — единый формат тела ошибки: {"code": ..., "message": ..., "field": ...}.
+type ErrorData struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+func WriteError(w http.ResponseWriter, status int, data ErrorData) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// writeInternal пишет подробности в лог, клиенту уходит только код
+func writeInternal(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("%v %v: %v", r.Method, r.URL.Path, err)
+	WriteError(w, http.StatusInternalServerError, ErrorData{Code: CodeInternal, Message: "internal server error"})
+}
+
+// writeInvalid отвечает на ошибку валидации; status различается: 400 для формы, 422 для номера заказа
+func writeInvalid(w http.ResponseWriter, r *http.Request, status int, err error) {
+	var fe *validation.FieldError
+
+	if errors.As(err, &fe) {
+		WriteError(w, status, ErrorData{Code: fe.Code, Message: fe.Message, Field: fe.Field})
+		return
+	}
+
+	writeInternal(w, r, err)
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		WriteError(w, http.StatusBadRequest, ErrorData{Code: CodeInvalidJSON, Message: "request body must be a valid JSON object"})
+		return false
+	}
+	return true
+}
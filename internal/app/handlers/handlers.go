@@ -2,157 +2,176 @@ package handlers
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
-	"encoding/hex"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
-	"github.com/DatDomrachev/go-loyalty-system/internal/app/wpool"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/auth"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/password"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/throttle"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/validation"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"errors"
-	"context"
-	"fmt"
-	"time"
-	"crypto/md5"
 	"log"
 )
 
-type JobData struct {
-	OrderID string
-	AccrualURL string
-	UserToken string
-}
-
-type ArgsError struct {
-	Message string
-}
-
-type BadResponse struct {
-	Message string
-}
-
-type TooManyRequests struct {
-	Message string
-}
-
-type DBError struct {
-	Message string
-}
-
+// dummyHash сверяется с паролем, когда логина нет, чтобы по времени ответа нельзя было перебирать логины
+var dummyHash, _ = password.Hash("dummy password")
 
-func (ae *ArgsError) Error() string {
-	return fmt.Sprintf("%v", ae.Message)
-}
-
-func (br *BadResponse) Error() string {
-	return fmt.Sprintf("%v", br.Message)
+// clientIP — адрес клиента без порта; за доверенным прокси RemoteAddr уже подменён middleware.RealIP
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
-func (tmr *TooManyRequests) Error() string {
-	return fmt.Sprintf("%v", tmr.Message)
-}
+func RegisterHandler(repo repository.Repositorier, sessions Sessions) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request)  {
 
-func (dbe *DBError) Error() string {
-	return fmt.Sprintf("%v", dbe.Message)
-}
+		var loginData repository.LoginData
 
-func validateLuhnOrderNumber(num string) bool {
-	idx := len(num) - 1
-	total := 0
-	pos := 0
-	for i := idx; i > -1; i-- {
-		char := num[i]
-		if char == ' ' {
-			continue
-		}
-		if char < 48 || char > 57 {
-			return false
-		}
-		digit := int(char - 48)
-		if pos%2 == 0 {
-			total += digit
-		} else {
-			switch digit {
-			case 1, 2, 3, 4:
-				total += digit << 1
-			case 5, 6, 7, 8:
-				total += (digit << 1) - 9
-			case 9:
-				total += digit
-			}
+		if !decodeJSON(w, r, &loginData) {
+			return
 		}
-		pos++
-	}
-	return pos > 1 && total%10 == 0
-}
 
-func RegisterHandler(repo repository.Repositorier) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request)  {
+		if err := validation.Registration(loginData); err != nil {
+			writeInvalid(w, r, http.StatusBadRequest, err)
+			return
+		}
 
-		var loginData repository.LoginData
+		hash, err := password.Hash(loginData.Password)
 
-		if err := json.NewDecoder(r.Body).Decode(&loginData); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if err != nil {
+			writeInternal(w, r, err)
 			return
 		}
 
-		password:= md5.Sum([]byte(loginData.Password))
-		userID, err := repo.SaveUser(r.Context(), loginData.Login, hex.EncodeToString(password[:]))
+		userID, err := repo.SaveUser(r.Context(), loginData.Login, hash)
 
 		if err != nil {
 			var ce *repository.ConflictError
 
 			if errors.As(err, &ce) {
-				w.WriteHeader(http.StatusConflict)
+				WriteError(w, http.StatusConflict, ErrorData{Code: CodeConflict, Message: "login is already taken", Field: "login"})
 				return
 			} else {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeInternal(w, r, err)
 				return
 			}
 		} 
 
 
-		token := auth.GetToken(userID);
+		token, err := auth.NewUserToken(userID)
+
+		if err != nil {
+			writeInternal(w, r, err)
+			return
+		}
+
 		token, err = repo.SaveUserToken(r.Context(), userID, token)
-		
+
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeInternal(w, r, err)
 			return
-		} else {
-				cookie := &http.Cookie {
-				Name:  "user_token",
-				Value: token,
-			}
-			http.SetCookie(w, cookie)
-			w.WriteHeader(http.StatusOK)
 		}
+
+		tokenData, err := sessions.start(w, r, repo, token)
+
+		if err != nil {
+			writeInternal(w, r, err)
+			return
+		}
+
+		writeToken(w, tokenData)
 	}
 }
 
 
-func LoginHandler(repo repository.Repositorier) func(w http.ResponseWriter, r *http.Request) {
+func LoginHandler(repo repository.Repositorier, sessions Sessions, guard *throttle.Guard) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		var loginData repository.LoginData
 
-		if err := json.NewDecoder(r.Body).Decode(&loginData); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if !decodeJSON(w, r, &loginData) {
 			return
 		}
 
-		password:= md5.Sum([]byte(loginData.Password))
-		userToken, err := repo.FindUser(r.Context(), loginData.Login, hex.EncodeToString(password[:]))
+		if err := validation.Credentials(loginData); err != nil {
+			writeInvalid(w, r, http.StatusBadRequest, err)
+			return
+		}
 
-		if err != nil {
-				w.WriteHeader(http.StatusUnauthorized)
+		ip := clientIP(r)
+
+		// пока логин или адрес заблокирован, пароль даже не проверяется
+		if err := guard.Check(r.Context(), loginData.Login, ip); err != nil {
+			var le *throttle.LockedError
+
+			if errors.As(err, &le) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(le.RetryAfter.Seconds()))))
+				WriteError(w, http.StatusTooManyRequests, ErrorData{Code: CodeTooManyLogins, Message: "too many failed login attempts, try again later"})
 				return
+			}
+
+			writeInternal(w, r, err)
+			return
+		}
+
+		loginFailed := func() {
+			if err := guard.Fail(r.Context(), loginData.Login, ip); err != nil {
+				log.Printf("unable to record failed login for %v: %v", loginData.Login, err)
+			}
+			WriteError(w, http.StatusUnauthorized, ErrorData{Code: CodeUnauthorized, Message: "invalid login or password"})
+		}
+
+		user, err := repo.FindUser(r.Context(), loginData.Login)
+
+		// неизвестный логин — обычная неудачная попытка; сбой БД попыткой не считается,
+		// иначе во время аварии блокировались бы все логины и адреса
+		if errors.Is(err, sql.ErrNoRows) {
+			password.Verify(dummyHash, loginData.Password)
+			loginFailed()
+			return
+		}
+
+		if err != nil {
+			writeInternal(w, r, err)
+			return
+		}
+
+		ok, rehash, err := password.Verify(user.Password, loginData.Password)
+
+		if err != nil || !ok {
+			loginFailed()
+			return
 		} else {
-			cookie := &http.Cookie {
-				Name:  "user_token",
-				Value: userToken,
+			if err := guard.Succeed(r.Context(), loginData.Login); err != nil {
+				log.Printf("unable to reset failed logins for %v: %v", loginData.Login, err)
 			}
-			http.SetCookie(w, cookie)
-			w.WriteHeader(http.StatusOK)
+
+			// старый md5 или устаревшие параметры: пересчитываем хеш, пока знаем пароль
+			if rehash {
+				if hash, err := password.Hash(loginData.Password); err == nil {
+					if err := repo.UpdatePassword(r.Context(), user.ID, hash); err != nil {
+						log.Printf("unable to upgrade password hash for user %v: %v", user.ID, err)
+					}
+				}
+			}
+
+			tokenData, err := sessions.start(w, r, repo, user.UserToken)
+
+			if err != nil {
+				writeInternal(w, r, err)
+				return
+			}
+
+			writeToken(w, tokenData)
 		}
 	}
 }
@@ -164,19 +183,18 @@ func GetBalanceHandler(repo repository.Repositorier, userToken string) func(w ht
 		result, err := repo.GetBalance(r.Context(), userToken)
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeInternal(w, r, err)
 			return
 		}
 
 		w.Header().Set("content-type", "application/json")
-		w.WriteHeader(http.StatusOK)
-
 		buf := bytes.NewBuffer([]byte{})
 		if err := json.NewEncoder(buf).Encode(result); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeInternal(w, r, err)
 			return
 		}
 
+		w.WriteHeader(http.StatusOK)
 		w.Write(buf.Bytes())
 
 	}
@@ -186,10 +204,16 @@ func GetBalanceHandler(repo repository.Repositorier, userToken string) func(w ht
 func WithdrawListHandler(repo repository.Repositorier, userToken string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		items, err := repo.GetWithdrawals(r.Context(), userToken)
+		opts, err := validation.ListQuery(r.URL.Query(), false)
+		if err != nil {
+			writeInvalid(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		items, next, err := repo.GetWithdrawals(r.Context(), userToken, opts)
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeInternal(w, r, err)
 			return
 		}
 
@@ -199,14 +223,14 @@ func WithdrawListHandler(repo repository.Repositorier, userToken string) func(w
 		}
 
 		w.Header().Set("content-type", "application/json")
-		w.WriteHeader(http.StatusOK)
-
 		buf := bytes.NewBuffer([]byte{})
 		if err := json.NewEncoder(buf).Encode(items); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeInternal(w, r, err)
 			return
 		}
 
+		setNextCursor(w, next)
+		w.WriteHeader(http.StatusOK)
 		w.Write(buf.Bytes())
 
 	}
@@ -214,11 +238,17 @@ func WithdrawListHandler(repo repository.Repositorier, userToken string) func(w
 
 func OrderListHandler(repo repository.Repositorier, userToken string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := validation.ListQuery(r.URL.Query(), true)
+		if err != nil {
+			writeInvalid(w, r, http.StatusBadRequest, err)
+			return
+		}
+
 		w.Header().Set("content-type", "application/json")
-		items, err := repo.GetOrders(r.Context(), userToken)
+		items, next, err := repo.GetOrders(r.Context(), userToken, opts)
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeInternal(w, r, err)
 			return
 		}
 
@@ -227,45 +257,74 @@ func OrderListHandler(repo repository.Repositorier, userToken string) func(w htt
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-
 		buf := bytes.NewBuffer([]byte{})
 		if err := json.NewEncoder(buf).Encode(items); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeInternal(w, r, err)
 			return
 		}
 
+		setNextCursor(w, next)
+		w.WriteHeader(http.StatusOK)
 		w.Write(buf.Bytes())
 
 	}
 }
 
+// setNextCursor отдаёт курсор следующей страницы; без заголовка страница последняя
+func setNextCursor(w http.ResponseWriter, next *repository.Cursor) {
+	if next != nil {
+		w.Header().Set("X-Next-Cursor", next.String())
+	}
+}
 
 func WithdrawHandler(repo repository.Repositorier, userToken string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var withdraw repository.Withdraw
 
-		if err := json.NewDecoder(r.Body).Decode(&withdraw); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !decodeJSON(w, r, &withdraw) {
+			return
+		}
+
+		if err := validation.Withdraw(withdraw); err != nil {
+			var fe *validation.FieldError
+
+			// неверный номер заказа — 422, как и раньше; остальное — ошибка формы
+			if errors.As(err, &fe) && fe.Code == validation.CodeInvalidNumber {
+				writeInvalid(w, r, http.StatusUnprocessableEntity, err)
+				return
+			}
+
+			writeInvalid(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		check := validateLuhnOrderNumber(withdraw.OrderID)
-		if !check {
-			w.WriteHeader(http.StatusUnprocessableEntity)
+		// повтор с тем же ключом или тем же заказом и суммой отвечает 200 и ничего не списывает
+		idempotencyKey := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+
+		if err := validation.IdempotencyKey(idempotencyKey); err != nil {
+			writeInvalid(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		err := repo.SaveWithdraw(r.Context(), withdraw.OrderID, withdraw.Points, userToken)
+		err := repo.SaveWithdraw(r.Context(), withdraw.OrderID, withdraw.Points, userToken, idempotencyKey)
 
 		if err != nil {
 			var lpe *repository.LowPointsError
+			var wce *repository.WithdrawConflictError
 
 			if errors.As(err, &lpe) {
-				w.WriteHeader(http.StatusPaymentRequired)
+				WriteError(w, http.StatusPaymentRequired, ErrorData{Code: CodeLowBalance, Message: "not enough points", Field: "sum"})
+				return
+			} else if errors.As(err, &wce) {
+				field := "order"
+				if wce.IdempotencyKey != "" {
+					field = "Idempotency-Key"
+				}
+
+				WriteError(w, http.StatusConflict, ErrorData{Code: CodeConflict, Message: wce.Message, Field: field})
 				return
 			} else {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeInternal(w, r, err)
 				return
 			}
 		} else {
@@ -276,13 +335,13 @@ func WithdrawHandler(repo repository.Repositorier, userToken string) func(w http
 }
 
 
-func OrderHandler(repo repository.Repositorier, wp wpool.WorkerPooler, AccrualURL string, userToken string) func(w http.ResponseWriter, r *http.Request) {
+func OrderHandler(repo repository.Repositorier, userToken string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		contentType := r.Header.Get("Content-type")
 		
 		if contentType != "text/plain" {
-			w.WriteHeader(http.StatusBadRequest)
+			WriteError(w, http.StatusBadRequest, ErrorData{Code: CodeBadRequest, Message: "order number must be sent as text/plain"})
 			return
 		}
 
@@ -290,186 +349,43 @@ func OrderHandler(repo repository.Repositorier, wp wpool.WorkerPooler, AccrualUR
 
 		if err != nil {
 			defer r.Body.Close()
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeInternal(w, r, err)
 			return
 		}
 
-		number := string(body)
+		number := strings.TrimSpace(string(body))
 
-		check := validateLuhnOrderNumber(number)
-		if !check {
-			w.WriteHeader(http.StatusUnprocessableEntity)
-			return
-		}
+		if err := validation.OrderNumber("number", number); err != nil {
+			var fe *validation.FieldError
 
-		accrual, err := repo.FindOrderAccrual(r.Context(), number)
-		
-		if err == nil {
-			if(accrual.UserToken == userToken) {
-				w.WriteHeader(http.StatusOK)
-				return
-			} else {
-				w.WriteHeader(http.StatusConflict)
+			if errors.As(err, &fe) && fe.Code == validation.CodeRequired {
+				writeInvalid(w, r, http.StatusBadRequest, err)
 				return
 			}
-		}
 
-		err = repo.CreateOrder(r.Context(), number, userToken)
-		
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeInvalid(w, r, http.StatusUnprocessableEntity, err)
 			return
 		}
-		w.WriteHeader(http.StatusAccepted)
-		
-		
-		go ProcessOrder(repo, wp, AccrualURL, userToken, number)
-	}
-}
-		
-func ProcessOrder(repo repository.Repositorier, wp wpool.WorkerPooler, accrualURL string, userToken string, OrderID string) {
-	// ставим первую задачу в воркер пулл на запрос в acrual	 
-	execFn := func(ctx context.Context, args interface{}) (interface{}, error) {		
-		argVal, ok := args.(JobData)
-	
-		if !ok {
-			return nil, &ArgsError {
-				Message: "Bad arguments",
-			}
-		}
-
-		return CheckOrder(ctx, repo, argVal.OrderID, argVal.UserToken, argVal.AccrualURL)
-	}
-
-	t := time.Now().Unix()
-
-	job := wpool.Job {
-		Descriptor: wpool.JobDescriptor{
-			ID:       wpool.JobID(fmt.Sprintf("%v_%v", OrderID, t)),
-			JType:    "PROCESSING",
-			Metadata: nil,
-		},
-		ExecFn: execFn,
-		Args:   JobData{
-			OrderID:   OrderID,
-			UserToken: userToken,
-			AccrualURL: accrualURL,
-		},
-	}
 
-	go wp.GenerateFrom(job)
-
-
-
-	//поворяем до получения результата или ошибки
-	for {
-		select {
-			case r, ok := <-wp.Results():
-				if !ok {
-					continue
-				}
+		// владельца определяет сама вставка: две одновременные загрузки одного номера не получат обе 202
+		err = repo.CreateOrder(r.Context(), number, userToken)
 
-			err := r.Err
-			if err != nil {
-				var tmr *TooManyRequests
-
-				if errors.As(err, &tmr) {
-					time.Sleep(60 * time.Second)
-				} else {
-					log.Print(err)
-					go wp.BroadcastDone(true)
-					break
-				}
+		var oee *repository.OrderExistsError
 
-			} else {
-				val := r.Value.(repository.ProcessingOrder)
-				log.Print(val.Status)
-				if val.Status == "PROCESSED" || val.Status == "INVALID" {
-					go wp.BroadcastDone(true)
-					break
-				}	
-			}		
-
-
-			t = time.Now().Unix()
-
-			job = wpool.Job {
-				Descriptor: wpool.JobDescriptor{
-					ID:       wpool.JobID(fmt.Sprintf("%v_%v", OrderID, t)),
-					JType:    "PROCESSING",
-					Metadata: nil,
-				},
-				ExecFn: execFn,
-				Args:   JobData{
-					OrderID:   OrderID,
-					UserToken: userToken,
-					AccrualURL: accrualURL,
-				},
+		if errors.As(err, &oee) {
+			if oee.UserToken == userToken {
+				w.WriteHeader(http.StatusOK)
+				return
 			}
 
-			go wp.GenerateFrom(job)
+			WriteError(w, http.StatusConflict, ErrorData{Code: CodeConflict, Message: "order was uploaded by another user", Field: "number"})
+			return
+		}
 
-		case <-wp.Done():
-			log.Print("done")
+		if err != nil {
+			writeInternal(w, r, err)
 			return
-		//default:
-		 	//log.Print("waiting")
-		} 
-	
+		}
+		w.WriteHeader(http.StatusAccepted)
 	}
-		
 }
-
-
-func CheckOrder	(ctx context.Context, repo repository.Repositorier, orderID string, userToken string, endpoint string) (interface{}, error) {
-	
-
-	url := endpoint+"/api/orders/"+orderID
-	
-	var myClient = &http.Client{Timeout: 10 * time.Second}
-
-    res, err := myClient.Get(url)
-    
-    if err != nil {
-        log.Printf("Can't do request to accrual %v\n", err)
-        return nil, &BadResponse{
-    		Message: "Unable to do request to accrual "+ orderID,
-    	}
-    }
-
-    if res.StatusCode == http.StatusInternalServerError {
-    	log.Printf("BadResponse %v\n", orderID)
-    	return nil, &BadResponse{
-    		Message: "BadResponse on order "+ orderID,
-    	}
-    }
-
-    if res.StatusCode == http.StatusTooManyRequests {
-    	log.Printf("TooManyRequest %v\n", orderID)
-    	return nil, &TooManyRequests {
-    		Message: "TooManyRequest on order " + orderID,
-    	}
-    }
-
-    var processingOrder repository.ProcessingOrder
-    
-   
-    if err := json.NewDecoder(res.Body).Decode(&processingOrder); err != nil {
-		defer res.Body.Close()
-		return nil, &BadResponse{
-    		Message: "Unable to read response on order "+ orderID,
-    	}
-	}
-
-
-	log.Printf("Accrual correct response %v\n", orderID)
-	err = repo.UpdateOrder(ctx, processingOrder.OrderID, processingOrder.Status, processingOrder.Accrual, userToken);
-	if err != nil {
-        log.Printf("DB error %v\n", err)
-        return nil, &DBError{
-    		Message: "DB error on order "+ orderID,
-    	}
-    }
-
-	return processingOrder, nil
-}
\ No newline at end of file
@@ -2,9 +2,23 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/accrual"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/accrual/accrualtest"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/auth"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/config"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/password"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/poller"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository/memory"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/throttle"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/validation"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/wpool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -13,14 +27,47 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
-	"runtime"
 	"time"
 	"fmt"
 	"github.com/golang-module/carbon/v2"
 )
 
-func testRequest(t *testing.T, config *config.Config, repo *repository.Repo, wp *wpool.WorkerPool, method, path, body, token string, textFlag bool) (*http.Response, string, []*http.Cookie) {
+// testPassword проходит политику паролей при регистрации
+const testPassword = "test-pass-1"
+
+var testKeys, _, _ = auth.Load("", "")
+
+var testSessions = Sessions{Keys: testKeys, AccessTTL: time.Minute, SessionTTL: time.Hour}
+
+var testGuard = throttle.New(throttle.NewMemory(), throttle.DefaultLoginPolicy, throttle.DefaultIPPolicy)
+
+// testUserToken достаёт из подписанной cookie идентификатор пользователя, как это делает CheckUser
+func testUserToken(t *testing.T, cookies []*http.Cookie) string {
+	require.NotEmpty(t, cookies)
+
+	claims, err := testKeys.Verify(cookies[0].Value)
+	require.NoError(t, err)
+
+	return claims.UserToken
+}
+
+// testRepo — Postgres, если задан DATABASE_URI, иначе хранилище в памяти
+func testRepo(t *testing.T, config *config.Config) repository.Repositorier {
+	if config.DBURL == "" {
+		return memory.New()
+	}
+
+	repo, err := repository.New(config.DBURL)
+	require.NoError(t, err)
+	t.Cleanup(repo.Close)
+
+	return repo
+}
+
+func testRequest(t *testing.T, config *config.Config, repo repository.Repositorier, method, path, body, token string, textFlag bool) (*http.Response, string, []*http.Cookie) {
 
 	request := httptest.NewRequest(method, path, nil)
 
@@ -37,15 +84,19 @@ func testRequest(t *testing.T, config *config.Config, repo *repository.Repo, wp
 	}
 
 	if method == "POST" && path == "/api/user/register" {
-		RegisterHandler(repo)(w, request)
+		RegisterHandler(repo, testSessions)(w, request)
 	}
 
 	if method == "POST" && path == "/api/user/login" {
-		LoginHandler(repo)(w, request)
+		LoginHandler(repo, testSessions, testGuard)(w, request)
+	}
+
+	if method == "POST" && path == "/api/user/token/refresh" {
+		RefreshHandler(repo, testSessions)(w, request)
 	}
 
 	if method == "POST" && path == "/api/user/orders" {
-		OrderHandler(repo, wp, "", token)(w, request)
+		OrderHandler(repo, token)(w, request)
 	}
 
 	if method == "GET" && path == "/api/user/balance" {
@@ -84,41 +135,42 @@ func TestRouter(t *testing.T) {
 		log.Printf("failed to configurate:+%v\n", err)
 	}
 
-	repo, err := repository.New(config.DBURL)
-	if err != nil {
-		log.Fatalf("failed to init repo:+%v", err)
-	}
-
-	workersCounter := runtime.NumCPU()
-
-	wp := wpool.New(workersCounter)
+	repo := testRepo(t, config)
 
 	timeUnix := time.Now().Unix()
 	
 	login := fmt.Sprintf("test_%v", timeUnix)
 
 	//рега
-	newQuery := repository.LoginData{Login: login, Password: "test"}
+	newQuery := repository.LoginData{Login: login, Password: testPassword}
 	inputBuf := bytes.NewBuffer([]byte{})
 	if err := json.NewEncoder(inputBuf).Encode(newQuery); err != nil {
 		log.Println(err.Error())
 		return
 	}
-	result, _,_ := testRequest(t, config, repo, wp, "POST", "/api/user/register", inputBuf.String(), "", false)	
+	result, _,_ := testRequest(t, config, repo, "POST", "/api/user/register", inputBuf.String(), "", false)	
 	assert.Equal(t, 200, result.StatusCode)
 	defer result.Body.Close()
 
 
-	result,_,_ = testRequest(t, config, repo, wp, "POST", "/api/user/register", inputBuf.String(), "", false)	
+	result,_,_ = testRequest(t, config, repo, "POST", "/api/user/register", inputBuf.String(), "", false)	
 	assert.Equal(t, http.StatusConflict, result.StatusCode)
 	defer result.Body.Close()
 
 	//логин
-	result, _, cookies := testRequest(t, config, repo, wp, "POST", "/api/user/login", inputBuf.String(), "", false)	
+	result, loginBody, cookies := testRequest(t, config, repo, "POST", "/api/user/login", inputBuf.String(), "", false)	
 	assert.Equal(t, 200, result.StatusCode)
 	defer result.Body.Close()
 
-	token:= cookies[0].Value    
+	// тот же токен отдаётся в теле для Authorization: Bearer
+	var tokenData TokenData
+	require.NoError(t, json.Unmarshal([]byte(loginBody), &tokenData))
+	assert.Equal(t, cookies[0].Value, tokenData.Token)
+	assert.Equal(t, "Bearer", tokenData.TokenType)
+	// Authorization — заголовок запроса, в ответе его никто не читает
+	assert.Empty(t, result.Header.Get("Authorization"))
+
+	token:= testUserToken(t, cookies)    
 
 	newQuery = repository.LoginData{Login: login, Password: "wrong"}
 	inputBuf = bytes.NewBuffer([]byte{})
@@ -126,7 +178,7 @@ func TestRouter(t *testing.T) {
 		log.Println(err.Error())
 		return
 	}
-	result, _,_ = testRequest(t, config, repo, wp, "POST", "/api/user/login", inputBuf.String(), "", false)	
+	result, _,_ = testRequest(t, config, repo, "POST", "/api/user/login", inputBuf.String(), "", false)	
 	assert.Equal(t, http.StatusUnauthorized, result.StatusCode)
 	defer result.Body.Close()
 
@@ -135,41 +187,41 @@ func TestRouter(t *testing.T) {
 	n1 := goluhn.Generate(16)
 	n2 := goluhn.Generate(16)
 	
-	result, _,_ = testRequest(t, config, repo, wp, "POST", "/api/user/orders", "01", token, true)	
+	result, _,_ = testRequest(t, config, repo, "POST", "/api/user/orders", "01", token, true)	
 	assert.Equal(t, http.StatusUnprocessableEntity, result.StatusCode)
 	defer result.Body.Close()
 
-	result, _,_ = testRequest(t, config, repo, wp, "POST", "/api/user/orders",n1, token, true)	
+	result, _,_ = testRequest(t, config, repo, "POST", "/api/user/orders",n1, token, true)	
 	assert.Equal(t, http.StatusAccepted, result.StatusCode)
 	defer result.Body.Close()
 	timeString1 := carbon.Now().ToRfc3339String()
 
-	result, _,_ = testRequest(t, config, repo, wp, "POST", "/api/user/orders", n1, token, true)	
+	result, _,_ = testRequest(t, config, repo, "POST", "/api/user/orders", n1, token, true)	
 	assert.Equal(t, 200, result.StatusCode)
 	defer result.Body.Close()
 
 	//рега2
 	login2 := fmt.Sprintf("test__%v", timeUnix)
 
-	newQuery = repository.LoginData{Login: login2, Password: "test"}
+	newQuery = repository.LoginData{Login: login2, Password: testPassword}
 	inputBuf = bytes.NewBuffer([]byte{})
 	if err = json.NewEncoder(inputBuf).Encode(newQuery); err != nil {
 		log.Println(err.Error())
 		return
 	}
-	result, _,cookies = testRequest(t, config, repo, wp, "POST", "/api/user/register", inputBuf.String(), "", false)	
+	result, _,cookies = testRequest(t, config, repo, "POST", "/api/user/register", inputBuf.String(), "", false)	
 	assert.Equal(t, 200, result.StatusCode)
 	defer result.Body.Close()
 
 	
-	token2:= cookies[0].Value 
+	token2:= testUserToken(t, cookies) 
 
-	result, _,_ = testRequest(t, config, repo, wp, "POST", "/api/user/orders", n1, token2, true)	
+	result, _,_ = testRequest(t, config, repo, "POST", "/api/user/orders", n1, token2, true)	
 	assert.Equal(t, http.StatusConflict, result.StatusCode)
 	defer result.Body.Close()
 
 
-	result, _,_ = testRequest(t, config, repo, wp, "POST", "/api/user/orders", n2, token, true)	
+	result, _,_ = testRequest(t, config, repo, "POST", "/api/user/orders", n2, token, true)	
 	assert.Equal(t, http.StatusAccepted, result.StatusCode)
 	defer result.Body.Close()
 	timeString2 := carbon.Now().ToRfc3339String()
@@ -181,7 +233,7 @@ func TestRouter(t *testing.T) {
 		log.Println(err.Error())
 		return
 	}
-	result, body,_ := testRequest(t, config, repo, wp, "GET", "/api/user/balance", "", token, false)	
+	result, body,_ := testRequest(t, config, repo, "GET", "/api/user/balance", "", token, false)	
 	assert.Equal(t, 200, result.StatusCode)
 	assert.Equal(t, "application/json", result.Header.Get("Content-Type"))
 	assert.Equal(t, outputBuf.String(), body)
@@ -189,29 +241,29 @@ func TestRouter(t *testing.T) {
 
 
 	//списание
-	newQueryW := repository.Withdraw{OrderID: "1", Points: 5}
+	newQueryW := repository.Withdraw{OrderID: "1", Points: money.FromInt(5)}
 	inputBuf = bytes.NewBuffer([]byte{})
 	if err = json.NewEncoder(inputBuf).Encode(newQueryW); err != nil {
 		log.Println(err.Error())
 		return
 	}
-	result,_,_ = testRequest(t, config, repo, wp, "POST", "/api/user/balance/withdraw", inputBuf.String(), token, false)	
+	result,_,_ = testRequest(t, config, repo, "POST", "/api/user/balance/withdraw", inputBuf.String(), token, false)	
 	assert.Equal(t, http.StatusUnprocessableEntity, result.StatusCode)
 	defer result.Body.Close()
 
-	newQueryW = repository.Withdraw{OrderID: n1, Points: 5}
+	newQueryW = repository.Withdraw{OrderID: n1, Points: money.FromInt(5)}
 	inputBuf = bytes.NewBuffer([]byte{})
 	if err = json.NewEncoder(inputBuf).Encode(newQueryW); err != nil {
 		log.Println(err.Error())
 		return
 	}
-	result,_,_ = testRequest(t, config, repo, wp, "POST", "/api/user/balance/withdraw", inputBuf.String(), token, false)	
+	result,_,_ = testRequest(t, config, repo, "POST", "/api/user/balance/withdraw", inputBuf.String(), token, false)	
 	assert.Equal(t, http.StatusPaymentRequired, result.StatusCode)
 	defer result.Body.Close()
 
 
 	//списания
-	result,_,_ = testRequest(t, config, repo, wp, "GET", "/api/user/balance/withdrawals", "", token, false)	
+	result,_,_ = testRequest(t, config, repo, "GET", "/api/user/balance/withdrawals", "", token, false)	
 	assert.Equal(t, http.StatusNoContent, result.StatusCode)
 	defer result.Body.Close()
 
@@ -231,16 +283,587 @@ func TestRouter(t *testing.T) {
 		return
 	}
 	
-	result, body,_ = testRequest(t, config, repo, wp, "GET", "/api/user/orders", "", token, false)	
+	result, body,_ = testRequest(t, config, repo, "GET", "/api/user/orders", "", token, false)	
 	assert.Equal(t, 200, result.StatusCode)
 	assert.Equal(t, "application/json", result.Header.Get("Content-Type"))
 	assert.Equal(t, outputBuf.String(), body)
 	defer result.Body.Close()
 
 
-	result,_,_ = testRequest(t, config, repo, wp, "GET", "/api/user/orders", "", token2, false)	
+	result,_,_ = testRequest(t, config, repo, "GET", "/api/user/orders", "", token2, false)	
 	assert.Equal(t, http.StatusNoContent, result.StatusCode)
 	defer result.Body.Close()
 
 	
 }
+
+func TestOrderLifecycle(t *testing.T) {
+
+	config, err := config.New()
+	require.NoError(t, err)
+
+	repo := testRepo(t, config)
+
+	srv := accrualtest.NewServer()
+	defer srv.Close()
+
+	client, err := accrual.NewClient(srv.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wp := wpool.New(2)
+	go wp.Run(ctx)
+	go poller.New(repo, wp, client, 2).Run(ctx)
+
+	login := fmt.Sprintf("lifecycle_%v", time.Now().UnixNano())
+	inputBuf := bytes.NewBuffer([]byte{})
+	require.NoError(t, json.NewEncoder(inputBuf).Encode(repository.LoginData{Login: login, Password: testPassword}))
+
+	result, _, cookies := testRequest(t, config, repo, "POST", "/api/user/register", inputBuf.String(), "", false)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	token := testUserToken(t, cookies)
+
+	number := goluhn.Generate(16)
+	srv.SetOrder(number, accrual.StatusProcessing, 0)
+
+	result, _, _ = testRequest(t, config, repo, "POST", "/api/user/orders", number, token, true)
+	require.Equal(t, http.StatusAccepted, result.StatusCode)
+
+	orderStatus := func() string {
+		_, body, _ := testRequest(t, config, repo, "GET", "/api/user/orders", "", token, false)
+		var orders []repository.Accrual
+		if err := json.Unmarshal([]byte(body), &orders); err != nil || len(orders) == 0 {
+			return ""
+		}
+		return orders[0].Status
+	}
+
+	require.Eventually(t, func() bool {
+		return orderStatus() == "PROCESSING"
+	}, 10*time.Second, 100*time.Millisecond)
+
+	srv.SetOrder(number, accrual.StatusProcessed, money.FromInt(500))
+
+	require.Eventually(t, func() bool {
+		return orderStatus() == "PROCESSED"
+	}, 10*time.Second, 100*time.Millisecond)
+
+	_, body, _ := testRequest(t, config, repo, "GET", "/api/user/balance", "", token, false)
+	var balance repository.Balance
+	require.NoError(t, json.Unmarshal([]byte(body), &balance))
+	assert.Equal(t, repository.Balance{Current: money.FromInt(500), Withdrawn: 0}, balance)
+}
+
+func TestLoginUpgradesLegacyHash(t *testing.T) {
+
+	config, err := config.New()
+	require.NoError(t, err)
+
+	repo := testRepo(t, config)
+
+	login := fmt.Sprintf("legacy_%v", time.Now().UnixNano())
+	legacy := md5.Sum([]byte("test"))
+
+	userID, err := repo.SaveUser(context.Background(), login, hex.EncodeToString(legacy[:]))
+	require.NoError(t, err)
+	_, err = repo.SaveUserToken(context.Background(), userID, fmt.Sprintf("token_%v", login))
+	require.NoError(t, err)
+
+	inputBuf := bytes.NewBuffer([]byte{})
+	require.NoError(t, json.NewEncoder(inputBuf).Encode(repository.LoginData{Login: login, Password: "test"}))
+
+	result, _, _ := testRequest(t, config, repo, "POST", "/api/user/login", inputBuf.String(), "", false)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+
+	user, err := repo.FindUser(context.Background(), login)
+	require.NoError(t, err)
+	assert.Equal(t, password.AlgoArgon2id, password.Algorithm(user.Password))
+
+	// после пересчёта хеша вход по тому же паролю продолжает работать
+	result, _, _ = testRequest(t, config, repo, "POST", "/api/user/login", inputBuf.String(), "", false)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+}
+
+func TestRefreshToken(t *testing.T) {
+
+	config, err := config.New()
+	require.NoError(t, err)
+
+	repo := testRepo(t, config)
+
+	login := fmt.Sprintf("refresh_%v", time.Now().UnixNano())
+	inputBuf := bytes.NewBuffer([]byte{})
+	require.NoError(t, json.NewEncoder(inputBuf).Encode(repository.LoginData{Login: login, Password: testPassword}))
+
+	result, body, cookies := testRequest(t, config, repo, "POST", "/api/user/register", inputBuf.String(), "", false)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	userToken := testUserToken(t, cookies)
+
+	var first TokenData
+	require.NoError(t, json.Unmarshal([]byte(body), &first))
+	require.NotEmpty(t, first.RefreshToken)
+
+	refresh := func(token string) (*http.Response, TokenData) {
+		result, body, _ := testRequest(t, config, repo, "POST", "/api/user/token/refresh", fmt.Sprintf(`{"refresh_token":%q}`, token), "", false)
+		var data TokenData
+		if result.StatusCode == http.StatusOK {
+			require.NoError(t, json.Unmarshal([]byte(body), &data))
+		}
+		return result, data
+	}
+
+	result, second := refresh(first.RefreshToken)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+
+	claims, err := testKeys.Verify(second.Token)
+	require.NoError(t, err)
+	assert.Equal(t, userToken, claims.UserToken)
+
+	// повторное использование гасит всю сессию, включая уже выданный новый токен
+	result, _ = refresh(first.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, result.StatusCode)
+
+	result, _ = refresh(second.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, result.StatusCode)
+
+	session, err := repo.FindSession(context.Background(), claims.SessionID)
+	require.NoError(t, err)
+	assert.False(t, session.Active(time.Now()))
+
+	result, _ = refresh("unknown")
+	assert.Equal(t, http.StatusUnauthorized, result.StatusCode)
+}
+
+func TestRefreshToken_ChunkedEmptyBody(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.New()
+
+	id, err := repo.SaveUser(ctx, fmt.Sprintf("chunked_%v", time.Now().UnixNano()), "hash")
+	require.NoError(t, err)
+	token, err := repo.SaveUserToken(ctx, id, fmt.Sprintf("token_chunked_%v", id))
+	require.NoError(t, err)
+
+	tokenData, err := testSessions.start(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/user/login", nil), repo, token)
+	require.NoError(t, err)
+
+	// длина тела неизвестна, как у chunked-запроса: пустое тело — не ошибка, токен берётся из cookie
+	chunked := func(body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/user/token/refresh", ioutil.NopCloser(strings.NewReader(body)))
+		r.ContentLength = -1
+		r.AddCookie(&http.Cookie{Name: "refresh_token", Value: tokenData.RefreshToken})
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	RefreshHandler(repo, testSessions)(w, chunked(""))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	RefreshHandler(repo, testSessions)(w, chunked("{not json"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestLoginLockout(t *testing.T) {
+
+	config, err := config.New()
+	require.NoError(t, err)
+
+	repo := testRepo(t, config)
+
+	login := fmt.Sprintf("lockout_%v", time.Now().UnixNano())
+	right := fmt.Sprintf(`{"login":%q,"password":%q}`, login, testPassword)
+	wrong := fmt.Sprintf(`{"login":%q,"password":"wrong"}`, login)
+
+	result, _, _ := testRequest(t, config, repo, "POST", "/api/user/register", right, "", false)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+
+	for i := 0; i < throttle.DefaultLoginPolicy.MaxFailures; i++ {
+		result, _, _ = testRequest(t, config, repo, "POST", "/api/user/login", wrong, "", false)
+		require.Equal(t, http.StatusUnauthorized, result.StatusCode)
+	}
+
+	// после порога не проходит даже верный пароль
+	result, _, _ = testRequest(t, config, repo, "POST", "/api/user/login", right, "", false)
+	assert.Equal(t, http.StatusTooManyRequests, result.StatusCode)
+	assert.Equal(t, "30", result.Header.Get("Retry-After"))
+}
+
+func TestOrderUploadRace(t *testing.T) {
+
+	config, err := config.New()
+	require.NoError(t, err)
+
+	repo := testRepo(t, config)
+	number := goluhn.Generate(16)
+
+	statuses := make(chan int, 10)
+	var wg sync.WaitGroup
+
+	for i := 0; i < cap(statuses); i++ {
+		login := fmt.Sprintf("race_%v_%v", i, time.Now().UnixNano())
+		id, err := repo.SaveUser(context.Background(), login, "hash")
+		require.NoError(t, err)
+		token, err := repo.SaveUserToken(context.Background(), id, "token_"+login)
+		require.NoError(t, err)
+
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+
+			request := httptest.NewRequest(http.MethodPost, "/api/user/orders", strings.NewReader(number))
+			request.Header.Set("Content-type", "text/plain")
+			w := httptest.NewRecorder()
+			OrderHandler(repo, token)(w, request)
+
+			statuses <- w.Code
+		}(token)
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+
+	assert.Equal(t, map[int]int{http.StatusAccepted: 1, http.StatusConflict: 9}, counts)
+}
+
+func TestWithdrawIdempotent(t *testing.T) {
+
+	config, err := config.New()
+	require.NoError(t, err)
+
+	repo := testRepo(t, config)
+	ctx := context.Background()
+
+	newUser := func(prefix string) string {
+		login := fmt.Sprintf("%v_%v", prefix, time.Now().UnixNano())
+		id, err := repo.SaveUser(ctx, login, "hash")
+		require.NoError(t, err)
+		token, err := repo.SaveUserToken(ctx, id, "token_"+login)
+		require.NoError(t, err)
+
+		order := goluhn.Generate(16)
+		require.NoError(t, repo.CreateOrder(ctx, order, token))
+		require.NoError(t, repo.UpdateOrder(ctx, order, "PROCESSED", money.FromInt(100)))
+
+		return token
+	}
+
+	token := newUser("idempotent")
+	other := newUser("idempotent_other")
+
+	withdraw := func(userToken, key, order string, sum int64) (int, ErrorData) {
+		request := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(fmt.Sprintf(`{"order":%q,"sum":%v}`, order, sum)))
+		if key != "" {
+			request.Header.Set("Idempotency-Key", key)
+		}
+
+		w := httptest.NewRecorder()
+		WithdrawHandler(repo, userToken)(w, request)
+
+		var data ErrorData
+		if w.Code != http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+		}
+		return w.Code, data
+	}
+
+	order := goluhn.Generate(16)
+
+	// повтор клиента после обрыва связи не списывает второй раз
+	status, _ := withdraw(token, "", order, 10)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = withdraw(token, "", order, 10)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, data := withdraw(other, "", order, 10)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, "order", data.Field)
+
+	keyed := goluhn.Generate(16)
+	status, _ = withdraw(token, "retry-1", keyed, 5)
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = withdraw(token, "retry-1", keyed, 5)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, data = withdraw(token, "retry-1", goluhn.Generate(16), 5)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, ErrorData{Code: CodeConflict, Message: "idempotency key was used for another withdrawal", Field: "Idempotency-Key"}, data)
+
+	status, data = withdraw(token, strings.Repeat("k", 256), goluhn.Generate(16), 5)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "Idempotency-Key", data.Field)
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, repository.Balance{Current: money.FromInt(85), Withdrawn: money.FromInt(15)}, *balance)
+}
+
+func TestValidationErrors(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		status  int
+		error   ErrorData
+	}{
+		{
+			name:    "register malformed json",
+			handler: RegisterHandler(nil, testSessions),
+			body:    `{"login":`,
+			status:  http.StatusBadRequest,
+			error:   ErrorData{Code: CodeInvalidJSON, Message: "request body must be a valid JSON object"},
+		},
+		{
+			name:    "register empty login",
+			handler: RegisterHandler(nil, testSessions),
+			body:    `{"login":"","password":"test-pass-1"}`,
+			status:  http.StatusBadRequest,
+			error:   ErrorData{Code: validation.CodeRequired, Message: "login is required", Field: "login"},
+		},
+		{
+			name:    "register weak password",
+			handler: RegisterHandler(nil, testSessions),
+			body:    `{"login":"someone","password":"password"}`,
+			status:  http.StatusBadRequest,
+			error:   ErrorData{Code: validation.CodeWeakPassword, Message: "password must contain letters and digits and differ from login", Field: "password"},
+		},
+		{
+			name:    "login empty password",
+			handler: LoginHandler(nil, testSessions, testGuard),
+			body:    `{"login":"someone"}`,
+			status:  http.StatusBadRequest,
+			error:   ErrorData{Code: validation.CodeRequired, Message: "password is required", Field: "password"},
+		},
+		{
+			name:    "withdraw malformed json",
+			handler: WithdrawHandler(nil, "token"),
+			body:    `{"order":"2377225624","sum":`,
+			status:  http.StatusBadRequest,
+			error:   ErrorData{Code: CodeInvalidJSON, Message: "request body must be a valid JSON object"},
+		},
+		{
+			name:    "withdraw negative sum",
+			handler: WithdrawHandler(nil, "token"),
+			body:    `{"order":"2377225624","sum":-5}`,
+			status:  http.StatusBadRequest,
+			error:   ErrorData{Code: validation.CodeNotPositive, Message: "sum must be positive", Field: "sum"},
+		},
+		{
+			name:    "withdraw bad order",
+			handler: WithdrawHandler(nil, "token"),
+			body:    `{"order":"2377225625","sum":5}`,
+			status:  http.StatusUnprocessableEntity,
+			error:   ErrorData{Code: validation.CodeInvalidNumber, Message: "order number is invalid", Field: "order"},
+		},
+	}
+
+	// до репозитория эти запросы не доходят, поэтому БД не нужна
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+			var data ErrorData
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+			assert.Equal(t, tt.error, data)
+		})
+	}
+}
+
+func TestListPagination(t *testing.T) {
+
+	config, err := config.New()
+	require.NoError(t, err)
+
+	repo := testRepo(t, config)
+	ctx := context.Background()
+
+	login := fmt.Sprintf("pages_%v", time.Now().UnixNano())
+	id, err := repo.SaveUser(ctx, login, "hash")
+	require.NoError(t, err)
+	token, err := repo.SaveUserToken(ctx, id, "token_"+login)
+	require.NoError(t, err)
+
+	var numbers []string
+	for i := 0; i < 3; i++ {
+		number := goluhn.Generate(16)
+		require.NoError(t, repo.CreateOrder(ctx, number, token))
+		numbers = append(numbers, number)
+		time.Sleep(time.Millisecond)
+	}
+
+	list := func(handler http.HandlerFunc, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		return w
+	}
+
+	w := list(OrderListHandler(repo, token), "limit=2&sort=desc")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var page []repository.Accrual
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page, 2)
+	assert.Equal(t, numbers[2], page[0].OrderID)
+	assert.Equal(t, numbers[1], page[1].OrderID)
+
+	next := w.Header().Get("X-Next-Cursor")
+	require.NotEmpty(t, next)
+
+	w = list(OrderListHandler(repo, token), "limit=2&sort=desc&after="+next)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page, 1)
+	assert.Equal(t, numbers[0], page[0].OrderID)
+	assert.Empty(t, w.Header().Get("X-Next-Cursor"))
+
+	// курсор от убывающей выдачи не подходит к возрастающей и к другому фильтру
+	w = list(OrderListHandler(repo, token), "limit=2&sort=asc&after="+next)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = list(OrderListHandler(repo, token), "limit=2&sort=desc&status=new&after="+next)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = list(OrderListHandler(repo, token), "status=processed")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = list(OrderListHandler(repo, token), "status=new&from=2022-01-01T00:00:00Z")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Len(t, page, 3)
+
+	// ошибки в параметрах не доходят до репозитория
+	tests := []struct {
+		handler http.HandlerFunc
+		query   string
+		field   string
+	}{
+		{handler: OrderListHandler(nil, token), query: "limit=0", field: "limit"},
+		{handler: OrderListHandler(nil, token), query: "limit=1001", field: "limit"},
+		{handler: OrderListHandler(nil, token), query: "after=garbage", field: "after"},
+		{handler: OrderListHandler(nil, token), query: "status=DONE", field: "status"},
+		{handler: OrderListHandler(nil, token), query: "from=yesterday", field: "from"},
+		{handler: OrderListHandler(nil, token), query: "from=2022-02-01T00:00:00Z&to=2022-01-01T00:00:00Z", field: "to"},
+		{handler: OrderListHandler(nil, token), query: "sort=up", field: "sort"},
+		{handler: WithdrawListHandler(nil, token), query: "status=PROCESSED", field: "status"},
+	}
+
+	for _, tt := range tests {
+		w := list(tt.handler, tt.query)
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.query)
+
+		var data ErrorData
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+		assert.Equal(t, validation.CodeInvalidValue, data.Code, tt.query)
+		assert.Equal(t, tt.field, data.Field, tt.query)
+	}
+}
+
+func TestStatement(t *testing.T) {
+
+	config, err := config.New()
+	require.NoError(t, err)
+
+	repo := testRepo(t, config)
+	ctx := context.Background()
+
+	login := fmt.Sprintf("statement_%v", time.Now().UnixNano())
+	id, err := repo.SaveUser(ctx, login, "hash")
+	require.NoError(t, err)
+	token, err := repo.SaveUserToken(ctx, id, "token_"+login)
+	require.NoError(t, err)
+
+	statement := func(query, accept string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/api/user/statement?"+query, nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+
+		w := httptest.NewRecorder()
+		StatementHandler(repo, token)(w, request)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, statement("", "").Code)
+
+	accrued := goluhn.Generate(16)
+	require.NoError(t, repo.CreateOrder(ctx, accrued, token))
+	require.NoError(t, repo.UpdateOrder(ctx, accrued, "PROCESSED", money.FromInt(100)))
+	time.Sleep(time.Millisecond)
+
+	withdrawn := goluhn.Generate(16)
+	require.NoError(t, repo.SaveWithdraw(ctx, withdrawn, money.MustParse("40.5"), token, ""))
+
+	w := statement("", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var entries []repository.StatementEntry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, money.MustParse("-40.5"), entries[1].Amount)
+	assert.Equal(t, money.MustParse("59.5"), entries[1].Balance)
+
+	w = statement("", "text/csv")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, []string{"processed_at", "order", "type", "amount", "balance"}, records[0])
+	assert.Equal(t, []string{entries[0].ProcessedAt, accrued, "accrual", "100", "100"}, records[1])
+	assert.Equal(t, []string{entries[1].ProcessedAt, withdrawn, "withdrawal", "-40.5", "59.5"}, records[2])
+
+	// явный format важнее Accept
+	w = statement("format=json", "text/csv")
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	assert.Equal(t, http.StatusNoContent, statement("from=2100-01-01T00:00:00Z", "").Code)
+
+	w = statement("format=xml", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = statement("from=2022-02-01T00:00:00Z&to=2022-01-01T00:00:00Z", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// brokenUsers — хранилище, у которого поиск пользователя падает, как при недоступной БД
+type brokenUsers struct {
+	repository.Repositorier
+}
+
+func (brokenUsers) FindUser(ctx context.Context, login string) (*repository.User, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestLoginStorageFailure(t *testing.T) {
+	guard := throttle.New(throttle.NewMemory(), throttle.Policy{MaxFailures: 1, BaseLockout: time.Minute, MaxLockout: time.Minute, Window: time.Hour}, throttle.DefaultIPPolicy)
+	body := `{"login":"someone","password":"test-pass-1"}`
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		LoginHandler(brokenUsers{memory.New()}, testSessions, guard)(w, httptest.NewRequest(http.MethodPost, "/api/user/login", strings.NewReader(body)))
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	}
+
+	// сбой хранилища не записан как неудачная попытка
+	assert.NoError(t, guard.Check(context.Background(), "someone", "192.0.2.1"))
+
+	w := httptest.NewRecorder()
+	LoginHandler(memory.New(), testSessions, guard)(w, httptest.NewRequest(http.MethodPost, "/api/user/login", strings.NewReader(body)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Error(t, guard.Check(context.Background(), "someone", "192.0.2.1"))
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/auth"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/validation"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Sessions — настройки выдачи токенов: короткий access-токен подписывается ключами Keys,
+// refresh-токен живёт столько же, сколько сессия, и годится на один обмен.
+type Sessions struct {
+	Keys       *auth.KeyRing
+	AccessTTL  time.Duration
+	SessionTTL time.Duration
+}
+
+type TokenData struct {
+	Token        string `json:"token"`
+	TokenType    string `json:"token_type"`
+	ExpiresAt    string `json:"expires_at"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type RefreshData struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// start заводит сессию в БД с первым refresh-токеном и выдаёт к ней access-токен.
+func (s Sessions) start(w http.ResponseWriter, r *http.Request, repo repository.Repositorier, userToken string) (*TokenData, error) {
+	sessionID, err := auth.NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &repository.Session{
+		ID:        sessionID,
+		UserToken: userToken,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(s.SessionTTL),
+	}
+
+	if err := repo.CreateSession(r.Context(), session.ID, session.UserToken, session.ExpiresAt, refreshHash); err != nil {
+		return nil, err
+	}
+
+	return s.issue(w, session, refreshToken)
+}
+
+// issue подписывает access-токен и ставит cookie; тот же токен возвращается для тела ответа —
+// для клиентов с заголовком Authorization: Bearer. Токен не переживает свою сессию.
+func (s Sessions) issue(w http.ResponseWriter, session *repository.Session, refreshToken string) (*TokenData, error) {
+	now := time.Now()
+
+	expiresAt := now.Add(s.AccessTTL)
+	if expiresAt.After(session.ExpiresAt) {
+		expiresAt = session.ExpiresAt
+	}
+
+	signed, err := s.Keys.Sign(auth.Claims{
+		SessionID: session.ID,
+		UserToken: session.UserToken,
+		IssuedAt:  now,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "user_token",
+		Value:    signed,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+	})
+
+	// refresh-токен браузер отправляет только на обмен
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refreshToken,
+		Path:     "/api/user/token/refresh",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+	})
+
+	return &TokenData{
+		Token:        signed,
+		TokenType:    "Bearer",
+		ExpiresAt:    expiresAt.Format(time.RFC3339),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func writeToken(w http.ResponseWriter, token *TokenData) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(token)
+}
+
+func clearSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "user_token",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    "",
+		Path:     "/api/user/token/refresh",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// RefreshHandler меняет refresh-токен из тела (или cookie) на новую пару токенов.
+// Повторное предъявление уже использованного токена отзывает всю сессию.
+func RefreshHandler(repo repository.Repositorier, sessions Sessions) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var refreshData RefreshData
+
+		// тело необязательно; у chunked-запроса длина заранее неизвестна (-1), поэтому пустое тело
+		// узнаём по io.EOF от декодера, а не по ContentLength
+		if err := json.NewDecoder(r.Body).Decode(&refreshData); err != nil && err != io.EOF {
+			WriteError(w, http.StatusBadRequest, ErrorData{Code: CodeInvalidJSON, Message: "request body must be a valid JSON object"})
+			return
+		}
+
+		if refreshData.RefreshToken == "" {
+			if cookie, err := r.Cookie("refresh_token"); err == nil {
+				refreshData.RefreshToken = cookie.Value
+			}
+		}
+
+		if refreshData.RefreshToken == "" {
+			WriteError(w, http.StatusBadRequest, ErrorData{Code: validation.CodeRequired, Message: "refresh_token is required", Field: "refresh_token"})
+			return
+		}
+
+		refreshToken, refreshHash, err := auth.NewRefreshToken()
+
+		if err != nil {
+			writeInternal(w, r, err)
+			return
+		}
+
+		session, err := repo.RotateRefreshToken(r.Context(), auth.HashRefreshToken(refreshData.RefreshToken), refreshHash)
+
+		if err != nil {
+			var rte *repository.RefreshTokenError
+			var rtre *repository.RefreshTokenReuseError
+
+			if errors.As(err, &rte) || errors.As(err, &rtre) {
+				clearSession(w)
+				WriteError(w, http.StatusUnauthorized, ErrorData{Code: CodeUnauthorized, Message: "refresh token is invalid or expired"})
+				return
+			}
+
+			writeInternal(w, r, err)
+			return
+		}
+
+		tokenData, err := sessions.issue(w, session, refreshToken)
+
+		if err != nil {
+			writeInternal(w, r, err)
+			return
+		}
+
+		writeToken(w, tokenData)
+	}
+}
+
+func LogoutHandler(repo repository.Repositorier, sessionID string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if err := repo.RevokeSession(r.Context(), sessionID); err != nil {
+			writeInternal(w, r, err)
+			return
+		}
+
+		clearSession(w)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// LogoutAllHandler отзывает все сессии пользователя, включая текущую
+func LogoutAllHandler(repo repository.Repositorier, userToken string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if _, err := repo.RevokeUserSessions(r.Context(), userToken); err != nil {
+			writeInternal(w, r, err)
+			return
+		}
+
+		clearSession(w)
+		w.WriteHeader(http.StatusOK)
+	}
+}
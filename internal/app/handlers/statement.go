@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/validation"
+	"net/http"
+	"strings"
+)
+
+// StatementHandler отдаёт выписку в JSON или CSV: формат выбирается параметром format,
+// без него — по заголовку Accept.
+func StatementHandler(repo repository.Repositorier, userToken string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		from, to, err := validation.Period(r.URL.Query())
+		if err != nil {
+			writeInvalid(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+			if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+				format = "csv"
+			}
+		}
+
+		if format != "json" && format != "csv" {
+			WriteError(w, http.StatusBadRequest, ErrorData{Code: validation.CodeInvalidValue, Message: "format must be json or csv", Field: "format"})
+			return
+		}
+
+		entries, err := repo.GetStatement(r.Context(), userToken, from, to)
+		if err != nil {
+			writeInternal(w, r, err)
+			return
+		}
+
+		if len(entries) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		buf := bytes.NewBuffer([]byte{})
+
+		if format == "csv" {
+			if err := writeStatementCSV(buf, entries); err != nil {
+				writeInternal(w, r, err)
+				return
+			}
+
+			w.Header().Set("content-type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="statement.csv"`)
+		} else {
+			if err := json.NewEncoder(buf).Encode(entries); err != nil {
+				writeInternal(w, r, err)
+				return
+			}
+
+			w.Header().Set("content-type", "application/json")
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+	}
+}
+
+func writeStatementCSV(buf *bytes.Buffer, entries []repository.StatementEntry) error {
+	cw := csv.NewWriter(buf)
+
+	if err := cw.Write([]string{"processed_at", "order", "type", "amount", "balance"}); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		record := []string{entry.ProcessedAt, entry.OrderID, entry.Type, entry.Amount.String(), entry.Balance.String()}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,384 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockID — ключ pg_advisory_lock: экземпляры сервиса, стартующие одновременно,
+// применяют миграции по очереди, а не наперегонки.
+const lockID int64 = 7284921365
+
+const createTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version bigint primary key,
+	name text not null,
+	applied_at TIMESTAMPTZ not null default now()
+)`
+
+// Migration — файл в формате goose: <version>_<name>.sql с секциями -- +goose Up и -- +goose Down.
+// Секция выполняется целиком одним запросом, поэтому StatementBegin/StatementEnd ничего не меняют.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+	// NoTx — файл помечен -- +goose NO TRANSACTION (например, CREATE INDEX CONCURRENTLY)
+	NoTx bool
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type ParseError struct {
+	File    string
+	Message string
+}
+
+func (pe *ParseError) Error() string {
+	return fmt.Sprintf("migration %v: %v", pe.File, pe.Message)
+}
+
+type MigrationError struct {
+	Version int64
+	Name    string
+	Err     error
+}
+
+func (me *MigrationError) Error() string {
+	return fmt.Sprintf("migration %v_%v: %v", me.Version, me.Name, me.Err)
+}
+
+func (me *MigrationError) Unwrap() error {
+	return me.Err
+}
+
+// Load читает *.sql из корня fsys и возвращает миграции по возрастанию версии.
+func Load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int64]string)
+
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := Parse(file, string(data))
+		if err != nil {
+			return nil, err
+		}
+
+		if other, ok := seen[m.Version]; ok {
+			return nil, &ParseError{File: file, Message: fmt.Sprintf("version %v is already used by %v", m.Version, other)}
+		}
+		seen[m.Version] = file
+
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func Parse(file string, source string) (Migration, error) {
+	m := Migration{}
+
+	base := strings.TrimSuffix(path.Base(file), ".sql")
+	i := strings.Index(base, "_")
+	if i <= 0 {
+		return m, &ParseError{File: file, Message: "file name must be <version>_<name>.sql"}
+	}
+
+	version, err := strconv.ParseInt(base[:i], 10, 64)
+	if err != nil || version <= 0 {
+		return m, &ParseError{File: file, Message: "version must be a positive number"}
+	}
+
+	m.Version = version
+	m.Name = base[i+1:]
+
+	var up, down strings.Builder
+	var section *strings.Builder
+	hasUp := false
+
+	scanner := bufio.NewScanner(strings.NewReader(source))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "-- +goose ") {
+			switch annotation := strings.TrimSpace(strings.TrimPrefix(trimmed, "-- +goose ")); annotation {
+			case "Up":
+				if hasUp {
+					return m, &ParseError{File: file, Message: "duplicate Up section"}
+				}
+				hasUp = true
+				section = &up
+			case "Down":
+				section = &down
+			case "StatementBegin", "StatementEnd":
+			case "NO TRANSACTION":
+				m.NoTx = true
+			default:
+				return m, &ParseError{File: file, Message: fmt.Sprintf("unknown annotation %q", annotation)}
+			}
+			continue
+		}
+
+		if section == nil {
+			if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+				return m, &ParseError{File: file, Message: "statement outside of Up/Down sections"}
+			}
+			continue
+		}
+
+		section.WriteString(line)
+		section.WriteString("\n")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return m, &ParseError{File: file, Message: err.Error()}
+	}
+
+	if !hasUp || strings.TrimSpace(up.String()) == "" {
+		return m, &ParseError{File: file, Message: "Up section is missing or empty"}
+	}
+
+	m.Up = up.String()
+	m.Down = down.String()
+
+	return m, nil
+}
+
+// Migrator работает на одном соединении: advisory-блокировка сессионная и держится, пока оно открыто.
+type Migrator struct {
+	conn       *pgx.Conn
+	migrations []Migration
+}
+
+func New(conn *pgx.Conn, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		conn:       conn,
+		migrations: migrations,
+	}, nil
+}
+
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// withLock выполняет f под сессионной advisory-блокировкой.
+func (m *Migrator) withLock(ctx context.Context, f func(conn *pgx.Conn) error) error {
+	conn := m.conn
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", lockID); err != nil {
+		return err
+	}
+
+	// блокировка снимается и при ошибке; контекст может быть уже отменён
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", lockID)
+
+	if _, err := conn.Exec(ctx, createTable); err != nil {
+		return err
+	}
+
+	return f(conn)
+}
+
+func applied(ctx context.Context, conn *pgx.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.Query(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[int64]time.Time)
+
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		versions[version] = appliedAt
+	}
+
+	return versions, rows.Err()
+}
+
+// run выполняет тело миграции и запись в schema_migrations одной транзакцией, если файл это допускает.
+func run(ctx context.Context, conn *pgx.Conn, m Migration, body string, record string, args ...interface{}) error {
+	if m.NoTx {
+		if _, err := conn.Exec(ctx, body); err != nil {
+			return &MigrationError{Version: m.Version, Name: m.Name, Err: err}
+		}
+
+		_, err := conn.Exec(ctx, record, args...)
+		return err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	// без аргументов запрос идёт простым протоколом, и в секции может быть несколько команд
+	if _, err := tx.Exec(ctx, body); err != nil {
+		return &MigrationError{Version: m.Version, Name: m.Name, Err: err}
+	}
+
+	if _, err := tx.Exec(ctx, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Up применяет все ещё не применённые миграции по возрастанию версии.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+
+	err := m.withLock(ctx, func(conn *pgx.Conn) error {
+		versions, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, ok := versions[migration.Version]; ok {
+				continue
+			}
+
+			err := run(ctx, conn, migration, migration.Up,
+				"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+			if err != nil {
+				return err
+			}
+
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Pending возвращает ещё не применённые миграции, ничего не меняя в базе: ни блокировки,
+// ни создания schema_migrations, поэтому годится для запусков только на чтение.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	var exists bool
+
+	if err := m.conn.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return m.migrations, nil
+	}
+
+	versions, err := applied(ctx, m.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+
+	for _, migration := range m.migrations {
+		if _, ok := versions[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Down откатывает последнюю применённую миграцию; nil — откатывать нечего.
+func (m *Migrator) Down(ctx context.Context) (*Migration, error) {
+	var done *Migration
+
+	err := m.withLock(ctx, func(conn *pgx.Conn) error {
+		versions, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+
+			if _, ok := versions[migration.Version]; !ok {
+				continue
+			}
+
+			if strings.TrimSpace(migration.Down) == "" {
+				return &MigrationError{Version: migration.Version, Name: migration.Name, Err: fmt.Errorf("no Down section")}
+			}
+
+			err := run(ctx, conn, migration, migration.Down,
+				"DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+			if err != nil {
+				return err
+			}
+
+			done = &migration
+			return nil
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+
+	err := m.withLock(ctx, func(conn *pgx.Conn) error {
+		versions, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Migration: migration}
+
+			if appliedAt, ok := versions[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+
+			statuses = append(statuses, status)
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
@@ -0,0 +1,193 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"github.com/DatDomrachev/go-loyalty-system/migrations"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParse(t *testing.T) {
+	m, err := Parse("20220101120000_add_users.sql", `-- комментарий до секций
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE users (id integer);
+CREATE INDEX users_id ON users(id);
+-- +goose StatementEnd
+
+-- +goose Down
+DROP TABLE users;
+`)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(20220101120000), m.Version)
+	assert.Equal(t, "add_users", m.Name)
+	assert.Contains(t, m.Up, "CREATE TABLE users")
+	assert.Contains(t, m.Up, "CREATE INDEX users_id")
+	assert.NotContains(t, m.Up, "DROP")
+	assert.Equal(t, "DROP TABLE users;\n", m.Down)
+	assert.False(t, m.NoTx)
+
+	m, err = Parse("2_concurrently.sql", "-- +goose NO TRANSACTION\n-- +goose Up\nCREATE INDEX CONCURRENTLY i ON t(c);\n")
+	require.NoError(t, err)
+	assert.True(t, m.NoTx)
+	assert.Empty(t, m.Down)
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		source string
+	}{
+		{name: "no version", file: "init.sql", source: "-- +goose Up\nSELECT 1;"},
+		{name: "bad version", file: "v1_init.sql", source: "-- +goose Up\nSELECT 1;"},
+		{name: "no up", file: "1_init.sql", source: "-- +goose Down\nSELECT 1;"},
+		{name: "empty up", file: "1_init.sql", source: "-- +goose Up\n\n-- +goose Down\nSELECT 1;"},
+		{name: "duplicate up", file: "1_init.sql", source: "-- +goose Up\nSELECT 1;\n-- +goose Up\nSELECT 2;"},
+		{name: "statement outside", file: "1_init.sql", source: "SELECT 0;\n-- +goose Up\nSELECT 1;"},
+		{name: "unknown annotation", file: "1_init.sql", source: "-- +goose Up\n-- +goose Sideways\nSELECT 1;"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.file, tt.source)
+
+			var pe *ParseError
+			assert.True(t, errors.As(err, &pe), "got %v", err)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"10_second.sql": {Data: []byte("-- +goose Up\nSELECT 2;")},
+		"2_first.sql":   {Data: []byte("-- +goose Up\nSELECT 1;")},
+		"README.md":     {Data: []byte("not a migration")},
+	}
+
+	list, err := Load(fsys)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "first", list[0].Name)
+	assert.Equal(t, "second", list[1].Name)
+
+	fsys["02_again.sql"] = &fstest.MapFile{Data: []byte("-- +goose Up\nSELECT 3;")}
+	_, err = Load(fsys)
+	assert.Error(t, err)
+}
+
+// встроенные миграции сервиса должны разбираться без ошибок и иметь Down
+func TestLoad_Embedded(t *testing.T) {
+	list, err := Load(migrations.FS)
+	require.NoError(t, err)
+	require.NotEmpty(t, list)
+
+	for _, m := range list {
+		assert.NotEmpty(t, m.Down, "%v_%v", m.Version, m.Name)
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	dataBaseURL := os.Getenv("DATABASE_URI")
+	if dataBaseURL == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+
+	ctx := context.Background()
+
+	connect := func() *pgx.Conn {
+		conn, err := pgx.Connect(ctx, dataBaseURL)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close(ctx) })
+
+		return conn
+	}
+
+	db := connect()
+
+	// версии больше любых настоящих, чтобы Down откатывал именно их
+	fsys := fstest.MapFS{
+		"99990101000001_test_table.sql":  {Data: []byte("-- +goose Up\nCREATE TABLE migrator_test (id integer);\n-- +goose Down\nDROP TABLE migrator_test;\n")},
+		"99990101000002_test_column.sql": {Data: []byte("-- +goose Up\nALTER TABLE migrator_test ADD COLUMN name text;\nINSERT INTO migrator_test VALUES (1, 'one');\n-- +goose Down\nALTER TABLE migrator_test DROP COLUMN name;\n")},
+	}
+
+	m, err := New(db, fsys)
+	require.NoError(t, err)
+
+	defer func() {
+		db.Exec(ctx, "DROP TABLE IF EXISTS migrator_test")
+		db.Exec(ctx, "DELETE FROM schema_migrations WHERE version >= 99990101000000")
+	}()
+
+	// экземпляры стартуют одновременно, каждый со своим соединением, но каждая миграция применяется один раз
+	var wg sync.WaitGroup
+	applied := make([]int, 5)
+
+	for i := range applied {
+		instance, err := New(connect(), fsys)
+		require.NoError(t, err)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			done, err := instance.Up(ctx)
+			assert.NoError(t, err)
+			applied[i] = len(done)
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range applied {
+		total += n
+	}
+	assert.Equal(t, 2, total)
+
+	pending, err := m.Pending(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	statuses, err := m.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	assert.NotNil(t, statuses[0].AppliedAt)
+	assert.NotNil(t, statuses[1].AppliedAt)
+
+	down, err := m.Down(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, down)
+	assert.Equal(t, int64(99990101000002), down.Version)
+
+	statuses, err = m.Status(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, statuses[1].AppliedAt)
+
+	pending, err = m.Pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, int64(99990101000002), pending[0].Version)
+
+	// упавшая миграция не оставляет ни изменений, ни записи в schema_migrations
+	broken := fstest.MapFS{
+		"99990101000003_broken.sql": {Data: []byte("-- +goose Up\nALTER TABLE migrator_test ADD COLUMN extra text;\nSELECT * FROM missing_table;\n")},
+	}
+
+	bm, err := New(db, broken)
+	require.NoError(t, err)
+
+	_, err = bm.Up(ctx)
+	var me *MigrationError
+	assert.True(t, errors.As(err, &me))
+
+	var count int
+	require.NoError(t, db.QueryRow(ctx, "SELECT count(*) FROM information_schema.columns WHERE table_name = 'migrator_test' AND column_name = 'extra'").Scan(&count))
+	assert.Equal(t, 0, count)
+}
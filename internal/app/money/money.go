@@ -0,0 +1,174 @@
+package money
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Scale — количество минимальных единиц (копеек) в одном балле.
+const Scale = 100
+
+const (
+	maxLength   = 40
+	maxExponent = 20
+)
+
+// Amount хранит сумму баллов в копейках, чтобы сложения и списания не копили ошибку округления.
+// В JSON и в БД (NUMERIC) сумма выглядит как обычное десятичное число: 500, 729.98.
+type Amount int64
+
+type ParseError struct {
+	Value string
+}
+
+func (pe *ParseError) Error() string {
+	return fmt.Sprintf("invalid amount %q", pe.Value)
+}
+
+func FromInt(units int64) Amount {
+	return Amount(units * Scale)
+}
+
+// FromFloat округляет до копейки, половина — от нуля.
+func FromFloat(f float64) Amount {
+	return Amount(math.Round(f * Scale))
+}
+
+// Parse разбирает десятичную запись суммы; лишние знаки после копеек округляются, половина — от нуля.
+func Parse(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+
+	if s == "" || len(s) > maxLength || strings.Trim(s, "0123456789.+-eE") != "" {
+		return 0, &ParseError{Value: s}
+	}
+
+	// огромная экспонента заставила бы big.Rat считать 10^N
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exp, err := strconv.Atoi(s[i+1:])
+		if err != nil || exp > maxExponent || exp < -maxExponent {
+			return 0, &ParseError{Value: s}
+		}
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, &ParseError{Value: s}
+	}
+
+	r.Mul(r, big.NewRat(Scale, 1))
+
+	num := new(big.Int).Set(r.Num())
+	den := r.Denom()
+
+	q, m := new(big.Int).QuoRem(num, den, new(big.Int))
+	m.Abs(m).Mul(m, big.NewInt(2))
+	if m.Cmp(den) >= 0 {
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+
+	if !q.IsInt64() {
+		return 0, &ParseError{Value: s}
+	}
+
+	return Amount(q.Int64()), nil
+}
+
+func MustParse(s string) Amount {
+	a, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func (a Amount) Minor() int64 {
+	return int64(a)
+}
+
+func (a Amount) Float64() float64 {
+	return float64(a) / Scale
+}
+
+// String форматирует сумму без лишних нулей: 500, 729.9, 0.05.
+func (a Amount) String() string {
+	sign := ""
+	v := int64(a)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+
+	units := v / Scale
+	cents := v % Scale
+
+	if cents == 0 {
+		return sign + strconv.FormatInt(units, 10)
+	}
+
+	frac := strings.TrimRight(fmt.Sprintf("%02d", cents), "0")
+
+	return sign + strconv.FormatInt(units, 10) + "." + frac
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	v, err := Parse(string(data))
+	if err != nil {
+		return err
+	}
+
+	*a = v
+	return nil
+}
+
+func (a *Amount) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*a = 0
+		return nil
+	case string:
+		parsed, err := Parse(v)
+		if err != nil {
+			return err
+		}
+		*a = parsed
+		return nil
+	case []byte:
+		parsed, err := Parse(string(v))
+		if err != nil {
+			return err
+		}
+		*a = parsed
+		return nil
+	case int64:
+		*a = FromInt(v)
+		return nil
+	case float64:
+		*a = FromFloat(v)
+		return nil
+	default:
+		return fmt.Errorf("unable to scan %T into money.Amount", src)
+	}
+}
+
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
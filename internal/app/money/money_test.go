@@ -0,0 +1,89 @@
+package money
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+	}{
+		{in: "500", want: 50000},
+		{in: "729.98", want: 72998},
+		{in: "0.1", want: 10},
+		{in: "-1.5", want: -150},
+		{in: "1e2", want: 10000},
+		{in: "0.005", want: 1},
+		{in: "-0.005", want: -1},
+		{in: "0.004", want: 0},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+
+	for _, in := range []string{"", "abc", "1,5", "99999999999999999999999", "1e1000000000", "1/3", "0x10"} {
+		_, err := Parse(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, "0", Amount(0).String())
+	assert.Equal(t, "500", FromInt(500).String())
+	assert.Equal(t, "729.98", Amount(72998).String())
+	assert.Equal(t, "729.9", Amount(72990).String())
+	assert.Equal(t, "0.05", Amount(5).String())
+	assert.Equal(t, "-0.5", Amount(-50).String())
+}
+
+func TestArithmetic(t *testing.T) {
+	// 0.1 + 0.2 во float64 не равно 0.3, в копейках — равно
+	var sum Amount
+	for i := 0; i < 10; i++ {
+		sum += MustParse("0.1")
+	}
+	assert.Equal(t, FromInt(1), sum)
+	assert.Equal(t, MustParse("0.3"), MustParse("0.1")+MustParse("0.2"))
+}
+
+func TestJSON(t *testing.T) {
+	type balance struct {
+		Current Amount `json:"current"`
+		Accrual Amount `json:"accrual,omitempty"`
+	}
+
+	out, err := json.Marshal(balance{Current: MustParse("500.5")})
+	require.NoError(t, err)
+	assert.Equal(t, `{"current":500.5}`, string(out))
+
+	var in balance
+	require.NoError(t, json.Unmarshal([]byte(`{"current":729.98,"accrual":null}`), &in))
+	assert.Equal(t, Amount(72998), in.Current)
+	assert.Equal(t, Amount(0), in.Accrual)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"current":"abc"}`), &in))
+}
+
+func TestScan(t *testing.T) {
+	var a Amount
+
+	require.NoError(t, a.Scan("729.98"))
+	assert.Equal(t, Amount(72998), a)
+
+	require.NoError(t, a.Scan([]byte("0.10")))
+	assert.Equal(t, Amount(10), a)
+
+	require.NoError(t, a.Scan(nil))
+	assert.Equal(t, Amount(0), a)
+
+	v, err := Amount(72998).Value()
+	require.NoError(t, err)
+	assert.Equal(t, "729.98", v)
+}
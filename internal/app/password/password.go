@@ -0,0 +1,143 @@
+package password
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+)
+
+const (
+	AlgoArgon2id = "argon2id"
+	AlgoMD5      = "md5"
+)
+
+type Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultParams — рекомендация OWASP для argon2id: 19 MiB, 2 прохода, 1 поток.
+var DefaultParams = Params{
+	Memory:  19 * 1024,
+	Time:    2,
+	Threads: 1,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+type MalformedHashError struct {
+	Message string
+}
+
+func (mhe *MalformedHashError) Error() string {
+	return fmt.Sprintf("malformed password hash: %v", mhe.Message)
+}
+
+// Hash возвращает хеш в формате PHC: $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>.
+// Алгоритм и параметры хранятся вместе с хешем, соль у каждого пользователя своя.
+func Hash(password string) (string, error) {
+	return hashWith(password, DefaultParams)
+}
+
+func hashWith(password string, p Params) (string, error) {
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+
+	return fmt.Sprintf("$%v$v=%d$m=%d,t=%d,p=%d$%v$%v",
+		AlgoArgon2id,
+		argon2.Version,
+		p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Algorithm определяет схему по сохранённому хешу; старые пароли хранились как hex(md5) без тега.
+func Algorithm(encoded string) string {
+	if strings.HasPrefix(encoded, "$"+AlgoArgon2id+"$") {
+		return AlgoArgon2id
+	}
+	return AlgoMD5
+}
+
+// Verify сравнивает пароль с сохранённым хешем. rehash == true, если хеш устарел
+// (md5 или другие параметры argon2id) и его стоит пересчитать после успешного входа.
+func Verify(encoded string, password string) (ok bool, rehash bool, err error) {
+	switch Algorithm(encoded) {
+	case AlgoArgon2id:
+		p, salt, key, err := decode(encoded)
+		if err != nil {
+			return false, false, err
+		}
+
+		other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return false, false, nil
+		}
+
+		return true, p != DefaultParams, nil
+
+	default:
+		sum := md5.Sum([]byte(password))
+		other := hex.EncodeToString(sum[:])
+
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(encoded)), []byte(other)) != 1 {
+			return false, false, nil
+		}
+
+		return true, true, nil
+	}
+}
+
+func decode(encoded string) (Params, []byte, []byte, error) {
+	var p Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, &MalformedHashError{Message: "wrong number of sections"}
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, &MalformedHashError{Message: err.Error()}
+	}
+
+	if version != argon2.Version {
+		return p, nil, nil, &MalformedHashError{Message: "unsupported argon2 version"}
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, &MalformedHashError{Message: err.Error()}
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, &MalformedHashError{Message: err.Error()}
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, &MalformedHashError{Message: err.Error()}
+	}
+
+	if len(salt) == 0 || len(key) == 0 || p.Time == 0 || p.Threads == 0 {
+		return p, nil, nil, &MalformedHashError{Message: "empty parameters"}
+	}
+
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+
+	return p, salt, key, nil
+}
@@ -0,0 +1,71 @@
+package password
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestHashVerify(t *testing.T) {
+	encoded, err := Hash("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=19456,t=2,p=1$"))
+	assert.Equal(t, AlgoArgon2id, Algorithm(encoded))
+
+	ok, rehash, err := Verify(encoded, "secret")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, rehash)
+
+	ok, _, err = Verify(encoded, "wrong")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// соль у каждого хеша своя
+	other, err := Hash("secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, encoded, other)
+}
+
+func TestVerifyLegacyMD5(t *testing.T) {
+	sum := md5.Sum([]byte("test"))
+	legacy := hex.EncodeToString(sum[:])
+	assert.Equal(t, AlgoMD5, Algorithm(legacy))
+
+	ok, rehash, err := Verify(legacy, "test")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	ok, rehash, err = Verify(legacy, "wrong")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, rehash)
+}
+
+func TestVerifyOutdatedParams(t *testing.T) {
+	encoded, err := hashWith("secret", Params{Memory: 8 * 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32})
+	require.NoError(t, err)
+
+	ok, rehash, err := Verify(encoded, "secret")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	for _, encoded := range []string{
+		"$argon2id$",
+		"$argon2id$v=19$m=19456,t=2,p=1$!!!$abc",
+		"$argon2id$v=18$m=19456,t=2,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=19456,t=0,p=1$c2FsdA$a2V5",
+	} {
+		ok, _, err := Verify(encoded, "secret")
+		assert.False(t, ok, encoded)
+		var mhe *MalformedHashError
+		assert.ErrorAs(t, err, &mhe, encoded)
+	}
+}
@@ -0,0 +1,301 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/accrual"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/wpool"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	pollInterval = time.Second
+	leaseTimeout = time.Minute
+	minBackoff   = time.Second
+	maxBackoff   = 5 * time.Minute
+	// REGISTERED: accrual заказ уже знает и скоро начнёт расчёт, поэтому опрашиваем его чаще,
+	// чем заказ, о котором accrual ещё не слышал
+	maxRegisteredBackoff = 30 * time.Second
+)
+
+type JobData struct {
+	OrderID   string
+	UserToken string
+}
+
+type ArgsError struct {
+	Message string
+}
+
+type DBError struct {
+	Message string
+}
+
+func (ae *ArgsError) Error() string {
+	return fmt.Sprintf("%v", ae.Message)
+}
+
+func (dbe *DBError) Error() string {
+	return fmt.Sprintf("%v", dbe.Message)
+}
+
+// Poller держит в работе не больше заказов, чем воркеров в пуле: слот занимается при взятии
+// заказа из очереди и освобождается, когда результат записан.
+type Poller struct {
+	repo     repository.Repositorier
+	wp       wpool.WorkerPooler
+	client   accrual.Clienter
+	slots    chan struct{}
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+func New(repo repository.Repositorier, wp wpool.WorkerPooler, client accrual.Clienter, workersCount int) *Poller {
+	if workersCount < 1 {
+		workersCount = 1
+	}
+
+	return &Poller{
+		repo:     repo,
+		wp:       wp,
+		client:   client,
+		slots:    make(chan struct{}, workersCount),
+		inFlight: make(map[string]bool),
+	}
+}
+
+// Run поднимает незавершённые заказы после рестарта и опрашивает accrual, пока не отменён ctx.
+func (p *Poller) Run(ctx context.Context) {
+
+	recovered, err := p.repo.RecoverOrders(ctx)
+	if err != nil {
+		log.Printf("unable to recover accrual queue: %v", err)
+	} else if recovered > 0 {
+		log.Printf("recovered %v orders into accrual queue", recovered)
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		p.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll ждёт хотя бы один свободный слот и берёт из очереди столько заказов, сколько слотов свободно.
+// Пока воркеры заняты (или клиент accrual стоит на паузе после 429), новые заказы не берутся,
+// и их аренда не истекает впустую.
+func (p *Poller) poll(ctx context.Context) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+
+	free := 1
+	for free < cap(p.slots) && p.tryAcquire() {
+		free++
+	}
+
+	orders, err := p.repo.ClaimOrders(ctx, free, leaseTimeout)
+
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("unable to claim orders: %v", err)
+		}
+		p.release(free)
+		return
+	}
+
+	p.release(free - len(orders))
+
+	for _, order := range orders {
+		if !p.start(order.OrderID) {
+			// аренда прошлой попытки истекла, а она ещё выполняется: её результат уже не запишется,
+			// заказ вернётся в очередь после новой аренды
+			p.release(1)
+			continue
+		}
+
+		go p.process(ctx, order)
+	}
+}
+
+func (p *Poller) start(orderID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inFlight[orderID] {
+		return false
+	}
+
+	p.inFlight[orderID] = true
+	return true
+}
+
+func (p *Poller) finish(orderID string) {
+	p.mu.Lock()
+	delete(p.inFlight, orderID)
+	p.mu.Unlock()
+
+	p.release(1)
+}
+
+func (p *Poller) tryAcquire() bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Poller) release(n int) {
+	for i := 0; i < n; i++ {
+		<-p.slots
+	}
+}
+
+func (p *Poller) process(ctx context.Context, order repository.QueuedOrder) {
+	defer p.finish(order.OrderID)
+
+	r := <-p.wp.Submit(ctx, p.newJob(order))
+	p.handle(ctx, order, r)
+}
+
+func (p *Poller) newJob(order repository.QueuedOrder) wpool.Job {
+	execFn := func(ctx context.Context, args interface{}) (interface{}, error) {
+		argVal, ok := args.(JobData)
+
+		if !ok {
+			return nil, &ArgsError{
+				Message: "Bad arguments",
+			}
+		}
+
+		return CheckOrder(ctx, p.repo, p.client, argVal.OrderID, argVal.UserToken)
+	}
+
+	return wpool.Job{
+		Descriptor: wpool.JobDescriptor{
+			ID:       wpool.JobID(fmt.Sprintf("%v_%v", order.OrderID, order.Attempts)),
+			JType:    "PROCESSING",
+			Metadata: nil,
+		},
+		ExecFn: execFn,
+		Args: JobData{
+			OrderID:   order.OrderID,
+			UserToken: order.UserToken,
+		},
+	}
+}
+
+func (p *Poller) handle(ctx context.Context, order repository.QueuedOrder, r wpool.Result) {
+	orderID := order.OrderID
+
+	var err error
+
+	if r.Err != nil {
+		var tmr *accrual.TooManyRequestsError
+
+		if errors.As(r.Err, &tmr) {
+			err = p.repo.RescheduleOrder(ctx, orderID, order.Attempts, "", tmr.RetryAfter)
+		} else {
+			err = p.repo.RescheduleOrder(ctx, orderID, order.Attempts, "", backoff(order.Attempts))
+		}
+	} else {
+		val := r.Value.(accrual.OrderStatus)
+
+		// заказ, который accrual уже видел, пропал из его ответов — стоит разобраться
+		if val.Status == accrual.StatusUnregistered && (order.AccrualStatus == accrual.StatusRegistered || order.AccrualStatus == accrual.StatusProcessing) {
+			log.Printf("accrual no longer knows order %v, last status %v", orderID, order.AccrualStatus)
+		}
+
+		switch val.Status {
+		case accrual.StatusProcessed, accrual.StatusInvalid:
+			err = p.repo.DequeueOrder(ctx, orderID, order.Attempts)
+		default:
+			err = p.repo.RescheduleOrder(ctx, orderID, order.Attempts, val.Status, retryDelay(val.Status, order.Attempts))
+		}
+	}
+
+	// заказ уже взят заново: решать его судьбу теперь новой попытке
+	var lle *repository.LeaseLostError
+	if errors.As(err, &lle) {
+		log.Printf("accrual queue: %v", err)
+		return
+	}
+
+	// если записать не удалось, заказ вернётся в работу по истечении lease
+	if err != nil {
+		log.Printf("unable to update accrual queue for order %v: %v", orderID, err)
+	}
+}
+
+// retryDelay — когда снова спросить accrual о ещё не рассчитанном заказе: PROCESSING — на следующем
+// опросе, REGISTERED — с отступом не больше maxRegisteredBackoff, неизвестный accrual — всё реже, до maxBackoff.
+func retryDelay(accrualStatus string, attempts int) time.Duration {
+	switch accrualStatus {
+	case accrual.StatusProcessing:
+		return pollInterval
+	case accrual.StatusRegistered:
+		if delay := backoff(attempts); delay < maxRegisteredBackoff {
+			return delay
+		}
+		return maxRegisteredBackoff
+	default:
+		return backoff(attempts)
+	}
+}
+
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+
+	return delay
+}
+
+func CheckOrder(ctx context.Context, repo repository.Repositorier, client accrual.Clienter, orderID string, userToken string) (interface{}, error) {
+
+	status, err := client.GetOrder(ctx, orderID)
+
+	var nce *accrual.NoContentError
+	if errors.As(err, &nce) {
+		return accrual.OrderStatus{
+			Order:  orderID,
+			Status: accrual.StatusUnregistered,
+		}, nil
+	}
+
+	if err != nil {
+		log.Printf("accrual error on order %v: %v\n", orderID, err)
+		return nil, err
+	}
+
+	log.Printf("Accrual correct response %v\n", orderID)
+	err = repo.UpdateOrder(ctx, orderID, status.Status, status.Accrual)
+	if err != nil {
+		log.Printf("DB error %v\n", err)
+		return nil, &DBError{
+			Message: "DB error on order " + orderID,
+		}
+	}
+
+	return status, nil
+}
@@ -0,0 +1,133 @@
+package poller
+
+import (
+	"context"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/accrual"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository/memory"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository/repositorytest"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/wpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+const workers = 2
+
+// countingRepo считает, сколько заказов poller взял из очереди
+type countingRepo struct {
+	*memory.Repo
+	mu      sync.Mutex
+	claimed int
+}
+
+func (r *countingRepo) ClaimOrders(ctx context.Context, limit int, lease time.Duration) ([]repository.QueuedOrder, error) {
+	orders, err := r.Repo.ClaimOrders(ctx, limit, lease)
+
+	r.mu.Lock()
+	r.claimed += len(orders)
+	r.mu.Unlock()
+
+	return orders, err
+}
+
+func (r *countingRepo) claims() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.claimed
+}
+
+// blockingClient отвечает PROCESSED, но только после закрытия release
+type blockingClient struct {
+	release chan struct{}
+	mu      sync.Mutex
+	active  int
+	max     int
+	calls   map[string]int
+}
+
+func (c *blockingClient) GetOrder(ctx context.Context, number string) (accrual.OrderStatus, error) {
+	c.mu.Lock()
+	c.active++
+	if c.active > c.max {
+		c.max = c.active
+	}
+	c.calls[number]++
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.active--
+		c.mu.Unlock()
+	}()
+
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return accrual.OrderStatus{}, ctx.Err()
+	}
+
+	return accrual.OrderStatus{Order: number, Status: accrual.StatusProcessed, Accrual: money.FromInt(10)}, nil
+}
+
+func TestPoller_ClaimsOnlyFreeWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repo := &countingRepo{Repo: memory.New()}
+	token := repositorytest.User(t, repo)
+
+	var orders []string
+	for i := 0; i < 3*workers; i++ {
+		order := repositorytest.Order(i)
+		require.NoError(t, repo.CreateOrder(ctx, order, token))
+		orders = append(orders, order)
+	}
+
+	client := &blockingClient{release: make(chan struct{}), calls: make(map[string]int)}
+
+	wp := wpool.New(workers)
+	go wp.Run(ctx)
+	go New(repo, wp, client, workers).Run(ctx)
+
+	// пока воркеры заняты, несколько тиков подряд ничего нового не берётся
+	time.Sleep(2*pollInterval + pollInterval/2)
+	assert.Equal(t, workers, repo.claims())
+
+	close(client.release)
+
+	require.Eventually(t, func() bool {
+		balance, err := repo.GetBalance(ctx, token)
+		return err == nil && balance.Current == money.FromInt(int64(10*len(orders)))
+	}, 10*pollInterval, 50*time.Millisecond)
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	assert.LessOrEqual(t, client.max, workers)
+	for _, order := range orders {
+		assert.Equal(t, 1, client.calls[order], order)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		status   string
+		attempts int
+		delay    time.Duration
+	}{
+		{status: accrual.StatusProcessing, attempts: 10, delay: pollInterval},
+		{status: accrual.StatusRegistered, attempts: 1, delay: minBackoff},
+		{status: accrual.StatusRegistered, attempts: 3, delay: 4 * time.Second},
+		{status: accrual.StatusRegistered, attempts: 20, delay: maxRegisteredBackoff},
+		{status: accrual.StatusUnregistered, attempts: 1, delay: minBackoff},
+		{status: accrual.StatusUnregistered, attempts: 20, delay: maxBackoff},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.delay, retryDelay(tt.status, tt.attempts), "%v after %v attempts", tt.status, tt.attempts)
+	}
+}
@@ -0,0 +1,66 @@
+// Package reconcile периодически сверяет users.balance/withdrawn с транзакциями.
+package reconcile
+
+import (
+	"context"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"log"
+	"time"
+)
+
+type Reconciler struct {
+	repo     repository.Repositorier
+	interval time.Duration
+	repair   bool
+}
+
+// New — сверка раз в interval; repair — исправлять найденные расхождения, а не только сообщать о них.
+func New(repo repository.Repositorier, interval time.Duration, repair bool) *Reconciler {
+	return &Reconciler{
+		repo:     repo,
+		interval: interval,
+		repair:   repair,
+	}
+}
+
+// Once выполняет одну сверку и пишет расхождения в лог.
+func (rc *Reconciler) Once(ctx context.Context) ([]repository.BalanceMismatch, error) {
+	mismatches, err := rc.repo.Reconcile(ctx, rc.repair)
+	if err != nil {
+		return mismatches, err
+	}
+
+	for _, m := range mismatches {
+		action := "found"
+		if m.Repaired {
+			action = "repaired"
+		}
+		log.Printf("balance mismatch %v for %v: balance %v, ledger %v; withdrawn %v, ledger %v",
+			action, m.UserToken, m.Balance, m.LedgerBalance, m.Withdrawn, m.LedgerWithdrawn)
+	}
+
+	return mismatches, nil
+}
+
+// Run сверяет балансы сразу при запуске и затем раз в interval, пока не отменён ctx.
+// Нулевой interval выключает сверку.
+func (rc *Reconciler) Run(ctx context.Context) {
+	if rc.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := rc.Once(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("unable to reconcile balances: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
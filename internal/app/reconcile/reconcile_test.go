@@ -0,0 +1,50 @@
+package reconcile
+
+import (
+	"context"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository/memory"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// notifyingRepo сообщает о каждой сверке
+type notifyingRepo struct {
+	repository.Repositorier
+	reconciled chan struct{}
+}
+
+func (r *notifyingRepo) Reconcile(ctx context.Context, repair bool) ([]repository.BalanceMismatch, error) {
+	r.reconciled <- struct{}{}
+	return r.Repositorier.Reconcile(ctx, repair)
+}
+
+func TestReconciler_RunsOnStart(t *testing.T) {
+	repo := &notifyingRepo{Repositorier: memory.New(), reconciled: make(chan struct{}, 1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	// интервал заведомо длиннее теста: сверка должна пройти, не дожидаясь первого тика
+	go func() {
+		New(repo, time.Hour, false).Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-repo.reconciled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconcile did not run on start")
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop after cancel")
+	}
+
+	assert.Empty(t, repo.reconciled)
+}
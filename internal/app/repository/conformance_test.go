@@ -0,0 +1,28 @@
+package repository_test
+
+import (
+	"context"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository/repositorytest"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	dataBaseURL := os.Getenv("DATABASE_URI")
+	if dataBaseURL == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+
+	repo, err := repository.New(dataBaseURL)
+	require.NoError(t, err)
+	defer repo.Close()
+
+	repositorytest.Run(t, func(t *testing.T) repository.Repositorier {
+		return repo
+	}, func(t *testing.T, r repository.Repositorier, userToken string, balance money.Amount, withdrawn money.Amount) {
+		require.NoError(t, repository.SetBalance(context.Background(), r.(*repository.Repo), userToken, balance, withdrawn))
+	})
+}
@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"context"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"time"
+)
+
+// LedgerEntry — проведённая транзакция пользователя, из которых восстанавливаются остатки партий.
+type LedgerEntry struct {
+	ID          int64
+	Type        int
+	OrderID     string
+	Points      money.Amount
+	ProcessedAt time.Time
+}
+
+// ExpiredLot — сгоревший остаток партии: начисления за заказ OrderID.
+type ExpiredLot struct {
+	UserToken string
+	OrderID   string
+	Points    money.Amount
+}
+
+// ExpiringLots проигрывает историю пользователя в порядке проведения и возвращает партии,
+// проведённые раньше processedBefore и ещё не сгоревшие, с их остатками. Списания расходуют
+// партии по FIFO, самые старые первыми; сгорание закрывает партию целиком. Остаток может быть
+// нулевым — такую партию всё равно нужно закрыть, чтобы она больше не попадала в выборку.
+func ExpiringLots(entries []LedgerEntry, processedBefore time.Time) []ExpiredLot {
+	type lot struct {
+		orderID     string
+		remaining   money.Amount
+		processedAt time.Time
+		closed      bool
+	}
+
+	var lots []*lot
+	byOrder := make(map[string]*lot)
+
+	for _, e := range entries {
+		switch e.Type {
+		case TypeAccrual:
+			if e.Points <= 0 {
+				continue
+			}
+			l := &lot{orderID: e.OrderID, remaining: e.Points, processedAt: e.ProcessedAt}
+			lots = append(lots, l)
+			byOrder[e.OrderID] = l
+
+		case TypeWithdraw:
+			left := e.Points
+			for _, l := range lots {
+				if left == 0 {
+					break
+				}
+				if l.closed || l.remaining == 0 {
+					continue
+				}
+
+				taken := l.remaining
+				if taken > left {
+					taken = left
+				}
+				l.remaining -= taken
+				left -= taken
+			}
+
+		case TypeExpiration:
+			if l, ok := byOrder[e.OrderID]; ok {
+				l.closed = true
+				l.remaining = 0
+			}
+		}
+	}
+
+	var expiring []ExpiredLot
+
+	for _, l := range lots {
+		if !l.closed && l.processedAt.Before(processedBefore) {
+			expiring = append(expiring, ExpiredLot{OrderID: l.orderID, Points: l.remaining})
+		}
+	}
+
+	return expiring
+}
+
+// UsersWithExpiringPoints возвращает до limit пользователей с токеном больше after, у которых
+// есть партии, проведённые раньше processedBefore и ещё не закрытые сгоранием. Пользователи
+// упорядочены по токену, так что пропущенные ExpirePoints не мешают дойти до остальных.
+func (r *Repo) UsersWithExpiringPoints(ctx context.Context, processedBefore time.Time, after string, limit int) ([]string, error) {
+
+	var tokens []string
+
+	rows, err := r.pool.Query(ctx, `SELECT DISTINCT a.user_token FROM transactions a
+		WHERE a.type = $1 AND a.status = $2 AND a.points > 0 AND a.processed_at < $3
+			AND NOT EXISTS (SELECT 1 FROM transactions e WHERE e.order_id = a.order_id AND e.type = $4)
+			AND a.user_token > $5
+		ORDER BY a.user_token
+		LIMIT $6`, TypeAccrual, StatusProcessed, processedBefore, TypeExpiration, after, limit)
+	if err != nil {
+		return tokens, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token string
+		if err = rows.Scan(&token); err != nil {
+			return tokens, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// ExpirePoints сжигает остатки партий пользователя, проведённых раньше processedBefore:
+// записывает по транзакции сгорания на партию и уменьшает баланс. Строка пользователя
+// блокируется, как при начислении и списании, поэтому остатки считаются по согласованной истории.
+// Возвращает партии с ненулевым сгоревшим остатком. Если баланс меньше сгорающего остатка,
+// ничего не меняется: это расхождение пишется в лог и остаётся сверке.
+func (r *Repo) ExpirePoints(ctx context.Context, userToken string, processedBefore time.Time) ([]ExpiredLot, error) {
+
+	var expired []ExpiredLot
+
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return expired, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, "SELECT 1 FROM users WHERE user_token = $1 FOR UPDATE", userToken); err != nil {
+		return expired, err
+	}
+
+	rows, err := tx.Query(ctx, "SELECT id, type, order_id, points, processed_at FROM transactions WHERE user_token = $1 AND status = $2 AND type IN ($3, $4, $5) ORDER BY processed_at, id",
+		userToken, StatusProcessed, TypeAccrual, TypeWithdraw, TypeExpiration)
+	if err != nil {
+		return expired, err
+	}
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		if err = rows.Scan(&e.ID, &e.Type, &e.OrderID, &e.Points, &e.ProcessedAt); err != nil {
+			rows.Close()
+			return expired, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return expired, err
+	}
+
+	now := time.Now()
+	var total money.Amount
+
+	for _, lot := range ExpiringLots(entries, processedBefore) {
+		res, err := tx.Exec(ctx, stmtInsertExpiration, userToken, lot.OrderID, TypeExpiration, StatusProcessed, lot.Points, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.RowsAffected() == 1 && lot.Points > 0 {
+			lot.UserToken = userToken
+			expired = append(expired, lot)
+			total += lot.Points
+		}
+	}
+
+	if total > 0 {
+		res, err := tx.Exec(ctx, stmtExpireBalance, total, userToken)
+		if err != nil {
+			return nil, err
+		}
+
+		// баланс меньше, чем должно сгореть: сжигать нечего честно, оставляем пользователя сверке
+		if res.RowsAffected() == 0 {
+			log.Printf("balance of %v is lower than %v expiring points, skipping expiration until reconciled", userToken, total)
+			return nil, nil
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return expired, nil
+}
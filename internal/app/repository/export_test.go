@@ -0,0 +1,13 @@
+package repository
+
+import (
+	"context"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+)
+
+// SetBalance переписывает баланс пользователя в обход репозитория, чтобы общий набор проверок
+// мог испортить данные Postgres так же, как данные хранилища в памяти.
+func SetBalance(ctx context.Context, r *Repo, userToken string, balance money.Amount, withdrawn money.Amount) error {
+	_, err := r.pool.Exec(ctx, "UPDATE users SET balance = $1, withdrawn = $2 WHERE user_token = $3", balance, withdrawn, userToken)
+	return err
+}
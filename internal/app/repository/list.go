@@ -0,0 +1,160 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MaxListLimit = 1000
+
+// ListOptions — страница списка заказов или списаний. Пустые поля ничего не ограничивают,
+// нулевой Limit — весь список, как до появления пагинации.
+type ListOptions struct {
+	Limit    int
+	After    *Cursor
+	Statuses []int
+	From     time.Time
+	To       time.Time
+	Desc     bool
+}
+
+// Cursor указывает на последнюю строку предыдущей страницы: время сортировки и id.
+// Он помнит направление сортировки и отпечаток фильтров своей выборки, чтобы его нельзя было
+// применить к другой. Клиенту он отдаётся непрозрачной строкой.
+type Cursor struct {
+	At     time.Time
+	ID     int64
+	Desc   bool
+	Filter string
+}
+
+type CursorError struct {
+	Message string
+}
+
+func (ce *CursorError) Error() string {
+	return fmt.Sprintf("%v", ce.Message)
+}
+
+func (c Cursor) String() string {
+	direction := "a"
+	if c.Desc {
+		direction = "d"
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d.%v.%v", c.At.UnixNano()/1e3, c.ID, direction, c.Filter)))
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &CursorError{Message: "cursor is malformed"}
+	}
+
+	parts := strings.Split(string(raw), ".")
+	if len(parts) != 4 {
+		return nil, &CursorError{Message: "cursor is malformed"}
+	}
+
+	micros, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, &CursorError{Message: "cursor is malformed"}
+	}
+
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || id <= 0 {
+		return nil, &CursorError{Message: "cursor is malformed"}
+	}
+
+	if parts[2] != "a" && parts[2] != "d" {
+		return nil, &CursorError{Message: "cursor is malformed"}
+	}
+
+	return &Cursor{At: time.Unix(0, micros*1e3), ID: id, Desc: parts[2] == "d", Filter: parts[3]}, nil
+}
+
+// FilterHash — отпечаток фильтров выборки; размер страницы в него не входит, его можно менять между страницами.
+func (o ListOptions) FilterHash() string {
+	statuses := append([]int(nil), o.Statuses...)
+	sort.Ints(statuses)
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v|%v|%v", statuses, o.From.UTC().Format(time.RFC3339Nano), o.To.UTC().Format(time.RFC3339Nano))))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// Next — курсор на строку (at, id) для следующей страницы этой выборки.
+func (o ListOptions) Next(at time.Time, id int64) *Cursor {
+	return &Cursor{At: at, ID: id, Desc: o.Desc, Filter: o.FilterHash()}
+}
+
+// CheckCursor проверяет, что After выдан для той же сортировки и тех же фильтров.
+func (o ListOptions) CheckCursor() error {
+	if o.After == nil {
+		return nil
+	}
+
+	if o.After.Desc != o.Desc {
+		return &CursorError{Message: "cursor was issued for another sort order"}
+	}
+
+	if o.After.Filter != o.FilterHash() {
+		return &CursorError{Message: "cursor was issued for other filters"}
+	}
+
+	return nil
+}
+
+// StatusCode — обратное к StatusName: NEW, PROCESSING, INVALID, PROCESSED.
+func StatusCode(name string) (int, bool) {
+	for status, statusName := range getStatusMap() {
+		if statusName == name {
+			return status, true
+		}
+	}
+	return 0, false
+}
+
+// listQuery дописывает к запросу фильтры, условие курсора, сортировку и LIMIT.
+// Строк запрашивается на одну больше страницы: по лишней видно, что есть следующая.
+func listQuery(query string, timeColumn string, args []interface{}, opts ListOptions) (string, []interface{}) {
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if len(opts.Statuses) > 0 {
+		query += " AND status = ANY(" + arg(opts.Statuses) + "::integer[])"
+	}
+
+	if !opts.From.IsZero() {
+		query += fmt.Sprintf(" AND %v >= %v", timeColumn, arg(opts.From))
+	}
+
+	if !opts.To.IsZero() {
+		query += fmt.Sprintf(" AND %v < %v", timeColumn, arg(opts.To))
+	}
+
+	direction, compare := "ASC", ">"
+	if opts.Desc {
+		direction, compare = "DESC", "<"
+	}
+
+	if opts.After != nil {
+		query += fmt.Sprintf(" AND (%v, id) %v (%v, %v)", timeColumn, compare, arg(opts.After.At), arg(opts.After.ID))
+	}
+
+	query += fmt.Sprintf(" ORDER BY %v %v, id %v", timeColumn, direction, direction)
+
+	if opts.Limit > 0 {
+		query += " LIMIT " + arg(opts.Limit+1)
+	}
+
+	return query, args
+}
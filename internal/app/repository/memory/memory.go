@@ -0,0 +1,952 @@
+// Package memory — хранилище в памяти процесса с той же семантикой, что и Postgres:
+// для тестов без БД и локального запуска. Данные пропадают при перезапуске.
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/golang-module/carbon/v2"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _ repository.Repositorier = (*Repo)(nil)
+
+type user struct {
+	id        int
+	login     string
+	password  string
+	userToken string
+	balance   money.Amount
+	withdrawn money.Amount
+}
+
+type transaction struct {
+	id             int64
+	userToken      string
+	orderID        string
+	kind           int
+	status         int
+	points         money.Amount
+	uploadedAt     time.Time
+	processedAt    time.Time
+	idempotencyKey string
+}
+
+type queued struct {
+	order         repository.QueuedOrder
+	nextAttemptAt time.Time
+	createdAt     time.Time
+}
+
+type refreshToken struct {
+	sessionID string
+	expiresAt time.Time
+	usedAt    *time.Time
+}
+
+type loginAttempt struct {
+	failures      int
+	lastFailureAt time.Time
+	lockedUntil   time.Time
+}
+
+// Repo защищён одним мьютексом: каждый метод — аналог одной транзакции в Postgres.
+type Repo struct {
+	mu            sync.Mutex
+	users         []*user
+	transactions  []*transaction
+	queue         map[string]*queued
+	sessions      map[string]*repository.Session
+	refreshTokens map[string]*refreshToken
+	loginAttempts map[string]*loginAttempt
+	now           func() time.Time
+}
+
+func New() *Repo {
+	return &Repo{
+		queue:         make(map[string]*queued),
+		sessions:      make(map[string]*repository.Session),
+		refreshTokens: make(map[string]*refreshToken),
+		loginAttempts: make(map[string]*loginAttempt),
+		now:           now,
+	}
+}
+
+// now — время с точностью timestamp в Postgres, чтобы курсоры и границы периода совпадали.
+func now() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
+
+func (r *Repo) Close() {}
+
+func (r *Repo) userByLogin(login string) *user {
+	for _, u := range r.users {
+		if u.login == login {
+			return u
+		}
+	}
+	return nil
+}
+
+func (r *Repo) userByToken(userToken string) *user {
+	for _, u := range r.users {
+		if u.userToken != "" && u.userToken == userToken {
+			return u
+		}
+	}
+	return nil
+}
+
+func (r *Repo) SaveUser(ctx context.Context, login string, password string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.userByLogin(login) != nil {
+		return 0, &repository.ConflictError{
+			Err: fmt.Errorf("login %v already exists", login),
+		}
+	}
+
+	u := &user{
+		id:       len(r.users) + 1,
+		login:    login,
+		password: password,
+	}
+	r.users = append(r.users, u)
+
+	return u.id, nil
+}
+
+func (r *Repo) SaveUserToken(ctx context.Context, id int, userToken string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if other := r.userByToken(userToken); other != nil && other.id != id {
+		return "", &repository.ConflictError{
+			Err: fmt.Errorf("user token already exists"),
+		}
+	}
+
+	for _, u := range r.users {
+		if u.id == id {
+			u.userToken = userToken
+		}
+	}
+
+	return userToken, nil
+}
+
+func (r *Repo) FindUser(ctx context.Context, login string) (*repository.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u := r.userByLogin(login)
+	if u == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return &repository.User{
+		ID:        u.id,
+		Login:     u.login,
+		Password:  u.password,
+		UserToken: u.userToken,
+	}, nil
+}
+
+func (r *Repo) UpdatePassword(ctx context.Context, id int, password string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, u := range r.users {
+		if u.id == id {
+			u.password = password
+		}
+	}
+
+	return nil
+}
+
+func (r *Repo) GetBalance(ctx context.Context, userToken string) (*repository.Balance, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u := r.userByToken(userToken)
+	if u == nil {
+		return &repository.Balance{}, sql.ErrNoRows
+	}
+
+	return &repository.Balance{
+		Current:   u.balance,
+		Withdrawn: u.withdrawn,
+	}, nil
+}
+
+// nextID выдаёт id транзакции, как serial в Postgres.
+func (r *Repo) nextID() int64 {
+	return int64(len(r.transactions)) + 1
+}
+
+// list повторяет listQuery: транзакции пользователя заданного типа с фильтрами, курсором,
+// сортировкой по (ключ, id) и лимитом.
+func (r *Repo) list(userToken string, kind int, match func(tx *transaction) bool, key func(tx *transaction) time.Time, opts repository.ListOptions) ([]*transaction, *repository.Cursor) {
+	var found []*transaction
+
+	// before — строгий порядок (ключ, id) с учётом направления сортировки
+	before := func(aAt time.Time, aID int64, bAt time.Time, bID int64) bool {
+		if opts.Desc {
+			aAt, aID, bAt, bID = bAt, bID, aAt, aID
+		}
+		if !aAt.Equal(bAt) {
+			return aAt.Before(bAt)
+		}
+		return aID < bID
+	}
+
+	for _, tx := range r.transactions {
+		if tx.userToken != userToken || tx.kind != kind || !match(tx) {
+			continue
+		}
+
+		if len(opts.Statuses) > 0 && !containsStatus(opts.Statuses, tx.status) {
+			continue
+		}
+
+		if !opts.From.IsZero() && key(tx).Before(opts.From) {
+			continue
+		}
+
+		if !opts.To.IsZero() && !key(tx).Before(opts.To) {
+			continue
+		}
+
+		if opts.After != nil && !before(opts.After.At, opts.After.ID, key(tx), tx.id) {
+			continue
+		}
+
+		found = append(found, tx)
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return before(key(found[i]), found[i].id, key(found[j]), found[j].id)
+	})
+
+	if opts.Limit == 0 || len(found) <= opts.Limit {
+		return found, nil
+	}
+
+	found = found[:opts.Limit]
+	last := found[len(found)-1]
+
+	return found, opts.Next(key(last), last.id)
+}
+
+func containsStatus(statuses []int, status int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Repo) GetWithdrawals(ctx context.Context, userToken string, opts repository.ListOptions) ([]repository.ProcessedWithdraw, *repository.Cursor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var myWithdraws []repository.ProcessedWithdraw
+
+	processed := func(tx *transaction) bool { return tx.status == repository.StatusProcessed }
+	byProcessedAt := func(tx *transaction) time.Time { return tx.processedAt }
+
+	found, next := r.list(userToken, repository.TypeWithdraw, processed, byProcessedAt, opts)
+
+	for _, tx := range found {
+		myWithdraws = append(myWithdraws, repository.ProcessedWithdraw{
+			OrderID:     tx.orderID,
+			Points:      tx.points,
+			ProcessedAt: tx.processedAt.Format(time.RFC3339Nano),
+		})
+	}
+
+	return myWithdraws, next, nil
+}
+
+func (r *Repo) GetOrders(ctx context.Context, userToken string, opts repository.ListOptions) ([]repository.Accrual, *repository.Cursor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var myAccruals []repository.Accrual
+
+	all := func(tx *transaction) bool { return true }
+	byUploadedAt := func(tx *transaction) time.Time { return tx.uploadedAt }
+
+	found, next := r.list(userToken, repository.TypeAccrual, all, byUploadedAt, opts)
+
+	for _, tx := range found {
+		item := repository.Accrual{
+			OrderID:    tx.orderID,
+			Status:     repository.StatusName(tx.status),
+			UploadedAt: carbon.Time2Carbon(tx.uploadedAt).ToRfc3339String(),
+		}
+
+		if tx.points > 0 {
+			item.Accrual = tx.points
+		}
+
+		myAccruals = append(myAccruals, item)
+	}
+
+	return myAccruals, next, nil
+}
+
+func (r *Repo) GetStatement(ctx context.Context, userToken string, from time.Time, to time.Time) ([]repository.StatementEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ledger []*transaction
+
+	for _, tx := range r.transactions {
+		if tx.userToken == userToken && tx.status == repository.StatusProcessed && tx.points > 0 {
+			ledger = append(ledger, tx)
+		}
+	}
+
+	sort.Slice(ledger, func(i, j int) bool {
+		if !ledger[i].processedAt.Equal(ledger[j].processedAt) {
+			return ledger[i].processedAt.Before(ledger[j].processedAt)
+		}
+		return ledger[i].id < ledger[j].id
+	})
+
+	var entries []repository.StatementEntry
+	var balance money.Amount
+
+	// баланс копится по всей истории, период только отбирает строки, как окно в Postgres
+	for _, tx := range ledger {
+		entry := repository.StatementEntry{
+			ProcessedAt: tx.processedAt.Format(time.RFC3339Nano),
+			OrderID:     tx.orderID,
+			Type:        repository.EntryAccrual,
+			Amount:      tx.points,
+		}
+
+		switch tx.kind {
+		case repository.TypeWithdraw:
+			entry.Type = repository.EntryWithdrawal
+			entry.Amount = -tx.points
+		case repository.TypeExpiration:
+			entry.Type = repository.EntryExpiration
+			entry.Amount = -tx.points
+		}
+
+		balance += entry.Amount
+		entry.Balance = balance
+
+		if (!from.IsZero() && tx.processedAt.Before(from)) || (!to.IsZero() && !tx.processedAt.Before(to)) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (r *Repo) SaveWithdraw(ctx context.Context, orderID string, points money.Amount, userToken string, idempotencyKey string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, tx := range r.transactions {
+		if idempotencyKey != "" && tx.userToken == userToken && tx.idempotencyKey == idempotencyKey {
+			if tx.orderID == orderID && tx.points == points {
+				return nil
+			}
+
+			return &repository.WithdrawConflictError{
+				IdempotencyKey: idempotencyKey,
+				Message:        "idempotency key was used for another withdrawal",
+			}
+		}
+	}
+
+	for _, tx := range r.transactions {
+		if tx.kind == repository.TypeWithdraw && tx.orderID == orderID {
+			if tx.userToken == userToken && tx.points == points {
+				return nil
+			}
+
+			return &repository.WithdrawConflictError{
+				OrderID: orderID,
+				Message: "order was used for another withdrawal",
+			}
+		}
+	}
+
+	u := r.userByToken(userToken)
+
+	if u == nil || u.balance < points {
+		return &repository.LowPointsError{
+			Message: "Недостаточно баллов для списания",
+		}
+	}
+
+	u.balance -= points
+	u.withdrawn += points
+
+	now := r.now()
+
+	r.transactions = append(r.transactions, &transaction{
+		id:             r.nextID(),
+		userToken:      userToken,
+		orderID:        orderID,
+		kind:           repository.TypeWithdraw,
+		status:         repository.StatusProcessed,
+		points:         points,
+		uploadedAt:     now,
+		processedAt:    now,
+		idempotencyKey: idempotencyKey,
+	})
+
+	return nil
+}
+
+func (r *Repo) accrual(orderID string) *transaction {
+	for _, tx := range r.transactions {
+		if tx.orderID == orderID && tx.kind == repository.TypeAccrual {
+			return tx
+		}
+	}
+	return nil
+}
+
+func (r *Repo) FindOrderAccrual(ctx context.Context, orderID string) (*repository.AccrualRaw, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := r.accrual(orderID)
+	if tx == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return &repository.AccrualRaw{
+		UserToken:  tx.userToken,
+		OrderID:    tx.orderID,
+		Status:     tx.status,
+		Accrual:    tx.points,
+		UploadedAt: tx.uploadedAt.Format(time.RFC3339Nano),
+	}, nil
+}
+
+func (r *Repo) CreateOrder(ctx context.Context, orderID string, userToken string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// в Postgres транзакция ссылается на пользователя внешним ключом
+	if r.userByToken(userToken) == nil {
+		return fmt.Errorf("user %v does not exist", userToken)
+	}
+
+	if tx := r.accrual(orderID); tx != nil {
+		return &repository.OrderExistsError{
+			OrderID:   orderID,
+			UserToken: tx.userToken,
+		}
+	}
+
+	now := r.now()
+
+	r.transactions = append(r.transactions, &transaction{
+		id:         r.nextID(),
+		userToken:  userToken,
+		orderID:    orderID,
+		kind:       repository.TypeAccrual,
+		status:     repository.StatusNew,
+		uploadedAt: now,
+	})
+
+	r.enqueue(orderID, userToken, now)
+
+	return nil
+}
+
+func (r *Repo) enqueue(orderID string, userToken string, now time.Time) bool {
+	if _, ok := r.queue[orderID]; ok {
+		return false
+	}
+
+	r.queue[orderID] = &queued{
+		order: repository.QueuedOrder{
+			OrderID:   orderID,
+			UserToken: userToken,
+		},
+		nextAttemptAt: now,
+		createdAt:     now,
+	}
+
+	return true
+}
+
+func (r *Repo) UpdateOrder(ctx context.Context, orderID string, status string, accrual money.Amount) error {
+	statusKey, ok := repository.AccrualStatus(status)
+
+	if !ok {
+		return &repository.UnknownStatusError{
+			Status: status,
+		}
+	}
+
+	if statusKey == repository.StatusNew {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := r.accrual(orderID)
+
+	if tx == nil || !repository.CanTransition(tx.status, statusKey) {
+		return nil
+	}
+
+	tx.status = statusKey
+	tx.points = accrual
+	tx.processedAt = time.Time{}
+
+	if statusKey == repository.StatusProcessed {
+		tx.processedAt = r.now()
+
+		if u := r.userByToken(tx.userToken); u != nil {
+			u.balance += accrual
+		}
+	}
+
+	return nil
+}
+
+func (r *Repo) RecoverOrders(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var recovered int64
+	now := r.now()
+
+	for _, tx := range r.transactions {
+		if tx.kind != repository.TypeAccrual || (tx.status != repository.StatusNew && tx.status != repository.StatusProcessing) {
+			continue
+		}
+
+		if r.enqueue(tx.orderID, tx.userToken, now) {
+			recovered++
+		}
+	}
+
+	return recovered, nil
+}
+
+func (r *Repo) ClaimOrders(ctx context.Context, limit int, lease time.Duration) ([]repository.QueuedOrder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []*queued
+	now := r.now()
+
+	for _, q := range r.queue {
+		if !q.nextAttemptAt.After(now) {
+			due = append(due, q)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].nextAttemptAt.Equal(due[j].nextAttemptAt) {
+			return due[i].createdAt.Before(due[j].createdAt)
+		}
+		return due[i].nextAttemptAt.Before(due[j].nextAttemptAt)
+	})
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	var orders []repository.QueuedOrder
+
+	for _, q := range due {
+		q.order.Attempts++
+		q.nextAttemptAt = now.Add(lease)
+		orders = append(orders, q.order)
+	}
+
+	return orders, nil
+}
+
+func (r *Repo) RescheduleOrder(ctx context.Context, orderID string, attempts int, accrualStatus string, delay time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q, ok := r.queue[orderID]
+	if !ok || q.order.Attempts != attempts {
+		return &repository.LeaseLostError{OrderID: orderID, Attempts: attempts}
+	}
+
+	q.nextAttemptAt = r.now().Add(delay)
+
+	if accrualStatus != "" {
+		q.order.AccrualStatus = accrualStatus
+	}
+
+	return nil
+}
+
+func (r *Repo) DequeueOrder(ctx context.Context, orderID string, attempts int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q, ok := r.queue[orderID]
+	if !ok || q.order.Attempts != attempts {
+		return &repository.LeaseLostError{OrderID: orderID, Attempts: attempts}
+	}
+
+	delete(r.queue, orderID)
+	return nil
+}
+
+func (r *Repo) CreateSession(ctx context.Context, id string, userToken string, expiresAt time.Time, refreshHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.userByToken(userToken) == nil {
+		return fmt.Errorf("user %v does not exist", userToken)
+	}
+
+	if _, ok := r.sessions[id]; ok {
+		return &repository.ConflictError{Err: fmt.Errorf("session %v already exists", id)}
+	}
+
+	if _, ok := r.refreshTokens[refreshHash]; ok {
+		return &repository.ConflictError{Err: fmt.Errorf("refresh token already exists")}
+	}
+
+	r.sessions[id] = &repository.Session{
+		ID:        id,
+		UserToken: userToken,
+		CreatedAt: r.now(),
+		ExpiresAt: expiresAt,
+	}
+
+	r.refreshTokens[refreshHash] = &refreshToken{
+		sessionID: id,
+		expiresAt: expiresAt,
+	}
+
+	return nil
+}
+
+func (r *Repo) FindSession(ctx context.Context, id string) (*repository.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	found := *session
+	return &found, nil
+}
+
+func (r *Repo) revoke(session *repository.Session) {
+	if session.RevokedAt == nil {
+		now := r.now()
+		session.RevokedAt = &now
+	}
+}
+
+func (r *Repo) RevokeSession(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if session, ok := r.sessions[id]; ok {
+		r.revoke(session)
+	}
+
+	return nil
+}
+
+func (r *Repo) RevokeUserSessions(ctx context.Context, userToken string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var revoked int64
+	now := r.now()
+
+	for _, session := range r.sessions {
+		if session.UserToken == userToken && session.Active(now) {
+			r.revoke(session)
+			revoked++
+		}
+	}
+
+	return revoked, nil
+}
+
+func (r *Repo) RotateRefreshToken(ctx context.Context, oldHash string, newHash string) (*repository.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token, ok := r.refreshTokens[oldHash]
+	if !ok {
+		return nil, &repository.RefreshTokenError{
+			Message: "unknown refresh token",
+		}
+	}
+
+	session := r.sessions[token.sessionID]
+
+	if token.usedAt != nil {
+		r.revoke(session)
+
+		return nil, &repository.RefreshTokenReuseError{
+			SessionID: session.ID,
+		}
+	}
+
+	now := r.now()
+
+	if !session.Active(now) {
+		return nil, &repository.RefreshTokenError{
+			Message: "session is expired or revoked",
+		}
+	}
+
+	token.usedAt = &now
+
+	r.refreshTokens[newHash] = &refreshToken{
+		sessionID: session.ID,
+		expiresAt: session.ExpiresAt,
+	}
+
+	rotated := *session
+	return &rotated, nil
+}
+
+func (r *Repo) LoginAttempts(ctx context.Context, key string) (int, time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempt, ok := r.loginAttempts[key]
+	if !ok {
+		return 0, time.Time{}, nil
+	}
+
+	return attempt.failures, attempt.lockedUntil, nil
+}
+
+func (r *Repo) AddLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempt, ok := r.loginAttempts[key]
+	if !ok {
+		attempt = &loginAttempt{}
+		r.loginAttempts[key] = attempt
+	}
+
+	if !attempt.lastFailureAt.IsZero() && attempt.lastFailureAt.Before(now.Add(-window)) {
+		attempt.failures = 0
+	}
+
+	attempt.failures++
+	attempt.lastFailureAt = now
+
+	return attempt.failures, nil
+}
+
+func (r *Repo) LockLogin(ctx context.Context, key string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempt, ok := r.loginAttempts[key]
+	if !ok {
+		attempt = &loginAttempt{}
+		r.loginAttempts[key] = attempt
+	}
+
+	if until.After(attempt.lockedUntil) {
+		attempt.lockedUntil = until
+	}
+
+	return nil
+}
+
+func (r *Repo) ResetLoginAttempts(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.loginAttempts, key)
+	return nil
+}
+
+func (r *Repo) Reconcile(ctx context.Context, repair bool) ([]repository.BalanceMismatch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var mismatches []repository.BalanceMismatch
+
+	for _, u := range r.users {
+		if u.userToken == "" {
+			continue
+		}
+
+		m := repository.BalanceMismatch{UserToken: u.userToken, Balance: u.balance, Withdrawn: u.withdrawn}
+
+		for _, tx := range r.transactions {
+			if tx.userToken != u.userToken || tx.status != repository.StatusProcessed {
+				continue
+			}
+
+			switch tx.kind {
+			case repository.TypeAccrual:
+				m.LedgerBalance += tx.points
+			case repository.TypeWithdraw:
+				m.LedgerBalance -= tx.points
+				m.LedgerWithdrawn += tx.points
+			case repository.TypeExpiration:
+				m.LedgerBalance -= tx.points
+			}
+		}
+
+		if m.Balance == m.LedgerBalance && m.Withdrawn == m.LedgerWithdrawn {
+			continue
+		}
+
+		if repair {
+			u.balance = m.LedgerBalance
+			u.withdrawn = m.LedgerWithdrawn
+			m.Repaired = true
+		}
+
+		mismatches = append(mismatches, m)
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].UserToken < mismatches[j].UserToken
+	})
+
+	return mismatches, nil
+}
+
+// ledger — проведённые транзакции пользователя в порядке проведения, как в ExpirePoints у Postgres.
+func (r *Repo) ledger(userToken string) []repository.LedgerEntry {
+	var entries []repository.LedgerEntry
+
+	for _, tx := range r.transactions {
+		if tx.userToken == userToken && tx.status == repository.StatusProcessed {
+			entries = append(entries, repository.LedgerEntry{
+				ID:          tx.id,
+				Type:        tx.kind,
+				OrderID:     tx.orderID,
+				Points:      tx.points,
+				ProcessedAt: tx.processedAt,
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].ProcessedAt.Equal(entries[j].ProcessedAt) {
+			return entries[i].ProcessedAt.Before(entries[j].ProcessedAt)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+
+	return entries
+}
+
+func (r *Repo) UsersWithExpiringPoints(ctx context.Context, processedBefore time.Time, after string, limit int) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var tokens []string
+	seen := make(map[string]bool)
+
+	for _, tx := range r.transactions {
+		if tx.kind != repository.TypeAccrual || tx.status != repository.StatusProcessed || tx.points <= 0 || !tx.processedAt.Before(processedBefore) || seen[tx.userToken] {
+			continue
+		}
+
+		if tx.userToken <= after || r.expired(tx.orderID) {
+			continue
+		}
+
+		seen[tx.userToken] = true
+		tokens = append(tokens, tx.userToken)
+	}
+
+	sort.Strings(tokens)
+
+	if len(tokens) > limit {
+		tokens = tokens[:limit]
+	}
+
+	return tokens, nil
+}
+
+func (r *Repo) expired(orderID string) bool {
+	for _, tx := range r.transactions {
+		if tx.kind == repository.TypeExpiration && tx.orderID == orderID {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Repo) ExpirePoints(ctx context.Context, userToken string, processedBefore time.Time) ([]repository.ExpiredLot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u := r.userByToken(userToken)
+	if u == nil {
+		return nil, nil
+	}
+
+	var expired []repository.ExpiredLot
+	var total money.Amount
+
+	lots := repository.ExpiringLots(r.ledger(userToken), processedBefore)
+	for _, lot := range lots {
+		total += lot.Points
+	}
+
+	// как и в Postgres: баланс меньше остатка партий — ничего не сжигаем, расхождение покажет сверка
+	if u.balance < total {
+		log.Printf("balance of %v is lower than %v expiring points, skipping expiration until reconciled", userToken, total)
+		return nil, nil
+	}
+
+	now := r.now()
+
+	for _, lot := range lots {
+		r.transactions = append(r.transactions, &transaction{
+			id:          r.nextID(),
+			userToken:   userToken,
+			orderID:     lot.OrderID,
+			kind:        repository.TypeExpiration,
+			status:      repository.StatusProcessed,
+			points:      lot.Points,
+			uploadedAt:  now,
+			processedAt: now,
+		})
+
+		if lot.Points > 0 {
+			lot.UserToken = userToken
+			expired = append(expired, lot)
+			u.balance -= lot.Points
+		}
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,21 @@
+package memory
+
+import (
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository/repositorytest"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) repository.Repositorier {
+		return New()
+	}, func(t *testing.T, repo repository.Repositorier, userToken string, balance money.Amount, withdrawn money.Amount) {
+		u := repo.(*Repo).userByToken(userToken)
+		require.NotNil(t, u)
+
+		u.balance = balance
+		u.withdrawn = withdrawn
+	})
+}
@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+// settings — то, что New собирает из опций: настройки пула и нужно ли поднимать схему.
+type settings struct {
+	pool    *pgxpool.Config
+	migrate bool
+}
+
+type Option func(s *settings)
+
+// WithoutMigrations не применяет миграции при открытии, а только проверяет, что схема актуальна:
+// для служебных команд, которые не должны менять схему без спроса.
+func WithoutMigrations() Option {
+	return func(s *settings) {
+		s.migrate = false
+	}
+}
+
+func WithMaxConns(n int32) Option {
+	return func(s *settings) {
+		if n > 0 {
+			s.pool.MaxConns = n
+		}
+	}
+}
+
+func WithMinConns(n int32) Option {
+	return func(s *settings) {
+		if n > 0 {
+			s.pool.MinConns = n
+		}
+	}
+}
+
+// WithConnLifetime закрывает соединения старше lifetime, чтобы пул переживал переключение реплик и PgBouncer.
+func WithConnLifetime(lifetime time.Duration) Option {
+	return func(s *settings) {
+		if lifetime > 0 {
+			s.pool.MaxConnLifetime = lifetime
+		}
+	}
+}
+
+func WithConnIdleTime(idle time.Duration) Option {
+	return func(s *settings) {
+		if idle > 0 {
+			s.pool.MaxConnIdleTime = idle
+		}
+	}
+}
+
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(s *settings) {
+		if timeout > 0 {
+			s.pool.ConnConfig.ConnectTimeout = timeout
+		}
+	}
+}
+
+// WithStatementTimeout ограничивает время любого запроса на стороне сервера БД.
+func WithStatementTimeout(timeout time.Duration) Option {
+	return func(s *settings) {
+		if timeout > 0 {
+			s.pool.ConnConfig.RuntimeParams["statement_timeout"] = fmt.Sprintf("%d", timeout.Milliseconds())
+		}
+	}
+}
+
+// имена подготовленных запросов: pgx выполняет их по имени вместо текста
+const (
+	stmtInsertWithdraw           = "insert_withdraw"
+	stmtInsertAccrualTransaction = "insert_accrual_transaction"
+	stmtUpdateTransaction        = "update_transaction"
+	stmtCreditBalance            = "credit_balance"
+	stmtDebitBalance             = "debit_balance"
+	stmtEnqueueOrder             = "enqueue_order"
+	stmtInsertExpiration         = "insert_expiration"
+	stmtExpireBalance            = "expire_balance"
+)
+
+func newStatements() map[string]string {
+	return map[string]string{
+		// конфликт по заказу или ключу идемпотентности не ошибка: это повтор, его разбирает replayWithdraw
+		stmtInsertWithdraw:           "INSERT INTO transactions (user_token, order_id, type, status, points, processed_at, idempotency_key) VALUES($1,$2,$3,$4,$5,$6,NULLIF($7, '')) ON CONFLICT DO NOTHING",
+		stmtInsertAccrualTransaction: "INSERT INTO transactions (user_token, order_id, type, status, points) VALUES($1,$2,$3,$4,$5) ON CONFLICT (order_id, type) WHERE type = 1 DO NOTHING",
+		stmtUpdateTransaction:        "UPDATE transactions set status = $1, points = $2, processed_at = $3 where order_id = $4 and type = $5 and status = ANY($6::integer[]) RETURNING user_token",
+		// баланс меняется относительно текущего значения в БД, а не перезаписывается посчитанным в Go
+		stmtCreditBalance: "UPDATE users set balance = balance + $1 where user_token = $2",
+		stmtDebitBalance:  "UPDATE users set balance = balance - $1, withdrawn = withdrawn + $1 where user_token = $2 and balance >= $1",
+		stmtEnqueueOrder:  "INSERT INTO accrual_queue (order_id, user_token) VALUES($1,$2) ON CONFLICT (order_id) DO NOTHING",
+		// партия сгорает один раз, повтор задания ничего не меняет
+		stmtInsertExpiration: "INSERT INTO transactions (user_token, order_id, type, status, points, processed_at) VALUES($1,$2,$3,$4,$5,$6) ON CONFLICT (order_id, type) WHERE type = 3 DO NOTHING",
+		// как и списание, не уводит баланс в минус: если он меньше остатка партий, баланс разошёлся с транзакциями
+		stmtExpireBalance: "UPDATE users set balance = balance - $1 where user_token = $2 and balance >= $1",
+	}
+}
+
+// prepare готовит запросы на каждом новом соединении пула.
+func (r *Repo) prepare(ctx context.Context, conn *pgx.Conn) error {
+	for name, sql := range r.statements {
+		if _, err := conn.Prepare(ctx, name, sql); err != nil {
+			return fmt.Errorf("prepare %v: %w", name, err)
+		}
+	}
+
+	return nil
+}
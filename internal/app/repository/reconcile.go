@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/jackc/pgx/v4"
+)
+
+// BalanceMismatch — пользователь, у которого users.balance/withdrawn разошлись с суммой
+// проведённых транзакций. Ledger* — значения, посчитанные по транзакциям.
+type BalanceMismatch struct {
+	UserToken       string
+	Balance         money.Amount
+	Withdrawn       money.Amount
+	LedgerBalance   money.Amount
+	LedgerWithdrawn money.Amount
+	Repaired        bool
+}
+
+// ledgerQuery считает для пользователей баланс (начисления минус списания и сгорания) и сумму
+// списаний по проведённым транзакциям рядом с хранимыми значениями; $1 — пустая строка
+// для всех пользователей или токен одного.
+var ledgerQuery = fmt.Sprintf(`SELECT user_token, balance, withdrawn, ledger_balance, ledger_withdrawn FROM (
+		SELECT u.user_token, u.balance, u.withdrawn,
+			COALESCE(SUM(t.points) FILTER (WHERE t.type = %[1]d), 0) - COALESCE(SUM(t.points) FILTER (WHERE t.type IN (%[2]d, %[4]d)), 0) AS ledger_balance,
+			COALESCE(SUM(t.points) FILTER (WHERE t.type = %[2]d), 0) AS ledger_withdrawn
+		FROM users u LEFT JOIN transactions t ON t.user_token = u.user_token AND t.status = %[3]d
+		WHERE u.user_token IS NOT NULL AND ($1 = '' OR u.user_token = $1)
+		GROUP BY u.user_token, u.balance, u.withdrawn
+	) ledger`, TypeAccrual, TypeWithdraw, StatusProcessed, TypeExpiration)
+
+// Reconcile пересчитывает балансы по транзакциям и возвращает расхождения. С repair каждое
+// расхождение перепроверяется под блокировкой строки пользователя и исправляется: начисления
+// и списания тоже берут эту блокировку, поэтому запись в полёте не будет затёрта.
+func (r *Repo) Reconcile(ctx context.Context, repair bool) ([]BalanceMismatch, error) {
+
+	var mismatches []BalanceMismatch
+
+	rows, err := r.pool.Query(ctx, ledgerQuery+" WHERE balance <> ledger_balance OR withdrawn <> ledger_withdrawn ORDER BY user_token", "")
+	if err != nil {
+		return mismatches, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m BalanceMismatch
+		if err = rows.Scan(&m.UserToken, &m.Balance, &m.Withdrawn, &m.LedgerBalance, &m.LedgerWithdrawn); err != nil {
+			return mismatches, err
+		}
+		mismatches = append(mismatches, m)
+	}
+
+	if err = rows.Err(); err != nil {
+		return mismatches, err
+	}
+	rows.Close()
+
+	if !repair {
+		return mismatches, nil
+	}
+
+	var repaired []BalanceMismatch
+
+	for _, m := range mismatches {
+		m, found, err := r.repairBalance(ctx, m.UserToken)
+		if err != nil {
+			return repaired, err
+		}
+
+		// расхождение было видно посреди чужой транзакции и уже исчезло
+		if found {
+			repaired = append(repaired, m)
+		}
+	}
+
+	return repaired, nil
+}
+
+func (r *Repo) repairBalance(ctx context.Context, userToken string) (BalanceMismatch, bool, error) {
+	m := BalanceMismatch{UserToken: userToken}
+
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return m, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, "SELECT 1 FROM users WHERE user_token = $1 FOR UPDATE", userToken); err != nil {
+		return m, false, err
+	}
+
+	row := tx.QueryRow(ctx, ledgerQuery, userToken)
+	if err = row.Scan(&m.UserToken, &m.Balance, &m.Withdrawn, &m.LedgerBalance, &m.LedgerWithdrawn); err != nil {
+		return m, false, notFound(err)
+	}
+
+	if m.Balance == m.LedgerBalance && m.Withdrawn == m.LedgerWithdrawn {
+		return m, false, nil
+	}
+
+	if _, err = tx.Exec(ctx, "UPDATE users SET balance = $1, withdrawn = $2 WHERE user_token = $3", m.LedgerBalance, m.LedgerWithdrawn, userToken); err != nil {
+		return m, false, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return m, false, err
+	}
+
+	m.Repaired = true
+
+	return m, true, nil
+}
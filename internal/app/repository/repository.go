@@ -3,29 +3,56 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/migrator"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/DatDomrachev/go-loyalty-system/migrations"
 	"github.com/golang-module/carbon/v2"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
-	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"log"
+	"sync/atomic"
+	"time"
 )
 
 type Repositorier interface {
 	SaveUser(ctx context.Context, login string, password string) (int, error)
 	SaveUserToken(ctx context.Context, id int, userToken string) (string, error)
-	FindUser(ctx context.Context, login string, password string) (string, error)
+	FindUser(ctx context.Context, login string) (*User, error)
+	UpdatePassword(ctx context.Context, id int, password string) error
 	GetBalance(ctx context.Context, userToken string) (*Balance, error)
-	GetWithdrawals(ctx context.Context, userToken string) ([]ProcessedWithdraw, error)
-	GetOrders(ctx context.Context, userToken string) ([]Accrual, error)
-	SaveWithdraw(ctx context.Context, orderID string, points float64, userToken string) error
+	GetWithdrawals(ctx context.Context, userToken string, opts ListOptions) ([]ProcessedWithdraw, *Cursor, error)
+	GetOrders(ctx context.Context, userToken string, opts ListOptions) ([]Accrual, *Cursor, error)
+	GetStatement(ctx context.Context, userToken string, from time.Time, to time.Time) ([]StatementEntry, error)
+	Reconcile(ctx context.Context, repair bool) ([]BalanceMismatch, error)
+	UsersWithExpiringPoints(ctx context.Context, processedBefore time.Time, after string, limit int) ([]string, error)
+	ExpirePoints(ctx context.Context, userToken string, processedBefore time.Time) ([]ExpiredLot, error)
+	SaveWithdraw(ctx context.Context, orderID string, points money.Amount, userToken string, idempotencyKey string) error
 	CreateOrder(ctx context.Context, orderID string, userToken string) error
-	UpdateOrder(ctx context.Context, orderID string, status string, accrual float64, userToken string) error
+	UpdateOrder(ctx context.Context, orderID string, status string, accrual money.Amount) error
 	FindOrderAccrual(ctx context.Context, orderID string) (*AccrualRaw, error)
+	RecoverOrders(ctx context.Context) (int64, error)
+	ClaimOrders(ctx context.Context, limit int, lease time.Duration) ([]QueuedOrder, error)
+	RescheduleOrder(ctx context.Context, orderID string, attempts int, accrualStatus string, delay time.Duration) error
+	DequeueOrder(ctx context.Context, orderID string, attempts int) error
+	CreateSession(ctx context.Context, id string, userToken string, expiresAt time.Time, refreshHash string) error
+	FindSession(ctx context.Context, id string) (*Session, error)
+	RevokeSession(ctx context.Context, id string) error
+	RevokeUserSessions(ctx context.Context, userToken string) (int64, error)
+	RotateRefreshToken(ctx context.Context, oldHash string, newHash string) (*Session, error)
+	LoginAttempts(ctx context.Context, key string) (int, time.Time, error)
+	AddLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (int, error)
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	ResetLoginAttempts(ctx context.Context, key string) error
+	Close()
 }
 
 const TypeAccrual = 1
 const TypeWithdraw = 2
+const TypeExpiration = 3
 
 const StatusNew = 1
 const StatusProcessing = 2
@@ -37,50 +64,72 @@ type LoginData struct {
 	Password string `json:"password"`
 }
 
+type User struct {
+	ID        int
+	Login     string
+	Password  string
+	UserToken string
+}
+
 type AccrualRaw struct {
-	UserToken  string  `json:"token"`
-	OrderID    string  `json:"number"`
-	Status     int     `json:"status"`
-	Accrual    float64 `json:"accrual"`
-	UploadedAt string  `json:"uploaded_at"`
+	UserToken  string       `json:"token"`
+	OrderID    string       `json:"number"`
+	Status     int          `json:"status"`
+	Accrual    money.Amount `json:"accrual"`
+	UploadedAt string       `json:"uploaded_at"`
 }
 
 type Accrual struct {
-	OrderID    string  `json:"number"`
-	Status     string  `json:"status"`
-	Accrual    float64 `json:"accrual,omitempty"`
-	UploadedAt string  `json:"uploaded_at"`
+	OrderID    string       `json:"number"`
+	Status     string       `json:"status"`
+	Accrual    money.Amount `json:"accrual,omitempty"`
+	UploadedAt string       `json:"uploaded_at"`
 }
 
 type Balance struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   money.Amount `json:"current"`
+	Withdrawn money.Amount `json:"withdrawn"`
 }
 
 type Withdraw struct {
-	OrderID string  `json:"order"`
-	Points  float64 `json:"sum"`
+	OrderID string       `json:"order"`
+	Points  money.Amount `json:"sum"`
 }
 
 type ProcessedWithdraw struct {
-	OrderID     string  `json:"order"`
-	Points      float64 `json:"sum"`
-	ProcessedAt string  `json:"processed_at"`
+	OrderID     string       `json:"order"`
+	Points      money.Amount `json:"sum"`
+	ProcessedAt string       `json:"processed_at"`
 }
 
-type ProcessingOrder struct {
-	OrderID string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual" default:"0.0"`
+type QueuedOrder struct {
+	OrderID       string
+	UserToken     string
+	Attempts      int
+	AccrualStatus string
 }
 
-type DataBase struct {
-	conn *sql.DB
+type Session struct {
+	ID        string
+	UserToken string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt *time.Time
 }
 
+// Active — сессия не отозвана и не истекла к моменту now.
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// Repo держит свой пул и свой набор подготовленных запросов, поэтому несколько экземпляров
+// (например, в тестах) друг другу не мешают.
 type Repo struct {
-	StoragePath string
-	DB          *DataBase
+	// loginFailures считает вызовы AddLoginFailure, чтобы раз в loginSweepEvery чистить login_attempts;
+	// первым полем, чтобы atomic работал и на 32-битных платформах
+	loginFailures uint64
+	pool          *pgxpool.Pool
+	statements    map[string]string
 }
 
 type ConflictError struct {
@@ -95,10 +144,69 @@ type LowPointsError struct {
 	Message string
 }
 
+// WithdrawConflictError — номер заказа или ключ идемпотентности уже заняты другим списанием.
+// IdempotencyKey заполнен, если конфликт по ключу.
+type WithdrawConflictError struct {
+	OrderID        string
+	IdempotencyKey string
+	Message        string
+}
+
+func (wce *WithdrawConflictError) Error() string {
+	return fmt.Sprintf("%v", wce.Message)
+}
+
+// LeaseLostError — заказ уже не принадлежит обработчику: он убран из очереди или взят заново
+// после истечения аренды.
+type LeaseLostError struct {
+	OrderID  string
+	Attempts int
+}
+
+func (lle *LeaseLostError) Error() string {
+	return fmt.Sprintf("lease on order %v (attempt %v) is lost", lle.OrderID, lle.Attempts)
+}
+
+// OrderExistsError — заказ уже загружен; UserToken — его владелец.
+type OrderExistsError struct {
+	OrderID   string
+	UserToken string
+}
+
+func (oee *OrderExistsError) Error() string {
+	return fmt.Sprintf("order %v already exists", oee.OrderID)
+}
+
 type QueryResult struct {
 	Message string
 }
 
+type RefreshTokenError struct {
+	Message string
+}
+
+// RefreshTokenReuseError — предъявлен уже использованный refresh-токен: скорее всего, его украли,
+// поэтому сессия отозвана целиком.
+type RefreshTokenReuseError struct {
+	SessionID string
+}
+
+func (rte *RefreshTokenError) Error() string {
+	return fmt.Sprintf("%v", rte.Message)
+}
+
+func (rtre *RefreshTokenReuseError) Error() string {
+	return fmt.Sprintf("refresh token reused, session %v revoked", rtre.SessionID)
+}
+
+type UnknownStatusError struct {
+	Status string
+}
+
+func (use *UnknownStatusError) Error() string {
+	return fmt.Sprintf("unknown accrual status %v", use.Status)
+}
+
 func (lpe *LowPointsError) Error() string {
 	return fmt.Sprintf("%v", lpe.Message)
 }
@@ -111,10 +219,34 @@ func (dbe *DBError) Error() string {
 	return fmt.Sprintf("%v", dbe.Message)
 }
 
-var insertTransaction *sql.Stmt
-var insertAccrualTransaction *sql.Stmt
-var updateTransaction *sql.Stmt
-var updateBalance *sql.Stmt
+// PendingMigrationsError — схема отстаёт от кода, а применять миграции New не просили.
+type PendingMigrationsError struct {
+	Count int
+	Next  int64
+}
+
+func (pme *PendingMigrationsError) Error() string {
+	return fmt.Sprintf("%v migrations are pending starting with %v, run gophermart migrate up", pme.Count, pme.Next)
+}
+
+// getStatusTransitions: для каждого статуса — из каких статусов в него можно перейти.
+// NEW -> PROCESSING -> PROCESSED/INVALID, accrual может и сразу вернуть окончательный статус.
+func getStatusTransitions() map[int][]int {
+	return map[int][]int{
+		StatusProcessing: {StatusNew},
+		StatusInvalid:    {StatusNew, StatusProcessing},
+		StatusProcessed:  {StatusNew, StatusProcessing},
+	}
+}
+
+func CanTransition(from int, to int) bool {
+	for _, allowed := range getStatusTransitions()[to] {
+		if allowed == from {
+			return true
+		}
+	}
+	return false
+}
 
 func getStatusMap() map[int]string {
 	return map[int]string{
@@ -125,100 +257,116 @@ func getStatusMap() map[int]string {
 	}
 }
 
-func firstKeyByValue(m map[int]string, value string) int {
-	for k, v := range m {
-		if value == v {
-			return k
-		}
+func StatusName(status int) string {
+	return getStatusMap()[status]
+}
+
+// AccrualStatus переводит статус accrual в наш; false — такого статуса accrual не бывает.
+func AccrualStatus(status string) (int, bool) {
+	statusKey, ok := getAccrualStatusMap()[status]
+	return statusKey, ok
+}
+
+// getAccrualStatusMap сопоставляет статусы accrual с нашими: REGISTERED для пользователя всё ещё NEW
+func getAccrualStatusMap() map[string]int {
+	return map[string]int{
+		"REGISTERED": StatusNew,
+		"PROCESSING": StatusProcessing,
+		"INVALID":    StatusInvalid,
+		"PROCESSED":  StatusProcessed,
 	}
-	return 0
 }
 
-func New(dataBaseURL string) (*Repo, error) {
+func New(dataBaseURL string, opts ...Option) (*Repo, error) {
 
-	dataBase := &DataBase{
-		conn: nil,
+	if dataBaseURL == "" {
+		return nil, &DBError{
+			Message: "Подключение к БД отсутствует",
+		}
 	}
 
-	repo := &Repo{
-		DB: dataBase,
+	config, err := pgxpool.ParseConfig(dataBaseURL)
+	if err != nil {
+		return nil, err
 	}
 
-	if dataBaseURL != "" {
-		db, err := sql.Open("pgx", dataBaseURL)
-		if err != nil {
-			db.Close()
-			return nil, err
-		}
+	s := &settings{pool: config, migrate: true}
 
-		if err := db.Ping(); err != nil {
-			db.Close()
-			return nil, err
-		}
+	for _, opt := range opts {
+		opt(s)
+	}
 
-		_, err = db.Exec("CREATE TABLE if not exists users (id BIGSERIAL primary key, login text, password text, user_token text, balance float default 0.0, withdrawn float default 0.0)")
+	ctx := context.Background()
 
-		if err != nil {
-			return nil, err
-		}
+	// схема создаётся теми же файлами, что и gophermart migrate up, и до открытия пула:
+	// новые соединения сразу готовят запросы к этим таблицам
+	if err := migrate(ctx, config.ConnConfig, s.migrate); err != nil {
+		return nil, err
+	}
 
-		_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS unique_login_constrain ON users(login)")
+	repo := &Repo{
+		statements: newStatements(),
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	config.AfterConnect = repo.prepare
 
-		_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS unique_token_constrain ON users(user_token)")
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	repo.pool = pool
 
-		_, err = db.Exec("CREATE TABLE if not exists transactions (id BIGSERIAL primary key, user_token text, order_id text, type integer, status integer, points float default 0.0, uploaded_at TIMESTAMPTZ default now(), processed_at TIMESTAMPTZ, FOREIGN KEY (user_token) REFERENCES users (user_token))")
+	return repo, nil
+}
 
-		if err != nil {
-			return nil, err
-		}
+// migrate поднимает схему, а при up = false только проверяет, что поднимать нечего.
+func migrate(ctx context.Context, config *pgx.ConnConfig, up bool) error {
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
 
-		insertTransaction, err = db.Prepare("INSERT INTO transactions (user_token, order_id, type, status, points, processed_at) VALUES($1,$2,$3,$4,$5,$6)")
-		if err != nil {
-			return nil, err
-		}
+	m, err := migrator.New(conn, migrations.FS)
+	if err != nil {
+		return err
+	}
 
-		insertAccrualTransaction, err = db.Prepare("INSERT INTO transactions (user_token, order_id, type, status, points) VALUES($1,$2,$3,$4,$5)")
-		if err != nil {
-			return nil, err
-		}
+	if up {
+		_, err = m.Up(ctx)
+		return err
+	}
 
-		updateTransaction, err = db.Prepare("UPDATE transactions set status = $1, points = $2, processed_at = $3 where order_id = $4 and type = $5")
-		if err != nil {
-			return nil, err
-		}
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
 
-		updateBalance, err = db.Prepare("UPDATE users set balance = $1, withdrawn = $2 where user_token = $3")
-		if err != nil {
-			return nil, err
-		}
+	if len(pending) > 0 {
+		return &PendingMigrationsError{Count: len(pending), Next: pending[0].Version}
+	}
 
-		dataBase := &DataBase{
-			conn: db,
-		}
+	return nil
+}
 
-		repo.DB = dataBase
+// Close дожидается возврата соединений в пул и закрывает их.
+func (r *Repo) Close() {
+	r.pool.Close()
+}
 
-	} else {
-		return nil, &DBError{
-			Message: "Подключение к БД отсутствует",
-		}
+// notFound: pgx сообщает об отсутствии строки своей ошибкой, вызывающие ждут sql.ErrNoRows
+func notFound(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return sql.ErrNoRows
 	}
-
-	return repo, nil
+	return err
 }
 
 func (r *Repo) SaveUser(ctx context.Context, login string, password string) (int, error) {
 	id := 0
 
-	row := r.DB.conn.QueryRowContext(ctx, "Insert into users (login, password) VALUES ($1, $2) RETURNING id", login, password)
+	row := r.pool.QueryRow(ctx, "Insert into users (login, password) VALUES ($1, $2) RETURNING id", login, password)
 	err := row.Scan(&id)
 
 	if err != nil {
@@ -237,7 +385,7 @@ func (r *Repo) SaveUser(ctx context.Context, login string, password string) (int
 }
 
 func (r *Repo) SaveUserToken(ctx context.Context, id int, userToken string) (string, error) {
-	_, err := r.DB.conn.ExecContext(ctx, "UPDATE users SET user_token = $1 WHERE id = $2", userToken, id)
+	_, err := r.pool.Exec(ctx, "UPDATE users SET user_token = $1 WHERE id = $2", userToken, id)
 
 	if err != nil {
 		return "", err
@@ -247,29 +395,36 @@ func (r *Repo) SaveUserToken(ctx context.Context, id int, userToken string) (str
 
 }
 
-func (r *Repo) FindUser(ctx context.Context, login string, password string) (string, error) {
-	token := ""
-	row := r.DB.conn.QueryRowContext(ctx, "SELECT user_token from users WHERE login = $1 and password = $2", login, password)
-	err := row.Scan(&token)
+// FindUser возвращает пользователя вместе с хешем пароля, сверка пароля — на стороне вызывающего.
+func (r *Repo) FindUser(ctx context.Context, login string) (*User, error) {
+	user := &User{
+		Login: login,
+	}
+	row := r.pool.QueryRow(ctx, "SELECT id, password, user_token from users WHERE login = $1", login)
+	err := row.Scan(&user.ID, &user.Password, &user.UserToken)
 	if err != nil {
 		log.Print(err.Error())
-		return "", err
+		return nil, notFound(err)
 	}
-	return token, nil
+	return user, nil
 
 }
 
+func (r *Repo) UpdatePassword(ctx context.Context, id int, password string) error {
+	_, err := r.pool.Exec(ctx, "UPDATE users SET password = $1 WHERE id = $2", password, id)
+	return err
+}
+
 func (r *Repo) GetBalance(ctx context.Context, userToken string) (*Balance, error) {
-	balance := 0.0
-	withdrawn := 0.0
-	row := r.DB.conn.QueryRowContext(ctx, "SELECT balance, withdrawn from users WHERE user_token = $1", userToken)
+	var balance, withdrawn money.Amount
+	row := r.pool.QueryRow(ctx, "SELECT balance, withdrawn from users WHERE user_token = $1", userToken)
 	err := row.Scan(&balance, &withdrawn)
 	if err != nil {
 		log.Print(err.Error())
 		return &Balance{
 			Current:   balance,
 			Withdrawn: withdrawn,
-		}, err
+		}, notFound(err)
 	}
 
 	return &Balance{
@@ -279,57 +434,94 @@ func (r *Repo) GetBalance(ctx context.Context, userToken string) (*Balance, erro
 
 }
 
-func (r *Repo) GetWithdrawals(ctx context.Context, userToken string) ([]ProcessedWithdraw, error) {
+// GetWithdrawals возвращает страницу списаний и курсор следующей, nil — если страница последняя.
+func (r *Repo) GetWithdrawals(ctx context.Context, userToken string, opts ListOptions) ([]ProcessedWithdraw, *Cursor, error) {
 
 	var myWithdraws []ProcessedWithdraw
+	var next *Cursor
+	more := false
+
+	query, args := listQuery("Select id, order_id, points, processed_at from transactions WHERE user_token = $1 AND type = $2 AND status = $3", "processed_at", []interface{}{userToken, TypeWithdraw, StatusProcessed}, opts)
 
-	rows, err := r.DB.conn.QueryContext(ctx, "Select order_id, points, processed_at from transactions WHERE user_token = $1 AND type = $2 AND status = $3 ORDER BY processed_at", userToken, TypeWithdraw, StatusProcessed)
+	rows, err := r.pool.Query(ctx, query, args...)
 
 	if err != nil {
-		return myWithdraws, err
+		return myWithdraws, nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var item ProcessedWithdraw
-		err = rows.Scan(&item.OrderID, &item.Points, &item.ProcessedAt)
+		var id int64
+		var processedAt time.Time
+		err = rows.Scan(&id, &item.OrderID, &item.Points, &processedAt)
 
 		if err != nil {
-			return myWithdraws, err
+			return myWithdraws, nil, err
 		}
 
+		// лишняя строка только сообщает, что есть следующая страница
+		if opts.Limit > 0 && len(myWithdraws) == opts.Limit {
+			more = true
+			break
+		}
+
+		item.ProcessedAt = processedAt.Format(time.RFC3339Nano)
+
 		myWithdraws = append(myWithdraws, item)
+		next = opts.Next(processedAt, id)
 	}
 
 	err = rows.Err()
 	if err != nil {
-		return myWithdraws, err
+		return myWithdraws, nil, err
+	}
+
+	if !more {
+		next = nil
 	}
 
-	return myWithdraws, nil
+	return myWithdraws, next, nil
 
 }
 
-func (r *Repo) GetOrders(ctx context.Context, userToken string) ([]Accrual, error) {
+// GetOrders возвращает страницу заказов и курсор следующей, nil — если страница последняя.
+func (r *Repo) GetOrders(ctx context.Context, userToken string, opts ListOptions) ([]Accrual, *Cursor, error) {
 
 	var myAccruals []Accrual
+	var next *Cursor
+	more := false
 
 	m := getStatusMap()
 
-	rows, err := r.DB.conn.QueryContext(ctx, "Select user_token, order_id, status, points, uploaded_at from transactions WHERE user_token = $1 AND type = $2 ORDER BY uploaded_at", userToken, TypeAccrual)
+	query, args := listQuery("Select id, user_token, order_id, status, points, uploaded_at from transactions WHERE user_token = $1 AND type = $2", "uploaded_at", []interface{}{userToken, TypeAccrual}, opts)
+
+	rows, err := r.pool.Query(ctx, query, args...)
 
 	if err != nil {
-		return myAccruals, err
+		return myAccruals, nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var itemRaw AccrualRaw
 		var item Accrual
-		err = rows.Scan(&itemRaw.UserToken, &itemRaw.OrderID, &itemRaw.Status, &itemRaw.Accrual, &itemRaw.UploadedAt)
+		var id int64
+		var uploadedAt time.Time
+		err = rows.Scan(&id, &itemRaw.UserToken, &itemRaw.OrderID, &itemRaw.Status, &itemRaw.Accrual, &uploadedAt)
 
 		if err != nil {
-			return myAccruals, err
+			return myAccruals, nil, err
+		}
+
+		// лишняя строка только сообщает, что есть следующая страница
+		if opts.Limit > 0 && len(myAccruals) == opts.Limit {
+			more = true
+			break
 		}
 
+		itemRaw.UploadedAt = uploadedAt.Format(time.RFC3339Nano)
+
 		item.OrderID = itemRaw.OrderID
 		item.Status = m[itemRaw.Status]
 
@@ -340,66 +532,138 @@ func (r *Repo) GetOrders(ctx context.Context, userToken string) ([]Accrual, erro
 		item.UploadedAt = carbon.Parse(itemRaw.UploadedAt).ToRfc3339String()
 
 		myAccruals = append(myAccruals, item)
+		next = opts.Next(uploadedAt, id)
 	}
 
 	err = rows.Err()
 	if err != nil {
-		return myAccruals, err
+		return myAccruals, nil, err
+	}
+
+	if !more {
+		next = nil
+	}
+
+	return myAccruals, next, nil
+
+}
+
+// SaveWithdraw списывает баллы в счёт заказа. Повтор того же списания (тот же заказ и сумма
+// или тот же Idempotency-Key) ничего не списывает и возвращает nil, поэтому клиент может
+// безопасно повторить запрос. Заказ или ключ, уже занятые другим списанием, — WithdrawConflictError.
+func (r *Repo) SaveWithdraw(ctx context.Context, orderID string, points money.Amount, userToken string, idempotencyKey string) error {
+	err := r.saveWithdraw(ctx, orderID, points, userToken, idempotencyKey)
+
+	// помешавшей записи уже нет, значит заказ свободен — пробуем ещё раз, но только однажды
+	if errors.Is(err, errWithdrawGone) {
+		err = r.saveWithdraw(ctx, orderID, points, userToken, idempotencyKey)
 	}
 
-	return myAccruals, nil
+	if errors.Is(err, errWithdrawGone) {
+		return &WithdrawConflictError{
+			OrderID: orderID,
+			Message: "order is being used by another withdrawal",
+		}
+	}
 
+	return err
 }
 
-func (r *Repo) SaveWithdraw(ctx context.Context, orderID string, points float64, userToken string) error {
+// errWithdrawGone — вставка упёрлась в чужое списание, но к разбору повтора его уже не найти.
+var errWithdrawGone = errors.New("conflicting withdrawal is gone")
+
+func (r *Repo) saveWithdraw(ctx context.Context, orderID string, points money.Amount, userToken string, idempotencyKey string) error {
+
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// сначала занимаем номер заказа: параллельный повтор дождётся нашей транзакции на уникальном индексе
+	res, err := tx.Exec(ctx, stmtInsertWithdraw, userToken, orderID, TypeWithdraw, StatusProcessed, points, time.Now(), idempotencyKey)
+	if err != nil {
+		return err
+	}
 
-	balance, err := r.GetBalance(ctx, userToken)
+	if res.RowsAffected() == 0 {
+		tx.Rollback(ctx)
+		return r.replayWithdraw(ctx, orderID, points, userToken, idempotencyKey)
+	}
 
+	// проверка остатка и списание одним UPDATE: строка пользователя блокируется до конца транзакции,
+	// поэтому параллельные списания не уведут баланс в минус
+	res, err = tx.Exec(ctx, stmtDebitBalance, points, userToken)
 	if err != nil {
 		return err
 	}
 
-	if points > balance.Current {
+	if res.RowsAffected() == 0 {
 		return &LowPointsError{
 			Message: "Недостаточно баллов для списания",
 		}
 	}
 
-	newBalance := balance.Current - points
-	newWithdrawn := balance.Withdrawn + points
-	timeString := carbon.Now().ToRfc3339String()
+	return tx.Commit(ctx)
 
-	tx, err := r.DB.conn.Begin()
-	if err != nil {
-		return err
+}
+
+// replayWithdraw разбирает, с каким уже сохранённым списанием совпал запрос.
+func (r *Repo) replayWithdraw(ctx context.Context, orderID string, points money.Amount, userToken string, idempotencyKey string) error {
+	var existingOrder, owner string
+	var existingPoints money.Amount
+
+	if idempotencyKey != "" {
+		row := r.pool.QueryRow(ctx, "SELECT order_id, points FROM transactions WHERE user_token = $1 AND idempotency_key = $2", userToken, idempotencyKey)
+		err := row.Scan(&existingOrder, &existingPoints)
+
+		if err == nil {
+			if existingOrder == orderID && existingPoints == points {
+				return nil
+			}
+
+			return &WithdrawConflictError{
+				IdempotencyKey: idempotencyKey,
+				Message:        "idempotency key was used for another withdrawal",
+			}
+		}
+
+		if err != pgx.ErrNoRows {
+			return err
+		}
 	}
-	defer tx.Rollback()
 
-	txStmt := tx.StmtContext(ctx, insertTransaction)
+	row := r.pool.QueryRow(ctx, "SELECT user_token, points FROM transactions WHERE order_id = $1 AND type = $2", orderID, TypeWithdraw)
+	err := row.Scan(&owner, &existingPoints)
 
-	if _, err = txStmt.ExecContext(ctx, userToken, orderID, TypeWithdraw, StatusProcessed, points, timeString); err != nil {
-		return err
+	if err == pgx.ErrNoRows {
+		return errWithdrawGone
 	}
 
-	txStmt = tx.StmtContext(ctx, updateBalance)
-	if _, err = txStmt.ExecContext(ctx, newBalance, newWithdrawn, userToken); err != nil {
+	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	if owner == userToken && existingPoints == points {
+		return nil
+	}
 
+	return &WithdrawConflictError{
+		OrderID: orderID,
+		Message: "order was used for another withdrawal",
+	}
 }
 
 func (r *Repo) FindOrderAccrual(ctx context.Context, orderID string) (*AccrualRaw, error) {
 	token := ""
 	status := 0
-	points := 0.0
-	uploadedAt := "NULL"
+	var points money.Amount
+	var uploadedAt time.Time
 
-	row := r.DB.conn.QueryRowContext(ctx, "SELECT user_token, status, points, uploaded_at from transactions WHERE order_id = $1 and type = $2", orderID, TypeAccrual)
+	row := r.pool.QueryRow(ctx, "SELECT user_token, status, points, uploaded_at from transactions WHERE order_id = $1 and type = $2", orderID, TypeAccrual)
 	err := row.Scan(&token, &status, &points, &uploadedAt)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	}
 
 	return &AccrualRaw{
@@ -407,76 +671,368 @@ func (r *Repo) FindOrderAccrual(ctx context.Context, orderID string) (*AccrualRa
 		OrderID:    orderID,
 		Status:     status,
 		Accrual:    points,
-		UploadedAt: uploadedAt,
+		UploadedAt: uploadedAt.Format(time.RFC3339Nano),
 	}, nil
 
 }
 
+// CreateOrder регистрирует заказ на начисление. Номер уникален: если заказ уже загружен,
+// возвращается OrderExistsError с владельцем — решение принимает уникальный индекс, а не
+// предварительная проверка, поэтому из двух одновременных загрузок пройдёт ровно одна.
 func (r *Repo) CreateOrder(ctx context.Context, orderID string, userToken string) error {
 
-	tx, err := r.DB.conn.Begin()
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	res, err := tx.Exec(ctx, stmtInsertAccrualTransaction, userToken, orderID, TypeAccrual, StatusNew, money.Amount(0))
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
-	txStmt := tx.StmtContext(ctx, insertAccrualTransaction)
+	if res.RowsAffected() == 0 {
+		// вставка дождалась фиксации конкурента, следующий запрос видит его строку
+		owner := ""
+		row := tx.QueryRow(ctx, "SELECT user_token FROM transactions WHERE order_id = $1 AND type = $2", orderID, TypeAccrual)
+		if err := row.Scan(&owner); err != nil {
+			return err
+		}
+
+		return &OrderExistsError{
+			OrderID:   orderID,
+			UserToken: owner,
+		}
+	}
 
-	if _, err = txStmt.ExecContext(ctx, userToken, orderID, TypeAccrual, StatusNew, 0.0); err != nil {
+	// заказ попадает в очередь опроса accrual в той же транзакции
+	if _, err = tx.Exec(ctx, stmtEnqueueOrder, orderID, userToken); err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	return tx.Commit(ctx)
 
 }
 
-func (r *Repo) UpdateOrder(ctx context.Context, orderID string, status string, accrual float64, userToken string) error {
-	m := getStatusMap()
-	statusKey := firstKeyByValue(m, status)
+func (r *Repo) UpdateOrder(ctx context.Context, orderID string, status string, accrual money.Amount) error {
+	statusKey, ok := getAccrualStatusMap()[status]
+
+	if !ok {
+		return &UnknownStatusError{
+			Status: status,
+		}
+	}
+
+	// REGISTERED: accrual принял заказ, но ещё не начал расчёт, у нас он остаётся NEW
+	if statusKey == StatusNew {
+		return nil
+	}
+
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var processedAt interface{}
+
+	if statusKey == StatusProcessed {
+		processedAt = time.Now()
+	}
+
+	// статус меняется только из допустимых предыдущих, поэтому повторный PROCESSED ничего не найдёт
+	// и баллы не будут начислены второй раз
+	userToken := ""
+	err = tx.QueryRow(ctx, stmtUpdateTransaction, statusKey, accrual, processedAt, orderID, TypeAccrual, getStatusTransitions()[statusKey]).Scan(&userToken)
 
-	if statusKey == 0 {
-		//r.CreateOrder(ctx, orderID, userToken)
+	if err == pgx.ErrNoRows {
 		return nil
 	}
 
-	newBalance := 0.0
-	withdrawn := 0.0
+	if err != nil {
+		return err
+	}
+
 	if statusKey == StatusProcessed {
-		balance, err := r.GetBalance(ctx, userToken)
 
-		if err != nil {
+		if _, err = tx.Exec(ctx, stmtCreditBalance, accrual, userToken); err != nil {
 			return err
 		}
-		newBalance = balance.Current + accrual
-		withdrawn = balance.Withdrawn
 	}
 
-	tx, err := r.DB.conn.Begin()
+	return tx.Commit(ctx)
+
+}
+
+// RecoverOrders возвращает в очередь все заказы, по которым ещё не получен окончательный статус.
+func (r *Repo) RecoverOrders(ctx context.Context) (int64, error) {
+	res, err := r.pool.Exec(ctx, "INSERT INTO accrual_queue (order_id, user_token) SELECT order_id, user_token FROM transactions WHERE type = $1 AND status IN ($2, $3) ON CONFLICT (order_id) DO NOTHING", TypeAccrual, StatusNew, StatusProcessing)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected(), nil
+}
+
+// ClaimOrders забирает из очереди заказы, которые пора опросить, и откладывает их на время lease,
+// чтобы их не взял другой экземпляр сервиса. Если обработчик не успеет, заказ вернётся в работу сам.
+func (r *Repo) ClaimOrders(ctx context.Context, limit int, lease time.Duration) ([]QueuedOrder, error) {
+
+	var orders []QueuedOrder
+
+	rows, err := r.pool.Query(ctx, `UPDATE accrual_queue q SET attempts = q.attempts + 1, next_attempt_at = now() + make_interval(secs => $2)
+		FROM (SELECT order_id FROM accrual_queue WHERE next_attempt_at <= now() ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED) due
+		WHERE q.order_id = due.order_id
+		RETURNING q.order_id, q.user_token, q.attempts, COALESCE(q.accrual_status, '')`, limit, lease.Seconds())
+
+	if err != nil {
+		return orders, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item QueuedOrder
+		err = rows.Scan(&item.OrderID, &item.UserToken, &item.Attempts, &item.AccrualStatus)
+
+		if err != nil {
+			return orders, err
+		}
+
+		orders = append(orders, item)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return orders, err
+	}
+
+	return orders, nil
+}
+
+// RescheduleOrder откладывает следующий опрос заказа; пустой accrualStatus оставляет последний известный статус.
+// attempts — значение, с которым заказ был взят: если аренда истекла и заказ взяли снова, ничего не меняется
+// и возвращается LeaseLostError.
+func (r *Repo) RescheduleOrder(ctx context.Context, orderID string, attempts int, accrualStatus string, delay time.Duration) error {
+	res, err := r.pool.Exec(ctx, "UPDATE accrual_queue SET next_attempt_at = now() + make_interval(secs => $1), accrual_status = COALESCE(NULLIF($2, ''), accrual_status) WHERE order_id = $3 AND attempts = $4", delay.Seconds(), accrualStatus, orderID, attempts)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
-	timeString := "NULL"
+	if res.RowsAffected() == 0 {
+		return &LeaseLostError{OrderID: orderID, Attempts: attempts}
+	}
 
-	if statusKey == StatusProcessed {
-		timeString = carbon.Now().ToRfc3339String()
+	return nil
+}
+
+// DequeueOrder убирает заказ из очереди, если он всё ещё взят с тем же attempts, иначе — LeaseLostError.
+func (r *Repo) DequeueOrder(ctx context.Context, orderID string, attempts int) error {
+	res, err := r.pool.Exec(ctx, "DELETE FROM accrual_queue WHERE order_id = $1 AND attempts = $2", orderID, attempts)
+	if err != nil {
+		return err
 	}
 
-	txStmt := tx.StmtContext(ctx, updateTransaction)
+	if res.RowsAffected() == 0 {
+		return &LeaseLostError{OrderID: orderID, Attempts: attempts}
+	}
+
+	return nil
+}
+
+// CreateSession заводит сессию вместе с первым refresh-токеном; хранится только хеш токена.
+func (r *Repo) CreateSession(ctx context.Context, id string, userToken string, expiresAt time.Time, refreshHash string) error {
 
-	if _, err = txStmt.ExecContext(ctx, statusKey, accrual, timeString, orderID, TypeAccrual); err != nil {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	if statusKey == StatusProcessed {
+	if _, err = tx.Exec(ctx, "INSERT INTO sessions (id, user_token, expires_at) VALUES ($1, $2, $3)", id, userToken, expiresAt); err != nil {
+		return err
+	}
 
-		txStmt = tx.StmtContext(ctx, updateBalance)
-		if _, err = txStmt.ExecContext(ctx, newBalance, withdrawn, userToken); err != nil {
-			return err
+	if _, err = tx.Exec(ctx, "INSERT INTO refresh_tokens (session_id, token_hash, expires_at) VALUES ($1, $2, $3)", id, refreshHash, expiresAt); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *Repo) FindSession(ctx context.Context, id string) (*Session, error) {
+	session := &Session{
+		ID: id,
+	}
+
+	var revokedAt sql.NullTime
+
+	row := r.pool.QueryRow(ctx, "SELECT user_token, created_at, expires_at, revoked_at FROM sessions WHERE id = $1", id)
+	err := row.Scan(&session.UserToken, &session.CreatedAt, &session.ExpiresAt, &revokedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+
+	return session, nil
+}
+
+// RevokeSession отзывает сессию; повторный отзыв не меняет время первого.
+func (r *Repo) RevokeSession(ctx context.Context, id string) error {
+	_, err := r.pool.Exec(ctx, "UPDATE sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", id)
+	return err
+}
+
+// RevokeUserSessions отзывает все действующие сессии пользователя — выход на всех устройствах.
+func (r *Repo) RevokeUserSessions(ctx context.Context, userToken string) (int64, error) {
+	res, err := r.pool.Exec(ctx, "UPDATE sessions SET revoked_at = now() WHERE user_token = $1 AND revoked_at IS NULL AND expires_at > now()", userToken)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected(), nil
+}
+
+// RotateRefreshToken гасит refresh-токен и выдаёт вместо него новый в той же сессии.
+// Строка токена блокируется, поэтому два параллельных обновления одним токеном не пройдут оба:
+// второе увидит used_at и отзовёт сессию.
+func (r *Repo) RotateRefreshToken(ctx context.Context, oldHash string, newHash string) (*Session, error) {
+
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var tokenID int64
+	var usedAt, revokedAt sql.NullTime
+	session := &Session{}
+
+	row := tx.QueryRow(ctx, `SELECT t.id, t.used_at, s.id, s.user_token, s.created_at, s.expires_at, s.revoked_at
+		FROM refresh_tokens t JOIN sessions s ON s.id = t.session_id
+		WHERE t.token_hash = $1 FOR UPDATE OF t`, oldHash)
+	err = row.Scan(&tokenID, &usedAt, &session.ID, &session.UserToken, &session.CreatedAt, &session.ExpiresAt, &revokedAt)
+
+	if err == pgx.ErrNoRows {
+		return nil, &RefreshTokenError{
+			Message: "unknown refresh token",
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+
+	if usedAt.Valid {
+		if _, err = tx.Exec(ctx, "UPDATE sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", session.ID); err != nil {
+			return nil, err
+		}
+
+		if err = tx.Commit(ctx); err != nil {
+			return nil, err
+		}
+
+		return nil, &RefreshTokenReuseError{
+			SessionID: session.ID,
 		}
 	}
 
-	return tx.Commit()
+	if !session.Active(time.Now()) {
+		return nil, &RefreshTokenError{
+			Message: "session is expired or revoked",
+		}
+	}
+
+	if _, err = tx.Exec(ctx, "UPDATE refresh_tokens SET used_at = now() WHERE id = $1", tokenID); err != nil {
+		return nil, err
+	}
+
+	// новый токен живёт не дольше сессии: обновление не продлевает вход бесконечно
+	if _, err = tx.Exec(ctx, "INSERT INTO refresh_tokens (session_id, token_hash, expires_at) VALUES ($1, $2, $3)", session.ID, newHash, session.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// LoginAttempts — число неудачных входов подряд и срок блокировки по ключу; нет записи — нет и блокировки.
+func (r *Repo) LoginAttempts(ctx context.Context, key string) (int, time.Time, error) {
+	failures := 0
+	var lockedUntil sql.NullTime
+
+	row := r.pool.QueryRow(ctx, "SELECT failures, locked_until FROM login_attempts WHERE key = $1", key)
+	err := row.Scan(&failures, &lockedUntil)
+
+	if err == pgx.ErrNoRows {
+		return 0, time.Time{}, nil
+	}
+
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return failures, lockedUntil.Time, nil
+}
+
+// AddLoginFailure увеличивает счётчик одним upsert, так что параллельные попытки
+// с разных экземпляров сервиса не теряются.
+func (r *Repo) AddLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (int, error) {
+	failures := 0
+
+	row := r.pool.QueryRow(ctx, `INSERT INTO login_attempts (key, failures, last_failure_at, expires_at) VALUES ($1, 1, $2, $2 + make_interval(secs => $3))
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < $2 - make_interval(secs => $3) THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = $2,
+			expires_at = $2 + make_interval(secs => $3)
+		RETURNING failures`, key, now, window.Seconds())
+	err := row.Scan(&failures)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if atomic.AddUint64(&r.loginFailures, 1)%loginSweepEvery == 0 {
+		r.sweepLoginAttempts(ctx, now)
+	}
+
+	return failures, nil
+}
+
+// loginSweepEvery — как часто AddLoginFailure удаляет забытые записи, чтобы перебор случайных
+// логинов и адресов не раздувал login_attempts бесконечно.
+const loginSweepEvery = 1024
+
+// sweepLoginAttempts удаляет записи, у которых истекли и окно подсчёта, и блокировка.
+// Сбой очистки не мешает учёту попытки, поэтому только пишется в лог.
+func (r *Repo) sweepLoginAttempts(ctx context.Context, now time.Time) {
+	_, err := r.pool.Exec(ctx, `DELETE FROM login_attempts
+		WHERE COALESCE(expires_at, '-infinity') < $1 AND COALESCE(locked_until, '-infinity') < $1`, now)
+
+	if err != nil {
+		log.Printf("unable to sweep login attempts: %v", err)
+	}
+}
+
+func (r *Repo) LockLogin(ctx context.Context, key string, until time.Time) error {
+	_, err := r.pool.Exec(ctx, `INSERT INTO login_attempts (key, locked_until) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET locked_until = GREATEST(login_attempts.locked_until, $2)`, key, until)
+	return err
+}
 
+func (r *Repo) ResetLoginAttempts(ctx context.Context, key string) error {
+	_, err := r.pool.Exec(ctx, "DELETE FROM login_attempts WHERE key = $1", key)
+	return err
 }
@@ -0,0 +1,406 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	parallelWithdrawals = 50
+	parallelAccruals    = 20
+)
+
+func testRepo(t *testing.T) *Repo {
+	dataBaseURL := os.Getenv("DATABASE_URI")
+	if dataBaseURL == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+
+	repo, err := New(dataBaseURL, WithMaxConns(parallelWithdrawals))
+	require.NoError(t, err)
+	t.Cleanup(repo.Close)
+
+	return repo
+}
+
+func testUser(t *testing.T, repo *Repo) string {
+	ctx := context.Background()
+
+	login := fmt.Sprintf("repo_%v", time.Now().UnixNano())
+	id, err := repo.SaveUser(ctx, login, "hash")
+	require.NoError(t, err)
+
+	token, err := repo.SaveUserToken(ctx, id, fmt.Sprintf("token_%v", login))
+	require.NoError(t, err)
+
+	return token
+}
+
+func testOrder(prefix string, i int) string {
+	return fmt.Sprintf("%v%v%03d", prefix, time.Now().UnixNano(), i)
+}
+
+func TestRepo_ConcurrentBalance(t *testing.T) {
+	repo := testRepo(t)
+	ctx := context.Background()
+	token := testUser(t, repo)
+
+	initial := testOrder("1", 0)
+	require.NoError(t, repo.CreateOrder(ctx, initial, token))
+	require.NoError(t, repo.UpdateOrder(ctx, initial, "PROCESSED", money.FromInt(100)))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	withdrawn := 0
+	rejected := 0
+
+	for i := 0; i < parallelWithdrawals; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			err := repo.SaveWithdraw(ctx, testOrder("2", i), money.FromInt(10), token, "")
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			var lpe *LowPointsError
+			if errors.As(err, &lpe) {
+				rejected++
+				return
+			}
+
+			assert.NoError(t, err)
+			withdrawn++
+		}(i)
+	}
+
+	for i := 0; i < parallelAccruals; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			number := testOrder("3", i)
+			assert.NoError(t, repo.CreateOrder(ctx, number, token))
+			assert.NoError(t, repo.UpdateOrder(ctx, number, "PROCESSED", money.FromInt(1)))
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, parallelWithdrawals, withdrawn+rejected)
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+
+	// ни одно начисление не потеряно, и баланс не ушёл в минус
+	assert.Equal(t, money.FromInt(int64(100+parallelAccruals-10*withdrawn)), balance.Current)
+	assert.Equal(t, money.FromInt(int64(10*withdrawn)), balance.Withdrawn)
+	assert.True(t, balance.Current >= 0)
+	assert.True(t, withdrawn >= 10 && withdrawn <= 12)
+}
+
+func TestRepo_UpdateOrderIdempotent(t *testing.T) {
+	repo := testRepo(t)
+	ctx := context.Background()
+	token := testUser(t, repo)
+
+	number := testOrder("4", 0)
+	require.NoError(t, repo.CreateOrder(ctx, number, token))
+	require.NoError(t, repo.UpdateOrder(ctx, number, "PROCESSING", 0))
+
+	// повторный опрос и гонка воркеров не должны начислить баллы дважды
+	var wg sync.WaitGroup
+	for i := 0; i < parallelAccruals; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, repo.UpdateOrder(ctx, number, "PROCESSED", money.FromInt(50)))
+		}()
+	}
+	wg.Wait()
+
+	// окончательный статус не откатывается
+	require.NoError(t, repo.UpdateOrder(ctx, number, "PROCESSING", 0))
+	require.NoError(t, repo.UpdateOrder(ctx, number, "INVALID", 0))
+
+	order, err := repo.FindOrderAccrual(ctx, number)
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessed, order.Status)
+	assert.Equal(t, money.FromInt(50), order.Accrual)
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromInt(50), balance.Current)
+
+	assert.Error(t, repo.UpdateOrder(ctx, number, "UNKNOWN", 0))
+}
+
+// у каждого Repo свой пул и свои подготовленные запросы: закрытие одного не ломает другой
+func TestRepo_Instances(t *testing.T) {
+	first := testRepo(t)
+	second := testRepo(t)
+	ctx := context.Background()
+
+	token := testUser(t, first)
+	order := testOrder("1", 0)
+	require.NoError(t, first.CreateOrder(ctx, order, token))
+
+	first.Close()
+
+	require.NoError(t, second.UpdateOrder(ctx, order, "PROCESSED", money.FromInt(5)))
+
+	balance, err := second.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromInt(5), balance.Current)
+
+	_, err = second.FindOrderAccrual(ctx, "missing")
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestCanTransition(t *testing.T) {
+	assert.True(t, CanTransition(StatusNew, StatusProcessing))
+	assert.True(t, CanTransition(StatusNew, StatusProcessed))
+	assert.True(t, CanTransition(StatusProcessing, StatusInvalid))
+	assert.False(t, CanTransition(StatusProcessing, StatusProcessing))
+	assert.False(t, CanTransition(StatusProcessed, StatusProcessed))
+	assert.False(t, CanTransition(StatusProcessed, StatusInvalid))
+	assert.False(t, CanTransition(StatusInvalid, StatusProcessing))
+	assert.False(t, CanTransition(StatusProcessing, StatusNew))
+}
+
+func TestExpiringLots(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(days int) time.Time { return start.AddDate(0, 0, days) }
+
+	entries := []LedgerEntry{
+		{ID: 1, Type: TypeAccrual, OrderID: "a", Points: money.FromInt(100), ProcessedAt: at(0)},
+		{ID: 2, Type: TypeAccrual, OrderID: "b", Points: money.FromInt(50), ProcessedAt: at(1)},
+		{ID: 3, Type: TypeAccrual, OrderID: "zero", Points: 0, ProcessedAt: at(1)},
+		// списание расходует сначала самую старую партию, остаток — из следующей
+		{ID: 4, Type: TypeWithdraw, OrderID: "w1", Points: money.FromInt(120), ProcessedAt: at(2)},
+		{ID: 5, Type: TypeAccrual, OrderID: "c", Points: money.FromInt(40), ProcessedAt: at(3)},
+		{ID: 6, Type: TypeAccrual, OrderID: "d", Points: money.FromInt(10), ProcessedAt: at(10)},
+	}
+
+	assert.Equal(t, []ExpiredLot{
+		{OrderID: "a", Points: 0},
+		{OrderID: "b", Points: money.FromInt(30)},
+		{OrderID: "c", Points: money.FromInt(40)},
+	}, ExpiringLots(entries, at(5)))
+
+	assert.Empty(t, ExpiringLots(entries, at(0)))
+
+	// сгоревшая партия закрыта, следующее списание её уже не трогает
+	entries = append(entries,
+		LedgerEntry{ID: 7, Type: TypeExpiration, OrderID: "b", Points: money.FromInt(30), ProcessedAt: at(11)},
+		LedgerEntry{ID: 8, Type: TypeWithdraw, OrderID: "w2", Points: money.FromInt(45), ProcessedAt: at(12)},
+	)
+
+	assert.Equal(t, []ExpiredLot{
+		{OrderID: "a", Points: 0},
+		{OrderID: "c", Points: 0},
+		{OrderID: "d", Points: money.FromInt(5)},
+	}, ExpiringLots(entries, at(20)))
+}
+
+func TestRepo_Sessions(t *testing.T) {
+	repo := testRepo(t)
+	ctx := context.Background()
+	token := testUser(t, repo)
+
+	first := testOrder("s", 1)
+	second := testOrder("s", 2)
+	require.NoError(t, repo.CreateSession(ctx, first, token, time.Now().Add(time.Hour), "hash_"+first))
+	require.NoError(t, repo.CreateSession(ctx, second, token, time.Now().Add(time.Hour), "hash_"+second))
+
+	session, err := repo.FindSession(ctx, first)
+	require.NoError(t, err)
+	assert.Equal(t, token, session.UserToken)
+	assert.True(t, session.Active(time.Now()))
+	assert.False(t, session.Active(time.Now().Add(2*time.Hour)))
+
+	// выход отзывает только свою сессию
+	require.NoError(t, repo.RevokeSession(ctx, first))
+
+	session, err = repo.FindSession(ctx, first)
+	require.NoError(t, err)
+	assert.False(t, session.Active(time.Now()))
+
+	session, err = repo.FindSession(ctx, second)
+	require.NoError(t, err)
+	assert.True(t, session.Active(time.Now()))
+
+	revoked, err := repo.RevokeUserSessions(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), revoked)
+
+	session, err = repo.FindSession(ctx, second)
+	require.NoError(t, err)
+	assert.False(t, session.Active(time.Now()))
+}
+
+func TestRepo_RotateRefreshTokenRace(t *testing.T) {
+	repo := testRepo(t)
+	ctx := context.Background()
+	token := testUser(t, repo)
+
+	id := testOrder("r", 0)
+	require.NoError(t, repo.CreateSession(ctx, id, token, time.Now().Add(time.Hour), "hash_"+id))
+
+	// один токен одновременно предъявили несколько раз: обмен проходит ровно однажды
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	rotated := 0
+
+	for i := 0; i < parallelAccruals; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := repo.RotateRefreshToken(ctx, "hash_"+id, fmt.Sprintf("hash_%v_%v", id, i))
+			if err == nil {
+				mu.Lock()
+				rotated++
+				mu.Unlock()
+				return
+			}
+
+			var rtre *RefreshTokenReuseError
+			assert.True(t, errors.As(err, &rtre), err)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, rotated)
+
+	session, err := repo.FindSession(ctx, id)
+	require.NoError(t, err)
+	assert.False(t, session.Active(time.Now()))
+
+	_, err = repo.RotateRefreshToken(ctx, "unknown", "hash_other_"+id)
+	var rte *RefreshTokenError
+	assert.True(t, errors.As(err, &rte))
+}
+
+func TestRepo_LoginAttempts(t *testing.T) {
+	repo := testRepo(t)
+	ctx := context.Background()
+	key := "login:" + testOrder("l", 0)
+	now := time.Now().Truncate(time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelAccruals; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := repo.AddLoginFailure(ctx, key, now, time.Hour)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// параллельные неудачи не теряются
+	failures, _, err := repo.LoginAttempts(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, parallelAccruals, failures)
+
+	require.NoError(t, repo.LockLogin(ctx, key, now.Add(time.Hour)))
+	require.NoError(t, repo.LockLogin(ctx, key, now.Add(time.Minute)))
+
+	_, lockedUntil, err := repo.LoginAttempts(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, lockedUntil.Equal(now.Add(time.Hour)))
+
+	failures, err = repo.AddLoginFailure(ctx, key, now.Add(2*time.Hour), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+
+	require.NoError(t, repo.ResetLoginAttempts(ctx, key))
+
+	failures, lockedUntil, err = repo.LoginAttempts(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, 0, failures)
+	assert.True(t, lockedUntil.IsZero())
+}
+
+func TestRepo_SweepLoginAttempts(t *testing.T) {
+	repo := testRepo(t)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	stale := "ip:" + testOrder("s", 0)
+	locked := "ip:" + testOrder("s", 1)
+	fresh := "ip:" + testOrder("s", 2)
+
+	_, err := repo.AddLoginFailure(ctx, stale, now.Add(-2*time.Hour), time.Hour)
+	require.NoError(t, err)
+
+	// окно прошло, но блокировка ещё действует — запись нужна
+	_, err = repo.AddLoginFailure(ctx, locked, now.Add(-2*time.Hour), time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, repo.LockLogin(ctx, locked, now.Add(time.Hour)))
+
+	_, err = repo.AddLoginFailure(ctx, fresh, now.Add(-time.Minute), time.Hour)
+	require.NoError(t, err)
+
+	repo.sweepLoginAttempts(ctx, now)
+
+	failures, _, err := repo.LoginAttempts(ctx, stale)
+	require.NoError(t, err)
+	assert.Equal(t, 0, failures)
+
+	failures, lockedUntil, err := repo.LoginAttempts(ctx, locked)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+	assert.True(t, lockedUntil.Equal(now.Add(time.Hour)))
+
+	failures, _, err = repo.LoginAttempts(ctx, fresh)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+}
+
+func TestCursor(t *testing.T) {
+	opts := ListOptions{Desc: true, Statuses: []int{StatusNew}}
+	cursor := opts.Next(time.Date(2022, 2, 1, 10, 0, 0, 123456000, time.UTC), 7)
+
+	parsed, err := ParseCursor(cursor.String())
+	require.NoError(t, err)
+	assert.True(t, cursor.At.Equal(parsed.At))
+	assert.Equal(t, cursor.ID, parsed.ID)
+	assert.True(t, parsed.Desc)
+	assert.Equal(t, opts.FilterHash(), parsed.Filter)
+
+	opts.After = parsed
+	assert.NoError(t, opts.CheckCursor())
+
+	var ce *CursorError
+
+	asc := opts
+	asc.Desc = false
+	assert.True(t, errors.As(asc.CheckCursor(), &ce))
+
+	filtered := opts
+	filtered.From = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.True(t, errors.As(filtered.CheckCursor(), &ce))
+
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+
+	for _, raw := range []string{"", "!!", "MTIz", encode("a.b.a.x"), encode("1.0.a.x"), encode("1.2"), encode("1.2.x.abc")} {
+		_, err := ParseCursor(raw)
+		var ce *CursorError
+		assert.True(t, errors.As(err, &ce), raw)
+	}
+}
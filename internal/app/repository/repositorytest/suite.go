@@ -0,0 +1,947 @@
+// Package repositorytest — общий набор проверок Repositorier: одни и те же тесты гоняются
+// и на Postgres, и на хранилище в памяти, чтобы их поведение не расходилось.
+package repositorytest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SetBalance переписывает сохранённый баланс пользователя в обход репозитория: так каждое
+// хранилище по-своему портит данные, а сверку и сгорание на испорченных данных проверяет общий набор.
+type SetBalance func(t *testing.T, repo repository.Repositorier, userToken string, balance money.Amount, withdrawn money.Amount)
+
+// Run прогоняет набор на хранилище, которое возвращает newRepo. Хранилище может быть общим
+// для всех подтестов: каждый заводит своих пользователей и заказы с уникальными номерами.
+func Run(t *testing.T, newRepo func(t *testing.T) repository.Repositorier, setBalance SetBalance) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo repository.Repositorier)
+	}{
+		{name: "Users", test: testUsers},
+		{name: "Orders", test: testOrders},
+		{name: "OrderOwnership", test: testOrderOwnership},
+		{name: "StatusTransitions", test: testStatusTransitions},
+		{name: "Withdrawals", test: testWithdrawals},
+		{name: "ConcurrentWithdrawals", test: testConcurrentWithdrawals},
+		{name: "IdempotentWithdrawals", test: testIdempotentWithdrawals},
+		{name: "Lists", test: testLists},
+		{name: "Statement", test: testStatement},
+		{name: "Reconcile", test: testReconcile},
+		{name: "ReconcileMismatch", test: func(t *testing.T, repo repository.Repositorier) {
+			testReconcileMismatch(t, repo, setBalance)
+		}},
+		{name: "Expiration", test: testExpiration},
+		{name: "ExpirationLowBalance", test: func(t *testing.T, repo repository.Repositorier) {
+			testExpirationLowBalance(t, repo, setBalance)
+		}},
+		{name: "Queue", test: testQueue},
+		{name: "Sessions", test: testSessions},
+		{name: "RefreshTokens", test: testRefreshTokens},
+		{name: "LoginAttempts", test: testLoginAttempts},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo(t))
+		})
+	}
+}
+
+func unique(prefix string) string {
+	return fmt.Sprintf("%v%v", prefix, time.Now().UnixNano())
+}
+
+// User заводит пользователя с токеном и возвращает токен.
+func User(t *testing.T, repo repository.Repositorier) string {
+	ctx := context.Background()
+
+	login := unique("suite_")
+	id, err := repo.SaveUser(ctx, login, "hash")
+	require.NoError(t, err)
+
+	token, err := repo.SaveUserToken(ctx, id, "token_"+login)
+	require.NoError(t, err)
+
+	return token
+}
+
+// Order — номер заказа, которого ещё нет в хранилище.
+func Order(i int) string {
+	return fmt.Sprintf("%v%03d", time.Now().UnixNano(), i)
+}
+
+// fund начисляет пользователю баллы через обработанный заказ.
+func fund(t *testing.T, repo repository.Repositorier, token string, points money.Amount) {
+	ctx := context.Background()
+
+	order := Order(999)
+	require.NoError(t, repo.CreateOrder(ctx, order, token))
+	require.NoError(t, repo.UpdateOrder(ctx, order, "PROCESSED", points))
+}
+
+func testUsers(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+
+	login := unique("suite_user_")
+	id, err := repo.SaveUser(ctx, login, "hash")
+	require.NoError(t, err)
+	assert.NotZero(t, id)
+
+	_, err = repo.SaveUser(ctx, login, "other")
+	var ce *repository.ConflictError
+	assert.True(t, errors.As(err, &ce), "got %v", err)
+
+	_, err = repo.SaveUserToken(ctx, id, "token_"+login)
+	require.NoError(t, err)
+
+	user, err := repo.FindUser(ctx, login)
+	require.NoError(t, err)
+	assert.Equal(t, id, user.ID)
+	assert.Equal(t, "hash", user.Password)
+	assert.Equal(t, "token_"+login, user.UserToken)
+
+	require.NoError(t, repo.UpdatePassword(ctx, id, "rehashed"))
+
+	user, err = repo.FindUser(ctx, login)
+	require.NoError(t, err)
+	assert.Equal(t, "rehashed", user.Password)
+
+	_, err = repo.FindUser(ctx, unique("missing_"))
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	balance, err := repo.GetBalance(ctx, "token_"+login)
+	require.NoError(t, err)
+	assert.Equal(t, repository.Balance{}, *balance)
+
+	_, err = repo.GetBalance(ctx, unique("missing_token_"))
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func testOrders(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	orders, _, err := repo.GetOrders(ctx, token, repository.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, orders)
+
+	first := Order(1)
+	second := Order(2)
+
+	require.NoError(t, repo.CreateOrder(ctx, first, token))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, repo.CreateOrder(ctx, second, token))
+
+	found, err := repo.FindOrderAccrual(ctx, first)
+	require.NoError(t, err)
+	assert.Equal(t, token, found.UserToken)
+	assert.Equal(t, repository.StatusNew, found.Status)
+
+	_, err = repo.FindOrderAccrual(ctx, Order(3))
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// старые заказы первыми
+	orders, _, err = repo.GetOrders(ctx, token, repository.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	assert.Equal(t, first, orders[0].OrderID)
+	assert.Equal(t, second, orders[1].OrderID)
+	assert.Equal(t, "NEW", orders[0].Status)
+	assert.Zero(t, orders[0].Accrual)
+
+	_, err = time.Parse(time.RFC3339, orders[0].UploadedAt)
+	assert.NoError(t, err)
+
+	// чужие заказы не видны
+	orders, _, err = repo.GetOrders(ctx, User(t, repo), repository.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, orders)
+}
+
+func testOrderOwnership(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	owner := User(t, repo)
+
+	order := Order(1)
+	require.NoError(t, repo.CreateOrder(ctx, order, owner))
+
+	var oee *repository.OrderExistsError
+	require.True(t, errors.As(repo.CreateOrder(ctx, order, owner), &oee))
+	assert.Equal(t, owner, oee.UserToken)
+
+	require.True(t, errors.As(repo.CreateOrder(ctx, order, User(t, repo)), &oee))
+	assert.Equal(t, owner, oee.UserToken)
+
+	orders, _, err := repo.GetOrders(ctx, owner, repository.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, orders, 1)
+
+	// из одновременных загрузок одного номера проходит ровно одна, остальные видят её владельца
+	contested := Order(2)
+	users := make([]string, 10)
+	for i := range users {
+		users[i] = User(t, repo)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var winners []string
+	var owners []string
+
+	for _, user := range users {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+
+			err := repo.CreateOrder(ctx, contested, user)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			var oee *repository.OrderExistsError
+			if errors.As(err, &oee) {
+				owners = append(owners, oee.UserToken)
+				return
+			}
+
+			if assert.NoError(t, err) {
+				winners = append(winners, user)
+			}
+		}(user)
+	}
+	wg.Wait()
+
+	require.Len(t, winners, 1)
+	assert.Len(t, owners, len(users)-1)
+	for _, o := range owners {
+		assert.Equal(t, winners[0], o)
+	}
+}
+
+func testStatusTransitions(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	order := Order(1)
+	require.NoError(t, repo.CreateOrder(ctx, order, token))
+
+	var use *repository.UnknownStatusError
+	assert.True(t, errors.As(repo.UpdateOrder(ctx, order, "LOST", 0), &use))
+
+	// REGISTERED ничего не меняет
+	require.NoError(t, repo.UpdateOrder(ctx, order, "REGISTERED", 0))
+	found, err := repo.FindOrderAccrual(ctx, order)
+	require.NoError(t, err)
+	assert.Equal(t, repository.StatusNew, found.Status)
+
+	require.NoError(t, repo.UpdateOrder(ctx, order, "PROCESSING", 0))
+	require.NoError(t, repo.UpdateOrder(ctx, order, "PROCESSED", money.FromInt(100)))
+
+	// повторный PROCESSED и откат в PROCESSING игнорируются, баллы начислены один раз
+	require.NoError(t, repo.UpdateOrder(ctx, order, "PROCESSED", money.FromInt(100)))
+	require.NoError(t, repo.UpdateOrder(ctx, order, "PROCESSING", 0))
+
+	found, err = repo.FindOrderAccrual(ctx, order)
+	require.NoError(t, err)
+	assert.Equal(t, repository.StatusProcessed, found.Status)
+	assert.Equal(t, money.FromInt(100), found.Accrual)
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromInt(100), balance.Current)
+
+	invalid := Order(2)
+	require.NoError(t, repo.CreateOrder(ctx, invalid, token))
+	require.NoError(t, repo.UpdateOrder(ctx, invalid, "INVALID", 0))
+	require.NoError(t, repo.UpdateOrder(ctx, invalid, "PROCESSED", money.FromInt(50)))
+
+	balance, err = repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromInt(100), balance.Current)
+
+	orders, _, err := repo.GetOrders(ctx, token, repository.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	assert.Equal(t, "PROCESSED", orders[0].Status)
+	assert.Equal(t, money.FromInt(100), orders[0].Accrual)
+	assert.Equal(t, "INVALID", orders[1].Status)
+}
+
+func testWithdrawals(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	var lpe *repository.LowPointsError
+	assert.True(t, errors.As(repo.SaveWithdraw(ctx, Order(1), money.FromInt(1), token, ""), &lpe))
+
+	fund(t, repo, token, money.MustParse("100.50"))
+
+	first := Order(2)
+	second := Order(3)
+
+	require.NoError(t, repo.SaveWithdraw(ctx, first, money.FromInt(40), token, ""))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, repo.SaveWithdraw(ctx, second, money.MustParse("60.50"), token, ""))
+
+	assert.True(t, errors.As(repo.SaveWithdraw(ctx, Order(4), money.MustParse("0.01"), token, ""), &lpe))
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, repository.Balance{Current: 0, Withdrawn: money.MustParse("100.50")}, *balance)
+
+	withdrawals, _, err := repo.GetWithdrawals(ctx, token, repository.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 2)
+	assert.Equal(t, first, withdrawals[0].OrderID)
+	assert.Equal(t, money.FromInt(40), withdrawals[0].Points)
+	assert.Equal(t, second, withdrawals[1].OrderID)
+
+	_, err = time.Parse(time.RFC3339, withdrawals[0].ProcessedAt)
+	assert.NoError(t, err)
+
+	withdrawals, _, err = repo.GetWithdrawals(ctx, User(t, repo), repository.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, withdrawals)
+}
+
+func testLists(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	var orders []string
+	for i := 0; i < 5; i++ {
+		order := Order(i)
+		require.NoError(t, repo.CreateOrder(ctx, order, token))
+		orders = append(orders, order)
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, repo.UpdateOrder(ctx, orders[1], "PROCESSED", money.FromInt(10)))
+	require.NoError(t, repo.UpdateOrder(ctx, orders[3], "PROCESSED", money.FromInt(20)))
+	require.NoError(t, repo.UpdateOrder(ctx, orders[4], "INVALID", 0))
+
+	// страницы по два заказа в обе стороны, курсор переживает кодирование в строку
+	page := func(desc bool) []string {
+		var got []string
+		opts := repository.ListOptions{Limit: 2, Desc: desc}
+
+		for pages := 0; pages < 5; pages++ {
+			items, next, err := repo.GetOrders(ctx, token, opts)
+			require.NoError(t, err)
+			for _, item := range items {
+				got = append(got, item.OrderID)
+			}
+
+			if next == nil {
+				assert.Len(t, items, 1)
+				return got
+			}
+			assert.Len(t, items, 2)
+
+			opts.After, err = repository.ParseCursor(next.String())
+			require.NoError(t, err)
+			require.NoError(t, opts.CheckCursor())
+		}
+
+		t.Fatal("pagination did not stop")
+		return nil
+	}
+
+	assert.Equal(t, orders, page(false))
+	assert.Equal(t, []string{orders[4], orders[3], orders[2], orders[1], orders[0]}, page(true))
+
+	items, next, err := repo.GetOrders(ctx, token, repository.ListOptions{Limit: 5})
+	require.NoError(t, err)
+	assert.Len(t, items, 5)
+	assert.Nil(t, next)
+
+	items, _, err = repo.GetOrders(ctx, token, repository.ListOptions{Statuses: []int{repository.StatusProcessed, repository.StatusInvalid}})
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	assert.Equal(t, orders[1], items[0].OrderID)
+	assert.Equal(t, orders[4], items[2].OrderID)
+
+	items, _, err = repo.GetOrders(ctx, token, repository.ListOptions{From: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, items)
+
+	items, _, err = repo.GetOrders(ctx, token, repository.ListOptions{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Len(t, items, 5)
+
+	items, _, err = repo.GetOrders(ctx, token, repository.ListOptions{To: time.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, items)
+
+	var withdrawn []string
+	for i := 5; i < 8; i++ {
+		order := Order(i)
+		require.NoError(t, repo.SaveWithdraw(ctx, order, money.FromInt(1), token, ""))
+		withdrawn = append(withdrawn, order)
+		time.Sleep(time.Millisecond)
+	}
+
+	withdrawals, next, err := repo.GetWithdrawals(ctx, token, repository.ListOptions{Limit: 2, Desc: true})
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 2)
+	require.NotNil(t, next)
+	assert.Equal(t, withdrawn[2], withdrawals[0].OrderID)
+	assert.Equal(t, withdrawn[1], withdrawals[1].OrderID)
+
+	withdrawals, next, err = repo.GetWithdrawals(ctx, token, repository.ListOptions{Limit: 2, Desc: true, After: next})
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 1)
+	assert.Nil(t, next)
+	assert.Equal(t, withdrawn[0], withdrawals[0].OrderID)
+}
+
+func testStatement(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	first := Order(1)
+	require.NoError(t, repo.CreateOrder(ctx, first, token))
+	require.NoError(t, repo.UpdateOrder(ctx, first, "PROCESSED", money.FromInt(100)))
+	time.Sleep(time.Millisecond)
+
+	// в выписку попадают только проведённые движения баллов
+	require.NoError(t, repo.CreateOrder(ctx, Order(2), token))
+	invalid := Order(3)
+	require.NoError(t, repo.CreateOrder(ctx, invalid, token))
+	require.NoError(t, repo.UpdateOrder(ctx, invalid, "INVALID", 0))
+
+	withdrawn := Order(4)
+	require.NoError(t, repo.SaveWithdraw(ctx, withdrawn, money.MustParse("30.25"), token, ""))
+	time.Sleep(time.Millisecond)
+
+	second := Order(5)
+	require.NoError(t, repo.CreateOrder(ctx, second, token))
+	require.NoError(t, repo.UpdateOrder(ctx, second, "PROCESSED", money.FromInt(50)))
+
+	entries, err := repo.GetStatement(ctx, token, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, repository.StatementEntry{ProcessedAt: entries[0].ProcessedAt, OrderID: first, Type: repository.EntryAccrual, Amount: money.FromInt(100), Balance: money.FromInt(100)}, entries[0])
+	assert.Equal(t, repository.StatementEntry{ProcessedAt: entries[1].ProcessedAt, OrderID: withdrawn, Type: repository.EntryWithdrawal, Amount: money.MustParse("-30.25"), Balance: money.MustParse("69.75")}, entries[1])
+	assert.Equal(t, repository.StatementEntry{ProcessedAt: entries[2].ProcessedAt, OrderID: second, Type: repository.EntryAccrual, Amount: money.FromInt(50), Balance: money.MustParse("119.75")}, entries[2])
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, balance.Current, entries[2].Balance)
+
+	// период отбирает строки, но баланс остаётся накопленным с начала истории
+	from, err := time.Parse(time.RFC3339Nano, entries[1].ProcessedAt)
+	require.NoError(t, err)
+	to, err := time.Parse(time.RFC3339Nano, entries[2].ProcessedAt)
+	require.NoError(t, err)
+
+	period, err := repo.GetStatement(ctx, token, from, to)
+	require.NoError(t, err)
+	require.Len(t, period, 1)
+	assert.Equal(t, entries[1], period[0])
+
+	period, err = repo.GetStatement(ctx, User(t, repo), time.Time{}, time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, period)
+}
+
+// согласованный баланс не попадает в отчёт
+func testReconcile(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	fund(t, repo, token, money.FromInt(100))
+	require.NoError(t, repo.SaveWithdraw(ctx, Order(1), money.MustParse("12.34"), token, ""))
+
+	invalid := Order(2)
+	require.NoError(t, repo.CreateOrder(ctx, invalid, token))
+	require.NoError(t, repo.UpdateOrder(ctx, invalid, "INVALID", 0))
+
+	for _, repair := range []bool{false, true} {
+		mismatches, err := repo.Reconcile(ctx, repair)
+		require.NoError(t, err)
+
+		for _, m := range mismatches {
+			assert.NotEqual(t, token, m.UserToken)
+		}
+	}
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, repository.Balance{Current: money.MustParse("87.66"), Withdrawn: money.MustParse("12.34")}, *balance)
+}
+
+// mismatch ищет в отчёте сверки пользователя token: в общей БД могут быть чужие расхождения
+func mismatch(t *testing.T, repo repository.Repositorier, token string, repair bool) *repository.BalanceMismatch {
+	mismatches, err := repo.Reconcile(context.Background(), repair)
+	require.NoError(t, err)
+
+	for _, m := range mismatches {
+		if m.UserToken == token {
+			return &m
+		}
+	}
+	return nil
+}
+
+func testReconcileMismatch(t *testing.T, repo repository.Repositorier, setBalance SetBalance) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	order := Order(1)
+	require.NoError(t, repo.CreateOrder(ctx, order, token))
+	require.NoError(t, repo.UpdateOrder(ctx, order, "PROCESSED", money.FromInt(100)))
+	require.NoError(t, repo.SaveWithdraw(ctx, Order(2), money.MustParse("30.5"), token, ""))
+
+	// баланс разошёлся с транзакциями в обход репозитория
+	setBalance(t, repo, token, money.FromInt(500), 0)
+
+	expected := repository.BalanceMismatch{
+		UserToken:       token,
+		Balance:         money.FromInt(500),
+		Withdrawn:       0,
+		LedgerBalance:   money.MustParse("69.5"),
+		LedgerWithdrawn: money.MustParse("30.5"),
+	}
+
+	assert.Equal(t, &expected, mismatch(t, repo, token, false))
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromInt(500), balance.Current)
+
+	expected.Repaired = true
+	assert.Equal(t, &expected, mismatch(t, repo, token, true))
+	assert.Nil(t, mismatch(t, repo, token, false))
+
+	balance, err = repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, repository.Balance{Current: money.MustParse("69.5"), Withdrawn: money.MustParse("30.5")}, *balance)
+}
+
+func testExpiration(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	old := Order(1)
+	require.NoError(t, repo.CreateOrder(ctx, old, token))
+	require.NoError(t, repo.UpdateOrder(ctx, old, "PROCESSED", money.FromInt(100)))
+	time.Sleep(2 * time.Millisecond)
+
+	cutoff := time.Now()
+	time.Sleep(2 * time.Millisecond)
+
+	fresh := Order(2)
+	require.NoError(t, repo.CreateOrder(ctx, fresh, token))
+	require.NoError(t, repo.UpdateOrder(ctx, fresh, "PROCESSED", money.FromInt(50)))
+
+	// списание расходует старую партию первой, сгорает только её остаток
+	require.NoError(t, repo.SaveWithdraw(ctx, Order(3), money.FromInt(30), token, ""))
+
+	tokens, err := repo.UsersWithExpiringPoints(ctx, cutoff, "", 1000000)
+	require.NoError(t, err)
+	assert.Contains(t, tokens, token)
+	assert.True(t, sort.StringsAreSorted(tokens))
+
+	// after отсекает уже пройденных пользователей
+	tokens, err = repo.UsersWithExpiringPoints(ctx, cutoff, token, 1000000)
+	require.NoError(t, err)
+	assert.NotContains(t, tokens, token)
+
+	expired, err := repo.ExpirePoints(ctx, token, cutoff)
+	require.NoError(t, err)
+	assert.Equal(t, []repository.ExpiredLot{{UserToken: token, OrderID: old, Points: money.FromInt(70)}}, expired)
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, repository.Balance{Current: money.FromInt(50), Withdrawn: money.FromInt(30)}, *balance)
+
+	// повтор задания ничего не сжигает второй раз
+	expired, err = repo.ExpirePoints(ctx, token, cutoff)
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	tokens, err = repo.UsersWithExpiringPoints(ctx, cutoff, "", 1000000)
+	require.NoError(t, err)
+	assert.NotContains(t, tokens, token)
+
+	entries, err := repo.GetStatement(ctx, token, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.Equal(t, repository.EntryExpiration, entries[3].Type)
+	assert.Equal(t, old, entries[3].OrderID)
+	assert.Equal(t, money.FromInt(-70), entries[3].Amount)
+	assert.Equal(t, money.FromInt(50), entries[3].Balance)
+
+	mismatches, err := repo.Reconcile(ctx, false)
+	require.NoError(t, err)
+	for _, m := range mismatches {
+		assert.NotEqual(t, token, m.UserToken)
+	}
+
+	var lpe *repository.LowPointsError
+	assert.True(t, errors.As(repo.SaveWithdraw(ctx, Order(4), money.FromInt(51), token, ""), &lpe))
+	require.NoError(t, repo.SaveWithdraw(ctx, Order(5), money.FromInt(50), token, ""))
+
+	// свежая партия тоже сгорает, когда срок подходит, но от неё ничего не осталось
+	expired, err = repo.ExpirePoints(ctx, token, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	tokens, err = repo.UsersWithExpiringPoints(ctx, time.Now().Add(time.Hour), "", 1000000)
+	require.NoError(t, err)
+	assert.NotContains(t, tokens, token)
+}
+
+func testExpirationLowBalance(t *testing.T, repo repository.Repositorier, setBalance SetBalance) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	order := Order(1)
+	require.NoError(t, repo.CreateOrder(ctx, order, token))
+	require.NoError(t, repo.UpdateOrder(ctx, order, "PROCESSED", money.FromInt(100)))
+
+	// баланс меньше партии, которой пора сгорать
+	setBalance(t, repo, token, money.FromInt(40), 0)
+
+	expired, err := repo.ExpirePoints(ctx, token, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromInt(40), balance.Current)
+
+	// партия не помечена сгоревшей, пока расхождение не исправят
+	tokens, err := repo.UsersWithExpiringPoints(ctx, time.Now().Add(time.Hour), "", 1000000)
+	require.NoError(t, err)
+	assert.Contains(t, tokens, token)
+
+	require.NotNil(t, mismatch(t, repo, token, true))
+
+	expired, err = repo.ExpirePoints(ctx, token, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []repository.ExpiredLot{{UserToken: token, OrderID: order, Points: money.FromInt(100)}}, expired)
+
+	balance, err = repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Zero(t, balance.Current)
+}
+
+func testConcurrentWithdrawals(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+	fund(t, repo, token, money.FromInt(100))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	withdrawn := 0
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			err := repo.SaveWithdraw(ctx, Order(i), money.FromInt(10), token, "")
+
+			var lpe *repository.LowPointsError
+			if errors.As(err, &lpe) {
+				return
+			}
+
+			if assert.NoError(t, err) {
+				mu.Lock()
+				withdrawn++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 10, withdrawn)
+
+	balance, err := repo.GetBalance(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, repository.Balance{Current: 0, Withdrawn: money.FromInt(100)}, *balance)
+}
+
+func testIdempotentWithdrawals(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+	fund(t, repo, token, money.FromInt(100))
+
+	balance := func() repository.Balance {
+		b, err := repo.GetBalance(ctx, token)
+		require.NoError(t, err)
+		return *b
+	}
+
+	var wce *repository.WithdrawConflictError
+
+	// повтор того же списания ничего не списывает
+	order := Order(1)
+	require.NoError(t, repo.SaveWithdraw(ctx, order, money.FromInt(10), token, ""))
+	require.NoError(t, repo.SaveWithdraw(ctx, order, money.FromInt(10), token, ""))
+	assert.Equal(t, money.FromInt(90), balance().Current)
+
+	// тот же заказ с другой суммой или от другого пользователя — конфликт
+	assert.True(t, errors.As(repo.SaveWithdraw(ctx, order, money.FromInt(20), token, ""), &wce))
+	assert.Equal(t, order, wce.OrderID)
+
+	other := User(t, repo)
+	fund(t, repo, other, money.FromInt(100))
+	assert.True(t, errors.As(repo.SaveWithdraw(ctx, order, money.FromInt(10), other, ""), &wce))
+
+	// повтор по ключу идемпотентности
+	key := unique("key_")
+	keyed := Order(2)
+	require.NoError(t, repo.SaveWithdraw(ctx, keyed, money.FromInt(5), token, key))
+	require.NoError(t, repo.SaveWithdraw(ctx, keyed, money.FromInt(5), token, key))
+	assert.Equal(t, money.FromInt(85), balance().Current)
+
+	// ключ уже использован для другого заказа
+	require.True(t, errors.As(repo.SaveWithdraw(ctx, Order(3), money.FromInt(5), token, key), &wce))
+	assert.Equal(t, key, wce.IdempotencyKey)
+
+	// ключи у каждого пользователя свои
+	require.NoError(t, repo.SaveWithdraw(ctx, Order(4), money.FromInt(5), other, key))
+
+	// параллельные повторы одного запроса списывают один раз
+	parallel := Order(5)
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, repo.SaveWithdraw(ctx, parallel, money.FromInt(10), token, ""))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, repository.Balance{Current: money.FromInt(75), Withdrawn: money.FromInt(25)}, balance())
+
+	withdrawals, _, err := repo.GetWithdrawals(ctx, token, repository.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, withdrawals, 3)
+
+	// списание без баллов откатывается и не должно ни занять заказ, ни обернуться внутренней ошибкой
+	// у того, кто столкнулся с ним на вставке
+	poor := User(t, repo)
+
+	for i := 0; i < 5; i++ {
+		contested := Order(10 + i)
+		var poorErr error
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			poorErr = repo.SaveWithdraw(ctx, contested, money.FromInt(1), poor, key)
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, repo.SaveWithdraw(ctx, contested, money.FromInt(1), other, ""))
+		}()
+		wg.Wait()
+
+		var lpe *repository.LowPointsError
+		assert.True(t, errors.As(poorErr, &lpe) || errors.As(poorErr, &wce), "%T: %v", poorErr, poorErr)
+	}
+
+	otherBalance, err := repo.GetBalance(ctx, other)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromInt(90), otherBalance.Current)
+}
+
+func testQueue(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	order := Order(1)
+	require.NoError(t, repo.CreateOrder(ctx, order, token))
+
+	// очередь общая: ищем свой заказ среди взятых
+	claim := func() *repository.QueuedOrder {
+		orders, err := repo.ClaimOrders(ctx, 1000, time.Hour)
+		require.NoError(t, err)
+
+		for _, queued := range orders {
+			if queued.OrderID == order {
+				return &queued
+			}
+		}
+		return nil
+	}
+
+	claimed := claim()
+	require.NotNil(t, claimed)
+	assert.Equal(t, token, claimed.UserToken)
+	assert.Equal(t, 1, claimed.Attempts)
+
+	// взятый заказ не выдаётся повторно до конца аренды
+	assert.Nil(t, claim())
+
+	require.NoError(t, repo.RescheduleOrder(ctx, order, 1, "PROCESSING", 0))
+
+	claimed = claim()
+	require.NotNil(t, claimed)
+	assert.Equal(t, 2, claimed.Attempts)
+	assert.Equal(t, "PROCESSING", claimed.AccrualStatus)
+
+	// обработчик первой попытки опоздал: заказ уже взят заново, его результат не применяется
+	var lle *repository.LeaseLostError
+	assert.True(t, errors.As(repo.RescheduleOrder(ctx, order, 1, "REGISTERED", time.Hour), &lle))
+	assert.True(t, errors.As(repo.DequeueOrder(ctx, order, 1), &lle))
+
+	// пустой статус не затирает последний известный
+	require.NoError(t, repo.RescheduleOrder(ctx, order, 2, "", 0))
+
+	claimed = claim()
+	require.NotNil(t, claimed)
+	assert.Equal(t, "PROCESSING", claimed.AccrualStatus)
+
+	require.NoError(t, repo.DequeueOrder(ctx, order, 3))
+	assert.True(t, errors.As(repo.RescheduleOrder(ctx, order, 3, "", 0), &lle))
+	assert.Nil(t, claim())
+
+	// незавершённый заказ возвращается в очередь, обработанный — нет
+	done := Order(2)
+	require.NoError(t, repo.CreateOrder(ctx, done, token))
+	require.NoError(t, repo.UpdateOrder(ctx, done, "PROCESSED", money.FromInt(1)))
+	require.NoError(t, repo.DequeueOrder(ctx, done, 0))
+
+	recovered, err := repo.RecoverOrders(ctx)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, recovered, int64(1))
+
+	claimed = claim()
+	require.NotNil(t, claimed)
+	assert.Equal(t, 1, claimed.Attempts)
+
+	require.NoError(t, repo.DequeueOrder(ctx, order, 1))
+}
+
+func testSessions(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	id := unique("session_")
+	require.NoError(t, repo.CreateSession(ctx, id, token, time.Now().Add(time.Hour), unique("hash_")))
+
+	session, err := repo.FindSession(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, token, session.UserToken)
+	assert.True(t, session.Active(time.Now()))
+
+	_, err = repo.FindSession(ctx, unique("missing_"))
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	require.NoError(t, repo.RevokeSession(ctx, id))
+
+	session, err = repo.FindSession(ctx, id)
+	require.NoError(t, err)
+	require.NotNil(t, session.RevokedAt)
+	revokedAt := *session.RevokedAt
+
+	// повторный отзыв не сдвигает время
+	require.NoError(t, repo.RevokeSession(ctx, id))
+	session, err = repo.FindSession(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, revokedAt.Equal(*session.RevokedAt))
+
+	other := unique("session_")
+	expired := unique("session_")
+	require.NoError(t, repo.CreateSession(ctx, other, token, time.Now().Add(time.Hour), unique("hash_")))
+	require.NoError(t, repo.CreateSession(ctx, expired, token, time.Now().Add(-time.Minute), unique("hash_")))
+
+	revoked, err := repo.RevokeUserSessions(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), revoked)
+
+	session, err = repo.FindSession(ctx, other)
+	require.NoError(t, err)
+	assert.False(t, session.Active(time.Now()))
+}
+
+func testRefreshTokens(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	token := User(t, repo)
+
+	id := unique("session_")
+	first := unique("hash_")
+	require.NoError(t, repo.CreateSession(ctx, id, token, time.Now().Add(time.Hour), first))
+
+	second := unique("hash_")
+	session, err := repo.RotateRefreshToken(ctx, first, second)
+	require.NoError(t, err)
+	assert.Equal(t, id, session.ID)
+	assert.Equal(t, token, session.UserToken)
+
+	var rte *repository.RefreshTokenError
+	_, err = repo.RotateRefreshToken(ctx, unique("unknown_"), unique("hash_"))
+	assert.True(t, errors.As(err, &rte), "got %v", err)
+
+	// повторное предъявление гасит всю сессию
+	var rtre *repository.RefreshTokenReuseError
+	_, err = repo.RotateRefreshToken(ctx, first, unique("hash_"))
+	require.True(t, errors.As(err, &rtre), "got %v", err)
+	assert.Equal(t, id, rtre.SessionID)
+
+	_, err = repo.RotateRefreshToken(ctx, second, unique("hash_"))
+	assert.True(t, errors.As(err, &rte), "got %v", err)
+
+	session, err = repo.FindSession(ctx, id)
+	require.NoError(t, err)
+	assert.False(t, session.Active(time.Now()))
+}
+
+func testLoginAttempts(t *testing.T, repo repository.Repositorier) {
+	ctx := context.Background()
+	key := unique("login:")
+	now := time.Now()
+
+	failures, lockedUntil, err := repo.LoginAttempts(ctx, key)
+	require.NoError(t, err)
+	assert.Zero(t, failures)
+	assert.True(t, lockedUntil.IsZero())
+
+	for i := 1; i <= 3; i++ {
+		failures, err = repo.AddLoginFailure(ctx, key, now, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, i, failures)
+	}
+
+	// после окна счёт начинается заново
+	failures, err = repo.AddLoginFailure(ctx, key, now.Add(2*time.Hour), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+
+	until := now.Add(time.Minute).Truncate(time.Microsecond)
+	require.NoError(t, repo.LockLogin(ctx, key, until))
+
+	// более короткая блокировка не сокращает действующую
+	require.NoError(t, repo.LockLogin(ctx, key, now))
+
+	failures, lockedUntil, err = repo.LoginAttempts(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+	assert.True(t, until.Equal(lockedUntil), "%v != %v", until, lockedUntil)
+
+	require.NoError(t, repo.ResetLoginAttempts(ctx, key))
+
+	failures, lockedUntil, err = repo.LoginAttempts(ctx, key)
+	require.NoError(t, err)
+	assert.Zero(t, failures)
+	assert.True(t, lockedUntil.IsZero())
+}
@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"time"
+)
+
+const (
+	EntryAccrual    = "accrual"
+	EntryWithdrawal = "withdrawal"
+	EntryExpiration = "expiration"
+)
+
+// StatementEntry — строка выписки: начисление (Amount > 0), списание или сгорание баллов
+// (Amount < 0) и баланс сразу после неё.
+type StatementEntry struct {
+	ProcessedAt string       `json:"processed_at"`
+	OrderID     string       `json:"order"`
+	Type        string       `json:"type"`
+	Amount      money.Amount `json:"amount"`
+	Balance     money.Amount `json:"balance"`
+}
+
+// GetStatement возвращает выписку по проведённым начислениям, списаниям и сгораниям в порядке проведения.
+// Баланс считается по всей истории, а период [from, to) только отбирает строки,
+// поэтому первая строка выписки показывает настоящий баланс, а не сумму с начала периода.
+func (r *Repo) GetStatement(ctx context.Context, userToken string, from time.Time, to time.Time) ([]StatementEntry, error) {
+
+	var entries []StatementEntry
+
+	args := []interface{}{userToken, TypeAccrual, TypeWithdraw, StatusProcessed, TypeExpiration}
+	query := `SELECT order_id, type, points, processed_at, balance FROM (
+		SELECT id, order_id, type, points, processed_at,
+			SUM(CASE WHEN type = $2 THEN points ELSE -points END) OVER (ORDER BY processed_at, id) AS balance
+		FROM transactions
+		WHERE user_token = $1 AND type IN ($2, $3, $5) AND status = $4 AND points > 0
+	) ledger WHERE true`
+
+	if !from.IsZero() {
+		args = append(args, from)
+		query += fmt.Sprintf(" AND processed_at >= $%d", len(args))
+	}
+
+	if !to.IsZero() {
+		args = append(args, to)
+		query += fmt.Sprintf(" AND processed_at < $%d", len(args))
+	}
+
+	query += " ORDER BY processed_at, id"
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry StatementEntry
+		var kind int
+		var processedAt time.Time
+
+		err = rows.Scan(&entry.OrderID, &kind, &entry.Amount, &processedAt, &entry.Balance)
+		if err != nil {
+			return entries, err
+		}
+
+		entry.ProcessedAt = processedAt.Format(time.RFC3339Nano)
+		entry.Type = EntryAccrual
+
+		switch kind {
+		case TypeWithdraw:
+			entry.Type = EntryWithdrawal
+			entry.Amount = -entry.Amount
+		case TypeExpiration:
+			entry.Type = EntryExpiration
+			entry.Amount = -entry.Amount
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
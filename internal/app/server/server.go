@@ -4,12 +4,12 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"database/sql"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/auth"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/handlers"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/poller"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/throttle"
 	"github.com/DatDomrachev/go-loyalty-system/internal/app/wpool"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -32,6 +32,10 @@ type srv struct {
 	AccrualURL string
 	repo       repository.Repositorier
 	wp         wpool.WorkerPooler
+	poller     *poller.Poller
+	sessions   handlers.Sessions
+	guard      *throttle.Guard
+	trustProxy bool
 }
 
 type gzipWriter struct {
@@ -43,12 +47,16 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
-func New(address string, AccrualURL string, repo repository.Repositorier, wp wpool.WorkerPooler) *srv {
+func New(address string, AccrualURL string, repo repository.Repositorier, wp wpool.WorkerPooler, p *poller.Poller, sessions handlers.Sessions, guard *throttle.Guard, trustProxy bool) *srv {
 	server := &srv{
 		address:    address,
 		AccrualURL: AccrualURL,
 		repo:       repo,
 		wp:         wp,
+		poller:     p,
+		sessions:   sessions,
+		guard:      guard,
+		trustProxy: trustProxy,
 	}
 
 	return server
@@ -59,6 +67,7 @@ func (s *srv) Run(ctx context.Context) (err error) {
 	ctx, cancel := context.WithCancel(ctx)
 
 	go s.wp.Run(ctx)
+	go s.poller.Run(ctx)
 
 	router := s.ConfigureRouter()
 	serv := &http.Server{
@@ -96,20 +105,39 @@ func (s *srv) Run(ctx context.Context) (err error) {
 func (s *srv) ConfigureRouter() *chi.Mux {
 	router := chi.NewRouter()
 
+	// адрес клиента из X-Forwarded-For/X-Real-IP, только если перед сервисом стоит свой прокси
+	if s.trustProxy {
+		router.Use(middleware.RealIP)
+	}
+
 	router.Use(middleware.Logger)
 	router.Use(GzipHandle)
 	router.Group(func(router chi.Router) {
 		router.Post("/api/user/register", func(rw http.ResponseWriter, r *http.Request) {
-			handlers.RegisterHandler(s.repo)(rw, r)
+			handlers.RegisterHandler(s.repo, s.sessions)(rw, r)
 		})
 
 		router.Post("/api/user/login", func(rw http.ResponseWriter, r *http.Request) {
-			handlers.LoginHandler(s.repo)(rw, r)
+			handlers.LoginHandler(s.repo, s.sessions, s.guard)(rw, r)
+		})
+
+		router.Post("/api/user/token/refresh", func(rw http.ResponseWriter, r *http.Request) {
+			handlers.RefreshHandler(s.repo, s.sessions)(rw, r)
 		})
 	})
 
 	router.Group(func(router chi.Router) {
-		router.Use(CheckUser)
+		router.Use(CheckUser(s.sessions.Keys, s.repo))
+
+		router.Post("/api/user/logout", func(rw http.ResponseWriter, r *http.Request) {
+			id := r.Context().Value(contextKey("session_id")).(string)
+			handlers.LogoutHandler(s.repo, id)(rw, r)
+		})
+
+		router.Post("/api/user/logout/all", func(rw http.ResponseWriter, r *http.Request) {
+			u := r.Context().Value(contextKey("user_token")).(string)
+			handlers.LogoutAllHandler(s.repo, u)(rw, r)
+		})
 
 		router.Get("/api/user/balance", func(rw http.ResponseWriter, r *http.Request) {
 			u := r.Context().Value(contextKey("user_token")).(string)
@@ -126,6 +154,11 @@ func (s *srv) ConfigureRouter() *chi.Mux {
 			handlers.OrderListHandler(s.repo, u)(rw, r)
 		})
 
+		router.Get("/api/user/statement", func(rw http.ResponseWriter, r *http.Request) {
+			u := r.Context().Value(contextKey("user_token")).(string)
+			handlers.StatementHandler(s.repo, u)(rw, r)
+		})
+
 		router.Post("/api/user/balance/withdraw", func(rw http.ResponseWriter, r *http.Request) {
 			u := r.Context().Value(contextKey("user_token")).(string)
 			handlers.WithdrawHandler(s.repo, u)(rw, r)
@@ -133,7 +166,7 @@ func (s *srv) ConfigureRouter() *chi.Mux {
 
 		router.Post("/api/user/orders", func(rw http.ResponseWriter, r *http.Request) {
 			u := r.Context().Value(contextKey("user_token")).(string)
-			handlers.OrderHandler(s.repo, s.wp, s.AccrualURL, u)(rw, r)
+			handlers.OrderHandler(s.repo, u)(rw, r)
 		})
 
 	})
@@ -149,18 +182,11 @@ func GzipHandle(next http.Handler) http.Handler {
 			return
 		}
 
-		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
-		if err != nil {
-			io.WriteString(w, err.Error())
-			return
-		}
-		defer gz.Close()
-
 		if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
 			reader, err := gzip.NewReader(r.Body)
 
 			if err != nil {
-				io.WriteString(w, err.Error())
+				handlers.WriteError(w, http.StatusBadRequest, handlers.ErrorData{Code: handlers.CodeBadRequest, Message: "request body is not valid gzip"})
 				return
 			}
 
@@ -169,47 +195,91 @@ func GzipHandle(next http.Handler) http.Handler {
 			b, err := ioutil.ReadAll(reader)
 
 			if err != nil {
-				io.WriteString(w, err.Error())
+				handlers.WriteError(w, http.StatusBadRequest, handlers.ErrorData{Code: handlers.CodeBadRequest, Message: "request body is not valid gzip"})
 				return
 			}
 
 			r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
 		}
 
+		// ответ сжимаем только после того, как тело запроса прочитано: ошибку выше клиент получит несжатой
+		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+		if err != nil {
+			handlers.WriteError(w, http.StatusInternalServerError, handlers.ErrorData{Code: handlers.CodeInternal, Message: "internal server error"})
+			return
+		}
+		defer gz.Close()
+
 		w.Header().Set("Content-Encoding", "gzip")
 		next.ServeHTTP(gzipWriter{ResponseWriter: w, Writer: gz}, r)
 	})
 }
 
-func CheckUser(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+var unauthorized = handlers.ErrorData{Code: handlers.CodeUnauthorized, Message: "authentication required"}
 
-		cookie, err := r.Cookie("user_token")
+// requestToken берёт токен из Authorization: Bearer, а если заголовка нет — из cookie
+func requestToken(r *http.Request) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		const prefix = "bearer "
 
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+		if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+			return "", false
 		}
 
-		userKey := cookie.Value
+		return strings.TrimSpace(header[len(prefix):]), true
+	}
 
-		data, err := hex.DecodeString(userKey)
+	cookie, err := r.Cookie("user_token")
 
-		if err != nil {
-			log.Fatalf("CookieRead error:%+v", err)
-		}
+	if err != nil {
+		return "", false
+	}
 
-		h := hmac.New(sha256.New, auth.SecretKey)
-		h.Write(data[:8])
-		sign := h.Sum(nil)
+	return cookie.Value, true
+}
 
-		if !hmac.Equal(sign, data[8:]) {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+// CheckUser пропускает запрос, только если токен подписан известным ключом,
+// а его сессия есть в БД, не истекла и не отозвана.
+func CheckUser(keys *auth.KeyRing, repo repository.Repositorier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		ctx := context.WithValue(r.Context(), contextKey("user_token"), cookie.Value)
+			token, ok := requestToken(r)
 
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+			if !ok {
+				handlers.WriteError(w, http.StatusUnauthorized, unauthorized)
+				return
+			}
+
+			claims, err := keys.Verify(token)
+
+			if err != nil {
+				handlers.WriteError(w, http.StatusUnauthorized, unauthorized)
+				return
+			}
+
+			session, err := repo.FindSession(r.Context(), claims.SessionID)
+
+			if err == sql.ErrNoRows {
+				handlers.WriteError(w, http.StatusUnauthorized, unauthorized)
+				return
+			}
+
+			if err != nil {
+				log.Printf("unable to find session: %v", err)
+				handlers.WriteError(w, http.StatusInternalServerError, handlers.ErrorData{Code: handlers.CodeInternal, Message: "internal server error"})
+				return
+			}
+
+			if !session.Active(time.Now()) || session.UserToken != claims.UserToken {
+				handlers.WriteError(w, http.StatusUnauthorized, unauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), contextKey("user_token"), session.UserToken)
+			ctx = context.WithValue(ctx, contextKey("session_id"), session.ID)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
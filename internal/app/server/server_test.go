@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/auth"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		token  string
+		ok     bool
+	}{
+		{name: "bearer", header: "Bearer abc.def.ghi", token: "abc.def.ghi", ok: true},
+		{name: "bearer lowercase", header: "bearer abc.def.ghi", token: "abc.def.ghi", ok: true},
+		{name: "cookie", cookie: "abc.def.ghi", token: "abc.def.ghi", ok: true},
+		{name: "header wins", header: "Bearer from-header", cookie: "from-cookie", token: "from-header", ok: true},
+		{name: "other scheme", header: "Basic dXNlcjpwYXNz", cookie: "from-cookie", ok: false},
+		{name: "empty bearer", header: "Bearer ", ok: false},
+		{name: "nothing", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: "user_token", Value: tt.cookie})
+			}
+
+			token, ok := requestToken(r)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.token, token)
+		})
+	}
+}
+
+// noSessions: до поиска сессии мусорные токены дойти не должны
+type noSessions struct {
+	repository.Repositorier
+}
+
+func (noSessions) FindSession(ctx context.Context, id string) (*repository.Session, error) {
+	return nil, sql.ErrNoRows
+}
+
+func TestCheckUser_Malformed(t *testing.T) {
+	keys, _, err := auth.Load("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := CheckUser(keys, noSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("request %v passed CheckUser", r.Header)
+	}))
+
+	values := []string{
+		"",
+		"zz",
+		"01",
+		"0100000000000000" + strings.Repeat("ab", 32),
+		"a.b.c",
+		"Bearer ",
+		"..",
+		strings.Repeat(".", 10),
+		"eyJhbGciOiJIUzI1NiJ9..",
+		"eyJhbGciOiJub25lIn0.e30.",
+		strings.Repeat("a", 10000),
+		"\x00\xff",
+	}
+
+	for _, value := range values {
+		for _, set := range []func(r *http.Request){
+			func(r *http.Request) { r.Header.Set("Cookie", "user_token="+value) },
+			func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+value) },
+			func(r *http.Request) { r.Header.Set("Authorization", value) },
+		} {
+			r := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			set(r)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusUnauthorized, w.Code, "%q", value)
+		}
+	}
+}
+
+func TestCheckUser_Random(t *testing.T) {
+	keys, _, err := auth.Load("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// подписанный токен доходит до поиска сессии, но сессии нет, так что и он не должен пройти
+	now := time.Now()
+	valid, err := keys.Sign(auth.Claims{SessionID: "session", UserToken: "user", IssuedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := CheckUser(keys, noSessions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatalf("request %v passed CheckUser", r.Header)
+	}))
+
+	seed := time.Now().UnixNano()
+	t.Logf("seed %v", seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	for i := 0; i < 5000; i++ {
+		var b []byte
+
+		if rnd.Intn(2) == 0 {
+			b = make([]byte, rnd.Intn(2*len(valid)))
+			rnd.Read(b)
+		} else {
+			b = []byte(valid)
+			for k := rnd.Intn(4) + 1; k > 0; k-- {
+				b[rnd.Intn(len(b))] = byte(rnd.Intn(256))
+			}
+		}
+		value := string(b)
+
+		for _, set := range []func(r *http.Request){
+			func(r *http.Request) { r.Header.Set("Cookie", "user_token="+value) },
+			func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+value) },
+			func(r *http.Request) { r.Header.Set("Authorization", value) },
+		} {
+			r := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			set(r)
+
+			w := httptest.NewRecorder()
+			func() {
+				defer func() {
+					if p := recover(); p != nil {
+						t.Fatalf("seed %v: CheckUser panicked on %q: %v", seed, value, p)
+					}
+				}()
+				handler.ServeHTTP(w, r)
+			}()
+
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("seed %v: got %v for %q", seed, w.Code, value)
+			}
+		}
+	}
+}
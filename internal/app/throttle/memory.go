@@ -0,0 +1,103 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepEvery — как часто Memory выбрасывает забытые записи, чтобы перебор случайных логинов
+// не раздувал карту бесконечно.
+const sweepEvery = 1024
+
+type attempt struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	window      time.Duration
+}
+
+// Memory — Store в памяти процесса; годится, когда сервис запущен в одном экземпляре.
+type Memory struct {
+	mu       sync.Mutex
+	attempts map[string]*attempt
+	added    int
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		attempts: make(map[string]*attempt),
+	}
+}
+
+func (m *Memory) LoginAttempts(ctx context.Context, key string) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attempts[key]
+	if !ok {
+		return 0, time.Time{}, nil
+	}
+
+	return a.failures, a.lockedUntil, nil
+}
+
+func (m *Memory) AddLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.added++
+	if m.added%sweepEvery == 0 {
+		m.sweep(now)
+	}
+
+	a, ok := m.attempts[key]
+	if !ok {
+		a = &attempt{}
+		m.attempts[key] = a
+	}
+
+	if a.lastFailure.Before(now.Add(-window)) {
+		a.failures = 0
+	}
+
+	a.failures++
+	a.lastFailure = now
+	a.window = window
+
+	return a.failures, nil
+}
+
+func (m *Memory) LockLogin(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attempts[key]
+	if !ok {
+		a = &attempt{}
+		m.attempts[key] = a
+	}
+
+	if until.After(a.lockedUntil) {
+		a.lockedUntil = until
+	}
+
+	return nil
+}
+
+func (m *Memory) ResetLoginAttempts(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, key)
+
+	return nil
+}
+
+func (m *Memory) sweep(now time.Time) {
+	for key, a := range m.attempts {
+		if a.lastFailure.Before(now.Add(-a.window)) && a.lockedUntil.Before(now) {
+			delete(m.attempts, key)
+		}
+	}
+}
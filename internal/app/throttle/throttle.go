@@ -0,0 +1,153 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Store хранит неудачные попытки по ключу ("login:<логин>", "ip:<адрес>").
+// Реализации: Memory для одного экземпляра и repository.Repo, общий для всех экземпляров.
+type Store interface {
+	LoginAttempts(ctx context.Context, key string) (failures int, lockedUntil time.Time, err error)
+	// AddLoginFailure учитывает попытку и возвращает число неудач подряд; если прошлая неудача
+	// была раньше now-window, счёт начинается заново.
+	AddLoginFailure(ctx context.Context, key string, now time.Time, window time.Duration) (int, error)
+	// LockLogin блокирует ключ до until; более ранний срок не сокращает уже выставленный.
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	ResetLoginAttempts(ctx context.Context, key string) error
+}
+
+// Policy: после MaxFailures неудач подряд ключ блокируется на BaseLockout,
+// каждая следующая неудача удваивает срок, но не больше MaxLockout.
+type Policy struct {
+	MaxFailures int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	Window      time.Duration
+}
+
+var DefaultLoginPolicy = Policy{
+	MaxFailures: 5,
+	BaseLockout: 30 * time.Second,
+	MaxLockout:  time.Hour,
+	Window:      24 * time.Hour,
+}
+
+// DefaultIPPolicy мягче: за одним адресом может быть много пользователей.
+var DefaultIPPolicy = Policy{
+	MaxFailures: 50,
+	BaseLockout: 30 * time.Second,
+	MaxLockout:  time.Hour,
+	Window:      24 * time.Hour,
+}
+
+type LockedError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (le *LockedError) Error() string {
+	return fmt.Sprintf("%v is locked for %v", le.Key, le.RetryAfter)
+}
+
+// Lockout — срок блокировки после failures неудач подряд, 0 — блокировать рано.
+func (p Policy) Lockout(failures int) time.Duration {
+	if p.MaxFailures <= 0 || failures < p.MaxFailures {
+		return 0
+	}
+
+	lockout := p.BaseLockout
+	for i := p.MaxFailures; i < failures; i++ {
+		lockout *= 2
+		if lockout >= p.MaxLockout {
+			return p.MaxLockout
+		}
+	}
+
+	if lockout > p.MaxLockout {
+		return p.MaxLockout
+	}
+
+	return lockout
+}
+
+// Guard считает неудачные входы отдельно по логину и по адресу клиента.
+type Guard struct {
+	store Store
+	login Policy
+	ip    Policy
+	now   func() time.Time
+}
+
+func New(store Store, login Policy, ip Policy) *Guard {
+	return &Guard{
+		store: store,
+		login: login,
+		ip:    ip,
+		now:   time.Now,
+	}
+}
+
+func LoginKey(login string) string {
+	return "login:" + login
+}
+
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check возвращает LockedError, если заблокирован логин или адрес; RetryAfter — наибольший из сроков.
+func (g *Guard) Check(ctx context.Context, login string, ip string) error {
+	var locked *LockedError
+
+	for _, key := range []string{LoginKey(login), IPKey(ip)} {
+		_, lockedUntil, err := g.store.LoginAttempts(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		retryAfter := lockedUntil.Sub(g.now())
+		if retryAfter > 0 && (locked == nil || retryAfter > locked.RetryAfter) {
+			locked = &LockedError{Key: key, RetryAfter: retryAfter}
+		}
+	}
+
+	if locked != nil {
+		return locked
+	}
+
+	return nil
+}
+
+// Fail учитывает неудачный вход и при превышении порога блокирует логин и/или адрес.
+func (g *Guard) Fail(ctx context.Context, login string, ip string) error {
+	now := g.now()
+
+	for _, item := range []struct {
+		key    string
+		policy Policy
+	}{
+		{key: LoginKey(login), policy: g.login},
+		{key: IPKey(ip), policy: g.ip},
+	} {
+		failures, err := g.store.AddLoginFailure(ctx, item.key, now, item.policy.Window)
+		if err != nil {
+			return err
+		}
+
+		if lockout := item.policy.Lockout(failures); lockout > 0 {
+			if err := g.store.LockLogin(ctx, item.key, now.Add(lockout)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Succeed сбрасывает счётчик логина. Счётчик адреса не сбрасывается: иначе перебор чужих логинов
+// можно было бы обнулять входом в свой аккаунт.
+func (g *Guard) Succeed(ctx context.Context, login string) error {
+	return g.store.ResetLoginAttempts(ctx, LoginKey(login))
+}
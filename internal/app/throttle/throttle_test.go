@@ -0,0 +1,102 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestPolicy_Lockout(t *testing.T) {
+	p := Policy{MaxFailures: 3, BaseLockout: time.Second, MaxLockout: 10 * time.Second}
+
+	assert.Equal(t, time.Duration(0), p.Lockout(2))
+	assert.Equal(t, time.Second, p.Lockout(3))
+	assert.Equal(t, 2*time.Second, p.Lockout(4))
+	assert.Equal(t, 8*time.Second, p.Lockout(6))
+	assert.Equal(t, 10*time.Second, p.Lockout(7))
+	assert.Equal(t, 10*time.Second, p.Lockout(1000))
+
+	assert.Equal(t, time.Duration(0), Policy{}.Lockout(1000))
+}
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 1, 26, 12, 0, 0, 0, time.UTC)
+
+	login := Policy{MaxFailures: 3, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: 24 * time.Hour}
+	ip := Policy{MaxFailures: 5, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: 24 * time.Hour}
+
+	g := New(NewMemory(), login, ip)
+	g.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, g.Check(ctx, "alice", "10.0.0.1"))
+		require.NoError(t, g.Fail(ctx, "alice", "10.0.0.1"))
+	}
+	require.NoError(t, g.Check(ctx, "alice", "10.0.0.1"))
+
+	// третья неудача блокирует логин на минуту
+	require.NoError(t, g.Fail(ctx, "alice", "10.0.0.1"))
+
+	var le *LockedError
+	require.True(t, errors.As(g.Check(ctx, "alice", "10.0.0.2"), &le))
+	assert.Equal(t, LoginKey("alice"), le.Key)
+	assert.Equal(t, time.Minute, le.RetryAfter)
+
+	// после блокировки следующая неудача удваивает срок
+	now = now.Add(time.Minute)
+	require.NoError(t, g.Check(ctx, "alice", "10.0.0.1"))
+	require.NoError(t, g.Fail(ctx, "alice", "10.0.0.1"))
+	require.True(t, errors.As(g.Check(ctx, "alice", "10.0.0.1"), &le))
+	assert.Equal(t, 2*time.Minute, le.RetryAfter)
+
+	// перебор разных логинов с одного адреса блокирует адрес
+	require.NoError(t, g.Fail(ctx, "bob", "10.0.0.1"))
+	require.True(t, errors.As(g.Check(ctx, "carol", "10.0.0.1"), &le))
+	assert.Equal(t, IPKey("10.0.0.1"), le.Key)
+	require.NoError(t, g.Check(ctx, "carol", "10.0.0.3"))
+
+	// успешный вход сбрасывает логин, но не адрес
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, g.Succeed(ctx, "alice"))
+	require.NoError(t, g.Check(ctx, "alice", "10.0.0.2"))
+
+	failures, _, err := g.store.LoginAttempts(ctx, IPKey("10.0.0.1"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, failures)
+}
+
+func TestMemory_Window(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	now := time.Now()
+
+	failures, err := m.AddLoginFailure(ctx, "k", now, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+
+	failures, err = m.AddLoginFailure(ctx, "k", now.Add(30*time.Minute), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, failures)
+
+	// давние неудачи забываются
+	failures, err = m.AddLoginFailure(ctx, "k", now.Add(3*time.Hour), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+
+	// более ранний срок не сокращает блокировку
+	require.NoError(t, m.LockLogin(ctx, "k", now.Add(time.Hour)))
+	require.NoError(t, m.LockLogin(ctx, "k", now.Add(time.Minute)))
+
+	_, lockedUntil, err := m.LoginAttempts(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour), lockedUntil)
+
+	m.sweep(now.Add(48 * time.Hour))
+	failures, _, err = m.LoginAttempts(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, 0, failures)
+}
@@ -0,0 +1,99 @@
+package validation
+
+import (
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListQuery разбирает параметры списка: limit, after, status, from, to и sort.
+// withStatus — можно ли фильтровать по статусу: у списаний статус всегда PROCESSED.
+func ListQuery(query url.Values, withStatus bool) (repository.ListOptions, error) {
+	var opts repository.ListOptions
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > repository.MaxListLimit {
+			return opts, &FieldError{Field: "limit", Code: CodeInvalidValue, Message: "limit must be between 1 and " + strconv.Itoa(repository.MaxListLimit)}
+		}
+		opts.Limit = limit
+	}
+
+	if raw := query.Get("after"); raw != "" {
+		cursor, err := repository.ParseCursor(raw)
+		if err != nil {
+			return opts, &FieldError{Field: "after", Code: CodeInvalidValue, Message: err.Error()}
+		}
+		opts.After = cursor
+	}
+
+	if raw := query.Get("status"); raw != "" {
+		if !withStatus {
+			return opts, &FieldError{Field: "status", Code: CodeInvalidValue, Message: "status filter is not supported here"}
+		}
+
+		for _, name := range strings.Split(raw, ",") {
+			status, ok := repository.StatusCode(strings.ToUpper(strings.TrimSpace(name)))
+			if !ok {
+				return opts, &FieldError{Field: "status", Code: CodeInvalidValue, Message: "status must be NEW, PROCESSING, INVALID or PROCESSED"}
+			}
+			opts.Statuses = append(opts.Statuses, status)
+		}
+	}
+
+	var err error
+
+	if opts.From, opts.To, err = Period(query); err != nil {
+		return opts, err
+	}
+
+	switch query.Get("sort") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, &FieldError{Field: "sort", Code: CodeInvalidValue, Message: "sort must be asc or desc"}
+	}
+
+	// курсор от другой сортировки или других фильтров молча отдал бы не ту страницу
+	if err := opts.CheckCursor(); err != nil {
+		return opts, &FieldError{Field: "after", Code: CodeInvalidValue, Message: err.Error()}
+	}
+
+	return opts, nil
+}
+
+// Period разбирает необязательный период [from, to) в RFC 3339.
+func Period(query url.Values) (time.Time, time.Time, error) {
+	from, err := listTime(query, "from")
+	if err != nil {
+		return from, time.Time{}, err
+	}
+
+	to, err := listTime(query, "to")
+	if err != nil {
+		return from, to, err
+	}
+
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, &FieldError{Field: "to", Code: CodeInvalidValue, Message: "to must be after from"}
+	}
+
+	return from, to, nil
+}
+
+func listTime(query url.Values, field string) (time.Time, error) {
+	raw := query.Get(field)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, &FieldError{Field: field, Code: CodeInvalidValue, Message: field + " must be an RFC 3339 timestamp"}
+	}
+
+	return t, nil
+}
@@ -0,0 +1,202 @@
+package validation
+
+import (
+	"fmt"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	CodeRequired      = "required"
+	CodeTooShort      = "too_short"
+	CodeTooLong       = "too_long"
+	CodeInvalidChars  = "invalid_charset"
+	CodeWeakPassword  = "weak_password"
+	CodeNotPositive   = "not_positive"
+	CodeInvalidNumber = "invalid_order_number"
+	CodeInvalidValue  = "invalid_value"
+)
+
+const (
+	MinLoginLen    = 3
+	MaxLoginLen    = 64
+	MinPasswordLen = 8
+	// MaxPasswordLen не даёт прислать мегабайтный пароль на argon2
+	MaxPasswordLen = 128
+	MaxOrderLen    = 32
+	// MaxIdempotencyKeyLen — с запасом для UUID и ключей с префиксом клиента
+	MaxIdempotencyKeyLen = 255
+)
+
+// FieldError — ошибка в конкретном поле запроса; Code — машиночитаемая причина.
+type FieldError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+func (fe *FieldError) Error() string {
+	return fmt.Sprintf("%v: %v", fe.Field, fe.Message)
+}
+
+// Registration проверяет логин и пароль нового пользователя целиком, включая политику паролей.
+func Registration(ld repository.LoginData) error {
+	if err := login(ld.Login); err != nil {
+		return err
+	}
+
+	return password(ld.Password, ld.Login)
+}
+
+// Credentials — проверки для входа: только наличие и разумная длина.
+// Политику не применяем, иначе пользователи со старыми логинами и паролями не смогли бы войти.
+func Credentials(ld repository.LoginData) error {
+	if err := required("login", ld.Login); err != nil {
+		return err
+	}
+
+	if err := maxLen("login", ld.Login, MaxLoginLen); err != nil {
+		return err
+	}
+
+	if err := required("password", ld.Password); err != nil {
+		return err
+	}
+
+	return maxLen("password", ld.Password, MaxPasswordLen)
+}
+
+func Withdraw(wd repository.Withdraw) error {
+	if err := OrderNumber("order", wd.OrderID); err != nil {
+		return err
+	}
+
+	if wd.Points <= 0 {
+		return &FieldError{Field: "sum", Code: CodeNotPositive, Message: "sum must be positive"}
+	}
+
+	return nil
+}
+
+// IdempotencyKey — заголовок необязательный, но если передан, то печатный ASCII разумной длины.
+func IdempotencyKey(key string) error {
+	const field = "Idempotency-Key"
+
+	if err := maxLen(field, key, MaxIdempotencyKeyLen); err != nil {
+		return err
+	}
+
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			return &FieldError{Field: field, Code: CodeInvalidChars, Message: field + " may contain only printable ASCII characters"}
+		}
+	}
+
+	return nil
+}
+
+// OrderNumber: номер заказа — только цифры и проходит проверку по Луну.
+func OrderNumber(field string, number string) error {
+	if err := required(field, number); err != nil {
+		return err
+	}
+
+	if err := maxLen(field, number, MaxOrderLen); err != nil {
+		return err
+	}
+
+	if !luhn(number) {
+		return &FieldError{Field: field, Code: CodeInvalidNumber, Message: "order number is invalid"}
+	}
+
+	return nil
+}
+
+func login(value string) error {
+	if err := required("login", value); err != nil {
+		return err
+	}
+
+	if utf8.RuneCountInString(value) < MinLoginLen {
+		return &FieldError{Field: "login", Code: CodeTooShort, Message: fmt.Sprintf("login must be at least %v characters", MinLoginLen)}
+	}
+
+	if err := maxLen("login", value, MaxLoginLen); err != nil {
+		return err
+	}
+
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-@", c)) {
+			return &FieldError{Field: "login", Code: CodeInvalidChars, Message: "login may contain only latin letters, digits and . _ - @"}
+		}
+	}
+
+	return nil
+}
+
+func password(value string, login string) error {
+	if err := required("password", value); err != nil {
+		return err
+	}
+
+	if utf8.RuneCountInString(value) < MinPasswordLen {
+		return &FieldError{Field: "password", Code: CodeTooShort, Message: fmt.Sprintf("password must be at least %v characters", MinPasswordLen)}
+	}
+
+	if err := maxLen("password", value, MaxPasswordLen); err != nil {
+		return err
+	}
+
+	letters, digits := 0, 0
+	for _, c := range value {
+		switch {
+		case unicode.IsLetter(c):
+			letters++
+		case unicode.IsDigit(c):
+			digits++
+		}
+	}
+
+	if letters == 0 || digits == 0 || strings.EqualFold(value, login) {
+		return &FieldError{Field: "password", Code: CodeWeakPassword, Message: "password must contain letters and digits and differ from login"}
+	}
+
+	return nil
+}
+
+func required(field string, value string) error {
+	if strings.TrimSpace(value) == "" {
+		return &FieldError{Field: field, Code: CodeRequired, Message: field + " is required"}
+	}
+	return nil
+}
+
+func maxLen(field string, value string, max int) error {
+	if utf8.RuneCountInString(value) > max {
+		return &FieldError{Field: field, Code: CodeTooLong, Message: fmt.Sprintf("%v must be at most %v characters", field, max)}
+	}
+	return nil
+}
+
+func luhn(num string) bool {
+	total := 0
+	pos := 0
+	for i := len(num) - 1; i > -1; i-- {
+		char := num[i]
+		if char < '0' || char > '9' {
+			return false
+		}
+		digit := int(char - '0')
+		if pos%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		total += digit
+		pos++
+	}
+	return pos > 1 && total%10 == 0
+}
@@ -0,0 +1,140 @@
+package validation
+
+import (
+	"errors"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/money"
+	"github.com/DatDomrachev/go-loyalty-system/internal/app/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assertField(t *testing.T, err error, field string, code string) {
+	t.Helper()
+
+	var fe *FieldError
+	if assert.True(t, errors.As(err, &fe), "%v", err) {
+		assert.Equal(t, field, fe.Field)
+		assert.Equal(t, code, fe.Code)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	assert.NoError(t, Registration(repository.LoginData{Login: "user.name-1@example", Password: "s3cret-pass"}))
+
+	tests := []struct {
+		data  repository.LoginData
+		field string
+		code  string
+	}{
+		{repository.LoginData{Login: "", Password: "s3cret-pass"}, "login", CodeRequired},
+		{repository.LoginData{Login: "   ", Password: "s3cret-pass"}, "login", CodeRequired},
+		{repository.LoginData{Login: "ab", Password: "s3cret-pass"}, "login", CodeTooShort},
+		{repository.LoginData{Login: strings.Repeat("a", MaxLoginLen+1), Password: "s3cret-pass"}, "login", CodeTooLong},
+		{repository.LoginData{Login: "user name", Password: "s3cret-pass"}, "login", CodeInvalidChars},
+		{repository.LoginData{Login: "пользователь", Password: "s3cret-pass"}, "login", CodeInvalidChars},
+		{repository.LoginData{Login: "user", Password: ""}, "password", CodeRequired},
+		{repository.LoginData{Login: "user", Password: "s3cret"}, "password", CodeTooShort},
+		{repository.LoginData{Login: "user", Password: strings.Repeat("a1", MaxPasswordLen)}, "password", CodeTooLong},
+		{repository.LoginData{Login: "user", Password: "onlyletters"}, "password", CodeWeakPassword},
+		{repository.LoginData{Login: "user", Password: "1234567890"}, "password", CodeWeakPassword},
+		{repository.LoginData{Login: "user12345", Password: "USER12345"}, "password", CodeWeakPassword},
+	}
+
+	for _, tt := range tests {
+		assertField(t, Registration(tt.data), tt.field, tt.code)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	// старые учётки с короткими паролями по-прежнему входят
+	assert.NoError(t, Credentials(repository.LoginData{Login: "ab", Password: "test"}))
+
+	assertField(t, Credentials(repository.LoginData{Password: "test"}), "login", CodeRequired)
+	assertField(t, Credentials(repository.LoginData{Login: "ab"}), "password", CodeRequired)
+	assertField(t, Credentials(repository.LoginData{Login: "ab", Password: strings.Repeat("a", MaxPasswordLen+1)}), "password", CodeTooLong)
+}
+
+func TestWithdraw(t *testing.T) {
+	assert.NoError(t, Withdraw(repository.Withdraw{OrderID: "2377225624", Points: money.MustParse("0.01")}))
+
+	assertField(t, Withdraw(repository.Withdraw{Points: money.FromInt(5)}), "order", CodeRequired)
+	assertField(t, Withdraw(repository.Withdraw{OrderID: "2377225625", Points: money.FromInt(5)}), "order", CodeInvalidNumber)
+	assertField(t, Withdraw(repository.Withdraw{OrderID: "2377 225624", Points: money.FromInt(5)}), "order", CodeInvalidNumber)
+	assertField(t, Withdraw(repository.Withdraw{OrderID: "2377225624"}), "sum", CodeNotPositive)
+	assertField(t, Withdraw(repository.Withdraw{OrderID: "2377225624", Points: money.FromInt(-1)}), "sum", CodeNotPositive)
+}
+
+func TestOrderNumber(t *testing.T) {
+	for _, number := range []string{"12345678903", "9278923470", "4561261212345467"} {
+		assert.NoError(t, OrderNumber("number", number), number)
+	}
+
+	for _, number := range []string{"1", "0", "12345678904", "12a45678903", strings.Repeat("0", MaxOrderLen+1)} {
+		assert.Error(t, OrderNumber("number", number), number)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	assert.NoError(t, IdempotencyKey(""))
+	assert.NoError(t, IdempotencyKey("3f2c1e9a-6d0b-4a47-9c1e-2b8f5d7a1c30"))
+
+	assertField(t, IdempotencyKey(strings.Repeat("k", MaxIdempotencyKeyLen+1)), "Idempotency-Key", CodeTooLong)
+	assertField(t, IdempotencyKey("key with spaces"), "Idempotency-Key", CodeInvalidChars)
+	assertField(t, IdempotencyKey("ключ"), "Idempotency-Key", CodeInvalidChars)
+}
+
+func TestListQuery(t *testing.T) {
+	opts, err := ListQuery(url.Values{}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, repository.ListOptions{}, opts)
+
+	query := url.Values{
+		"limit":  {"20"},
+		"status": {"new, processed"},
+		"from":   {"2022-01-01T00:00:00Z"},
+		"to":     {"2022-03-01T00:00:00+03:00"},
+		"sort":   {"desc"},
+	}
+	first, err := ListQuery(query, true)
+	require.NoError(t, err)
+
+	cursor := first.Next(time.Date(2022, 2, 1, 10, 0, 0, 123000, time.UTC), 42)
+	query.Set("after", cursor.String())
+	opts, err = ListQuery(query, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, opts.Limit)
+	assert.True(t, cursor.At.Equal(opts.After.At))
+	assert.Equal(t, cursor.ID, opts.After.ID)
+	assert.Equal(t, []int{repository.StatusNew, repository.StatusProcessed}, opts.Statuses)
+	assert.Equal(t, time.Date(2022, 2, 28, 21, 0, 0, 0, time.UTC), opts.To.UTC())
+	assert.True(t, opts.Desc)
+
+	_, err = ListQuery(url.Values{"limit": {"abc"}}, true)
+	assertField(t, err, "limit", CodeInvalidValue)
+	_, err = ListQuery(url.Values{"after": {"bm90LWEtY3Vyc29y"}}, true)
+	assertField(t, err, "after", CodeInvalidValue)
+
+	// курсор годится только для той сортировки и тех фильтров, с которыми выдан
+	query.Set("sort", "asc")
+	_, err = ListQuery(query, true)
+	assertField(t, err, "after", CodeInvalidValue)
+
+	query.Set("sort", "desc")
+	query.Set("status", "new")
+	_, err = ListQuery(query, true)
+	assertField(t, err, "after", CodeInvalidValue)
+
+	// порядок статусов и размер страницы на курсор не влияют
+	query.Set("status", "PROCESSED,NEW")
+	query.Set("limit", "5")
+	_, err = ListQuery(query, true)
+	assert.NoError(t, err)
+	_, err = ListQuery(url.Values{"status": {"NEW"}}, false)
+	assertField(t, err, "status", CodeInvalidValue)
+	_, err = ListQuery(url.Values{"to": {"2022-01-01"}}, true)
+	assertField(t, err, "to", CodeInvalidValue)
+}
@@ -24,28 +24,46 @@ func worker(ctx context.Context, jobs <-chan Job, results chan<- Result) {
 	}
 }
 
+type DuplicateJobError struct {
+	ID JobID
+}
+
+type PoolStoppedError struct {
+	ID JobID
+}
+
+func (dje *DuplicateJobError) Error() string {
+	return fmt.Sprintf("job %v is already submitted", dje.ID)
+}
+
+func (pse *PoolStoppedError) Error() string {
+	return fmt.Sprintf("worker pool is stopped, job %v rejected", pse.ID)
+}
+
 type WorkerPool struct {
 	workersCount int
 	jobs         chan Job
-	results      chan Result
-	done 		 chan bool	
+	executed     chan Result
+	mu           sync.Mutex
+	pending      map[JobID]chan Result
+	stopped      bool
+	// done закрывается при остановке пула и отпускает задачи, которые ещё ждут места в jobs
+	done chan struct{}
 }
 
 type WorkerPooler interface {
-	Run(ctx context.Context) 
-	GenerateFrom(jobsBulk Job)
-	Results() <-chan Result
-	BroadcastDone(flag bool)
-	Done() <- chan bool
+	Run(ctx context.Context)
+	Submit(ctx context.Context, job Job) <-chan Result
 }
 
-func New(wcount int) (*WorkerPool) {
-	
+func New(wcount int) *WorkerPool {
+
 	workerPool := &WorkerPool{
 		workersCount: wcount,
 		jobs:         make(chan Job, wcount),
-		results:      make(chan Result, wcount),
-		done:		  make(chan bool),
+		executed:     make(chan Result, wcount),
+		pending:      make(map[JobID]chan Result),
+		done:         make(chan struct{}),
 	}
 
 	return workerPool
@@ -58,28 +76,98 @@ func (wp *WorkerPool) Run(ctx context.Context) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			worker(ctx, wp.jobs, wp.results)
+			worker(ctx, wp.jobs, wp.executed)
 		}()
 	}
 
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		wp.dispatch()
+	}()
+
 	wg.Wait()
-	close(wp.done)
-	close(wp.results)
+	close(wp.executed)
+	<-dispatched
+
+	wp.stop(ctx.Err())
 }
 
+// Submit ставит задачу в пул и возвращает канал, в который придёт результат именно этой задачи.
+// Канал закрывается после единственного результата.
+func (wp *WorkerPool) Submit(ctx context.Context, job Job) <-chan Result {
+	result := make(chan Result, 1)
+
+	wp.mu.Lock()
+	if wp.stopped {
+		wp.mu.Unlock()
+		result <- Result{Err: &PoolStoppedError{ID: job.Descriptor.ID}, Descriptor: job.Descriptor}
+		close(result)
+		return result
+	}
+
+	if _, ok := wp.pending[job.Descriptor.ID]; ok {
+		wp.mu.Unlock()
+		result <- Result{Err: &DuplicateJobError{ID: job.Descriptor.ID}, Descriptor: job.Descriptor}
+		close(result)
+		return result
+	}
+
+	wp.pending[job.Descriptor.ID] = result
+	wp.mu.Unlock()
 
-func (wp *WorkerPool) GenerateFrom(jobBulk Job) {
-		wp.jobs <- jobBulk
+	go func() {
+		select {
+		case wp.jobs <- job:
+		case <-ctx.Done():
+			wp.deliver(Result{Err: ctx.Err(), Descriptor: job.Descriptor})
+		case <-wp.done:
+			wp.deliver(Result{Err: &PoolStoppedError{ID: job.Descriptor.ID}, Descriptor: job.Descriptor})
+		}
+	}()
+
+	return result
 }
 
-func (wp *WorkerPool) Results() <-chan Result {
-	return wp.results
+// dispatch раздаёт результаты воркеров подписчикам; результат без подписчика
+// (например, ошибка отменённого воркера) отбрасывается.
+func (wp *WorkerPool) dispatch() {
+	for r := range wp.executed {
+		wp.deliver(r)
+	}
 }
 
-func (wp *WorkerPool) Done() <- chan bool  {
-	return wp.done
+// deliver отдаёт результат подписчику задачи, если он ещё ждёт.
+func (wp *WorkerPool) deliver(r Result) bool {
+	wp.mu.Lock()
+	ch, ok := wp.pending[r.Descriptor.ID]
+	if ok {
+		delete(wp.pending, r.Descriptor.ID)
+	}
+	wp.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	ch <- r
+	close(ch)
+	return true
 }
 
-func (wp *WorkerPool) BroadcastDone(flag bool) {
-	wp.done <- flag
+// stop завершает все задачи, которые так и не дошли до воркеров.
+func (wp *WorkerPool) stop(err error) {
+	wp.mu.Lock()
+	if !wp.stopped {
+		close(wp.done)
+	}
+	wp.stopped = true
+	pending := wp.pending
+	wp.pending = make(map[JobID]chan Result)
+	wp.mu.Unlock()
+
+	for id, ch := range pending {
+		ch <- Result{Err: err, Descriptor: JobDescriptor{ID: id}}
+		close(ch)
+	}
 }
@@ -3,7 +3,8 @@ package wpool
 import (
 	"context"
 	"fmt"
-	"strconv"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 	"errors"
@@ -11,8 +12,9 @@ import (
 )
 
 const (
-	jobsCount   = 10
-	workerCount = 2
+	jobsCount       = 10
+	workerCount     = 2
+	concurrentCount = 500
 )
 
 func TestWorkerPool(t *testing.T) {
@@ -23,88 +25,243 @@ func TestWorkerPool(t *testing.T) {
 
 	go wp.Run(ctx)
 
-	jobs:= testJobs()
+	jobs := testJobs()
 
-	
+	results := make([]<-chan Result, len(jobs))
 	for i := range jobs {
-		go wp.GenerateFrom(jobs[i])
+		results[i] = wp.Submit(ctx, jobs[i])
 	}
-	
-	results := 0;
 
-	for {
+	for i, ch := range results {
+		r := <-ch
+		if r.Err != nil {
+			t.Fatalf("unexpected error: %v", r.Err)
+		}
+
+		val := r.Value.(int)
+		if val != i*2 {
+			t.Fatalf("wrong value %v; expected %v", val, i*2)
+		}
+		log.Printf("result: %v", val)
+	}
+}
+
+func TestWorkerPool_TimeOut(t *testing.T) {
+	wp := New(workerCount)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Nanosecond*10)
+	defer cancel()
+
+	pending := wp.Submit(context.TODO(), testJob(1, 0))
+
+	wp.Run(ctx)
+
+	r := <-pending
+	if r.Err != nil && r.Err != context.DeadlineExceeded {
+		t.Fatalf("expected error: %v; got: %v", context.DeadlineExceeded, r.Err)
+	}
+}
+
+func TestWorkerPool_Cancel(t *testing.T) {
+	wp := New(workerCount)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+
+	cancel()
+	wp.Run(ctx)
+
+	r := <-wp.Submit(context.TODO(), testJob(1, 0))
+	var pse *PoolStoppedError
+	if !errors.As(r.Err, &pse) {
+		t.Fatalf("expected pool stopped error; got: %v", r.Err)
+	}
+}
+
+// задачи, которые ждали места в очереди, когда пул остановился, получают ошибку,
+// даже если контекст вызывающего ещё жив, и их горутины не остаются висеть
+func TestWorkerPool_StopReleasesWaiting(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	wp := New(1)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+
+	pending := make([]<-chan Result, jobsCount)
+	for i := range pending {
+		pending[i] = wp.Submit(context.TODO(), testJob(i, 0))
+	}
+
+	cancel()
+	wp.Run(ctx)
+
+	for i, ch := range pending {
 		select {
-		case r, ok := <-wp.Results():
+		case r := <-ch:
+			if r.Err == nil && r.Value.(int) != i*2 {
+				t.Fatalf("wrong value %v; expected %v", r.Value, i*2)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("job %v got no result after pool stop", i)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%v goroutines leaked", n-before)
+	}
+}
+
+func TestWorkerPool_Submit(t *testing.T) {
+	wp := New(workerCount)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	go wp.Run(ctx)
+
+	jobs := make([]Job, concurrentCount)
+	for i := range jobs {
+		jobs[i] = testJob(i, 0)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentCount)
+
+	for i := range jobs {
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+
+			r, ok := <-wp.Submit(ctx, job)
 			if !ok {
-				continue
+				errs <- fmt.Errorf("job %v: channel closed without result", job.Descriptor.ID)
+				return
 			}
 
-			i, err := strconv.ParseInt(string(r.Descriptor.ID), 10, 64)
-			if err != nil {
-				t.Fatalf("unexpected error: %v", err)
+			if r.Descriptor.ID != job.Descriptor.ID {
+				errs <- fmt.Errorf("job %v: got result of job %v", job.Descriptor.ID, r.Descriptor.ID)
+				return
 			}
 
-			val := r.Value.(int)
-			if val != int(i)*2 {
-				t.Fatalf("wrong value %v; expected %v", val, int(i)*2)
-			} else {
-				log.Printf("result: %v", val)
-				results = results + 1
-				if results == jobsCount {
-					go wp.BroadcastDone(true)
-				}
+			if r.Err != nil {
+				errs <- fmt.Errorf("job %v: unexpected error %v", job.Descriptor.ID, r.Err)
+				return
 			}
-		case <-wp.Done():
-			log.Print("done")
-			return
-		default:
-			log.Print("waiting")
-		}
+
+			if r.Value.(int) != job.Args.(int)*2 {
+				errs <- fmt.Errorf("job %v: wrong value %v; expected %v", job.Descriptor.ID, r.Value, job.Args.(int)*2)
+			}
+		}(jobs[i])
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
 	}
 }
 
-func TestWorkerPool_TimeOut(t *testing.T) {
+func TestWorkerPool_SubmitIsolation(t *testing.T) {
 	wp := New(workerCount)
 
-	ctx, cancel := context.WithTimeout(context.TODO(), time.Nanosecond*10)
+	ctx, cancel := context.WithCancel(context.TODO())
 	defer cancel()
 
 	go wp.Run(ctx)
 
-	for {
-		select {
-		case r := <-wp.Results():
-			if r.Err != nil && r.Err != context.DeadlineExceeded {
-				t.Fatalf("expected error: %v; got: %v", context.DeadlineExceeded, r.Err)
-			}
-		case <-wp.Done():
-			return
-		default:
-			log.Print("waiting")
+	// медленные задачи не должны получать чужие результаты, даже если быстрые завершаются раньше
+	slow := wp.Submit(ctx, testJob(1, 50*time.Millisecond))
+
+	fast := make([]<-chan Result, concurrentCount)
+	for i := range fast {
+		fast[i] = wp.Submit(ctx, testJob(i+2, 0))
+	}
+
+	for i, ch := range fast {
+		r := <-ch
+		if r.Value.(int) != (i+2)*2 {
+			t.Fatalf("wrong value %v; expected %v", r.Value, (i+2)*2)
 		}
 	}
+
+	r := <-slow
+	if r.Err != nil || r.Value.(int) != 2 {
+		t.Fatalf("wrong slow result %+v", r)
+	}
+
+	if _, ok := <-slow; ok {
+		t.Fatalf("expected closed channel after single result")
+	}
 }
 
-func TestWorkerPool_Cancel(t *testing.T) {
+func TestWorkerPool_SubmitDuplicate(t *testing.T) {
 	wp := New(workerCount)
 
 	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	first := wp.Submit(ctx, testJob(1, 0))
+	second := wp.Submit(ctx, testJob(1, 0))
+
+	r := <-second
+	var dje *DuplicateJobError
+	if !errors.As(r.Err, &dje) {
+		t.Fatalf("expected duplicate error; got: %v", r.Err)
+	}
 
 	go wp.Run(ctx)
+
+	r = <-first
+	if r.Err != nil || r.Value.(int) != 2 {
+		t.Fatalf("wrong result %+v", r)
+	}
+}
+
+func TestWorkerPool_SubmitCancel(t *testing.T) {
+	wp := New(workerCount)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+
+	pending := make([]<-chan Result, jobsCount)
+	for i := range pending {
+		pending[i] = wp.Submit(context.TODO(), testJob(i, 0))
+	}
+
 	cancel()
+	wp.Run(ctx)
 
-	for {
-		select {
-		case r := <-wp.Results():
-			if r.Err != nil && r.Err != context.Canceled {
-				t.Fatalf("expected error: %v; got: %v", context.Canceled, r.Err)
-			}
-		case <-wp.Done():
-			return
-		default:
-			log.Print("waiting")
+	for _, ch := range pending {
+		r := <-ch
+		if r.Err != nil && r.Err != context.Canceled {
+			t.Fatalf("expected error: %v; got: %v", context.Canceled, r.Err)
 		}
 	}
+
+	r := <-wp.Submit(context.TODO(), testJob(jobsCount, 0))
+	var pse *PoolStoppedError
+	if !errors.As(r.Err, &pse) {
+		t.Fatalf("expected pool stopped error; got: %v", r.Err)
+	}
+}
+
+func testJob(i int, delay time.Duration) Job {
+	return Job{
+		Descriptor: JobDescriptor{
+			ID:       JobID(fmt.Sprintf("%v", i)),
+			JType:    "anyType",
+			Metadata: nil,
+		},
+		ExecFn: func(ctx context.Context, args interface{}) (interface{}, error) {
+			time.Sleep(delay)
+			return args.(int) * 2, nil
+		},
+		Args: i,
+	}
 }
 
 func testJobs() []Job {
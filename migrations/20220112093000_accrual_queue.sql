@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE if not exists accrual_queue (
+	order_id text primary key,
+	user_token text,
+	attempts integer default 0,
+	next_attempt_at TIMESTAMPTZ default now(),
+	created_at TIMESTAMPTZ default now()
+);
+
+CREATE INDEX IF NOT EXISTS accrual_queue_next_attempt ON accrual_queue(next_attempt_at);
+
+INSERT INTO accrual_queue (order_id, user_token)
+SELECT order_id, user_token FROM transactions WHERE type = 1 AND status IN (1, 2)
+ON CONFLICT (order_id) DO NOTHING;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF exists accrual_queue_next_attempt;
+DROP TABLE if exists accrual_queue;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE accrual_queue ADD COLUMN IF NOT EXISTS accrual_status text;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE accrual_queue DROP COLUMN IF EXISTS accrual_status;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+	ALTER COLUMN balance TYPE numeric(16,2) USING round(balance::numeric, 2),
+	ALTER COLUMN balance SET DEFAULT 0,
+	ALTER COLUMN withdrawn TYPE numeric(16,2) USING round(withdrawn::numeric, 2),
+	ALTER COLUMN withdrawn SET DEFAULT 0;
+
+ALTER TABLE transactions
+	ALTER COLUMN points TYPE numeric(16,2) USING round(points::numeric, 2),
+	ALTER COLUMN points SET DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE transactions
+	ALTER COLUMN points TYPE float USING points::float,
+	ALTER COLUMN points SET DEFAULT 0.0;
+
+ALTER TABLE users
+	ALTER COLUMN balance TYPE float USING balance::float,
+	ALTER COLUMN balance SET DEFAULT 0.0,
+	ALTER COLUMN withdrawn TYPE float USING withdrawn::float,
+	ALTER COLUMN withdrawn SET DEFAULT 0.0;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- повторное списание по тому же заказу больше не проходит; если в базе уже есть дубли,
+-- индекс не создастся и их нужно разобрать вручную — автоматически вернуть баллы нельзя
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_withdraw_order ON transactions(order_id, type) WHERE type = 2;
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS idempotency_key text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_idempotency_key ON transactions(user_token, idempotency_key) WHERE idempotency_key IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS transactions_idempotency_key;
+ALTER TABLE transactions DROP COLUMN IF EXISTS idempotency_key;
+DROP INDEX IF EXISTS transactions_withdraw_order;
+-- +goose StatementEnd
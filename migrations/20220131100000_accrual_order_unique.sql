@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- один номер заказа на начисление — один владелец; дубли, оставшиеся от гонки при загрузке,
+-- нужно разобрать до применения миграции
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_accrual_order ON transactions(order_id, type) WHERE type = 1;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS transactions_accrual_order;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- списки заказов и списаний листаются по (время, id) внутри пользователя и типа
+CREATE INDEX IF NOT EXISTS transactions_user_uploaded ON transactions(user_token, type, uploaded_at, id);
+CREATE INDEX IF NOT EXISTS transactions_user_processed ON transactions(user_token, type, processed_at, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS transactions_user_processed;
+DROP INDEX IF EXISTS transactions_user_uploaded;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- у каждой партии (начисления) не больше одной записи о сгорании, её номер заказа — номер партии
+CREATE UNIQUE INDEX IF NOT EXISTS transactions_expiration_order ON transactions(order_id, type) WHERE type = 3;
+-- поиск партий, которым пора сгорать
+CREATE INDEX IF NOT EXISTS transactions_accrual_processed ON transactions(processed_at) WHERE type = 1 AND status = 4;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS transactions_accrual_processed;
+DROP INDEX IF EXISTS transactions_expiration_order;
+-- +goose StatementEnd
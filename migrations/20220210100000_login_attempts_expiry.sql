@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- до какого момента помнится последняя неудача; окно у логинов и адресов своё, поэтому хранится в строке
+ALTER TABLE login_attempts ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+UPDATE login_attempts SET expires_at = last_failure_at + interval '24 hours' WHERE expires_at IS NULL;
+CREATE INDEX IF NOT EXISTS login_attempts_expires_at ON login_attempts(expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS login_attempts_expires_at;
+ALTER TABLE login_attempts DROP COLUMN IF EXISTS expires_at;
+-- +goose StatementEnd
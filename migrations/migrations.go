@@ -0,0 +1,8 @@
+// Package migrations встраивает SQL-миграции в бинарник, чтобы сервис и команда
+// gophermart migrate применяли одни и те же файлы.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS